@@ -1,58 +1,464 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/furmanp/gitlab-activity-importer/internal"
 	"github.com/furmanp/gitlab-activity-importer/internal/services"
 )
 
+// Version is set at build time by the release workflow.
+var Version = "dev"
+
+// exitTokenExpired lets schedulers tell an expired GitLab token apart from
+// other failures.
+const exitTokenExpired = 3
+
 func main() {
-	startNow := time.Now()
-	err := internal.CheckEnvVariables()
+	services.ImporterVersion = Version
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "login":
+			runLogin(os.Args[2:])
+		case "doctor":
+			runDoctor()
+		case "cache":
+			runCache(os.Args[2:])
+		case "preview":
+			runPreview(os.Args[2:])
+		case "purge":
+			runPurge(os.Args[2:])
+		case "verify":
+			runVerify()
+		default:
+			log.Fatalf("Unknown command: %v", os.Args[1])
+		}
+		return
+	}
+
+	runImport()
+}
+
+// runLogin logs into BASE_URL, or the GITLAB_INSTANCES entry named by the
+// first argument.
+func runLogin(args []string) {
+	if err := internal.LoadEnvFile(); err != nil {
+		log.Fatalf("Error during loading environmental variables: %v", err)
+	}
+	if len(args) == 0 && os.Getenv("BASE_URL") == "" {
+		log.Fatal("BASE_URL is required for the login.")
+	}
+	if err := services.ConfigureHTTPClient(); err != nil {
+		log.Fatalf("Error during configuring the HTTP client: %v", err)
+	}
+
+	var oauth *services.OAuthTokenSource
+	var err error
+	if len(args) > 0 {
+		oauth, err = services.NewInstanceOAuthTokenSource(args[0])
+	} else {
+		oauth, err = services.NewOAuthTokenSourceFromEnv(os.Getenv("BASE_URL"))
+	}
 	if err != nil {
+		log.Fatalf("Error during reading OAuth settings: %v", err)
+	}
+	if err := oauth.Login(os.Getenv("GITLAB_OAUTH_PORT")); err != nil {
+		log.Fatalf("Error during the OAuth login: %v", err)
+	}
+}
+
+func runDoctor() {
+	if !services.PrintChecklist(os.Stdout, services.DoctorFromEnv()) {
+		os.Exit(1)
+	}
+}
+
+func runCache(args []string) {
+	if len(args) != 1 || args[0] != "clear" {
+		log.Fatal("Usage: cache clear")
+	}
+	if err := internal.LoadEnvFile(); err != nil {
 		log.Fatalf("Error during loading environmental variables: %v", err)
 	}
 
-	gitlabUser, err := services.GetGitlabUser()
+	dir := os.Getenv("HTTP_CACHE_DIR")
+	if dir == "" {
+		log.Fatal("HTTP_CACHE_DIR is not set, there is no cache to clear.")
+	}
+	removed, err := services.ClearHTTPCache(dir)
+	if err != nil {
+		log.Fatalf("Error during clearing the HTTP cache: %v", err)
+	}
+	log.Printf("Removed %v cached responses from %v.\n", removed, dir)
+}
+
+func runPreview(args []string) {
+	if len(args) > 1 {
+		log.Fatal("Usage: preview [output.svg]")
+	}
 
+	err := services.CheckEnvVariables()
 	if err != nil {
-		log.Fatalf("Error during reading GitLab User data: %v", err)
+		log.Fatalf("Error during loading environmental variables: %v", err)
+	}
+	if err := services.ConfigureHTTPClient(); err != nil {
+		log.Fatalf("Error during configuring the HTTP client: %v", err)
+	}
+	datePolicy, err := services.DatePolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading commit date settings: %v", err)
+	}
+	location, err := services.GraphTimezoneFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading graph settings: %v", err)
+	}
+	aggregation, err := services.AggregationModeFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading aggregation settings: %v", err)
 	}
+	obfuscation := obfuscationFromEnv(location, aggregation)
 
-	gitLabUserId := gitlabUser.ID
+	sources, err := services.SourcesFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading sources: %v", err)
+	}
+	projects, err := services.ListAllProjects(sources)
+	if err != nil {
+		log.Fatalf("Error during getting users projects: %v", err)
+	}
 
-	var projectIds []int
-	projectIds, err = services.GetUsersProjectsIds(gitLabUserId)
+	commitChannel := make(chan []internal.Commit, len(projects))
+	go services.FetchAllCommits(projects, commitChannel)
+	var commits []internal.Commit
+	for batch := range commitChannel {
+		commits = append(commits, batch...)
+	}
 
+	repo, err := services.OpenMirrorReadOnly()
+	if err != nil {
+		log.Fatalf("Error during reading the mirror: %v", err)
+	}
+	existing, err := services.MirrorCommitDates(repo)
 	if err != nil {
+		log.Fatalf("Error during reading the mirror history: %v", err)
+	}
+	calendar := services.NewCalendar(time.Now(), location)
+	for _, date := range existing {
+		calendar.AddExisting(date)
+	}
+
+	if aggregation == services.AggregateNone {
+		pending, err := services.ObfuscatePending(repo, commits, obfuscation, datePolicy)
+		if err != nil {
+			log.Fatalf("Error during reading the mirror history: %v", err)
+		}
+		for _, commit := range pending {
+			calendar.AddPending(datePolicy.Date(commit))
+		}
+	} else {
+		groups, err := services.PendingGroups(repo, obfuscation.Apply(commits, nil, datePolicy), aggregation, datePolicy, location)
+		if err != nil {
+			log.Fatalf("Error during reading the mirror history: %v", err)
+		}
+		for _, group := range groups {
+			calendar.AddPending(group.Date)
+		}
+	}
+	calendar.RenderText(os.Stdout)
+
+	if len(args) == 1 {
+		file, err := os.Create(args[0])
+		if err != nil {
+			log.Fatalf("Error during writing the preview: %v", err)
+		}
+		defer file.Close()
+		if err := calendar.RenderSVG(file); err != nil {
+			log.Fatalf("Error during writing the preview: %v", err)
+		}
+		log.Printf("Wrote the contribution graph preview to %v.\n", args[0])
+	}
+}
+
+func runVerify() {
+	err := services.CheckEnvVariables()
+	if err != nil {
+		log.Fatalf("Error during loading environmental variables: %v", err)
+	}
+	if err := services.ConfigureHTTPClient(); err != nil {
+		log.Fatalf("Error during configuring the HTTP client: %v", err)
+	}
+	builder, err := services.NewMessageBuilderFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading commit message settings: %v", err)
+	}
+	datePolicy, err := services.DatePolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading commit date settings: %v", err)
+	}
+	location, err := services.GraphTimezoneFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading graph settings: %v", err)
+	}
+	aggregation, err := services.AggregationModeFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading aggregation settings: %v", err)
+	}
+	obfuscation := obfuscationFromEnv(location, aggregation)
+
+	sources, err := services.SourcesFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading sources: %v", err)
+	}
+	projects, err := services.ListAllProjects(sources)
+	if err != nil {
+		exitOnExpiredToken(err)
 		log.Fatalf("Error during getting users projects: %v", err)
 	}
-	if len(projectIds) == 0 {
+	commits, failed := services.FetchCommitsForVerify(projects, builder)
+
+	repo, err := services.OpenMirrorReadOnly()
+	if err != nil {
+		log.Fatalf("Error during reading the mirror: %v", err)
+	}
+	report, err := services.VerifyMirror(repo, commits, services.VerifyOptions{
+		Policy:      datePolicy,
+		Obfuscation: obfuscation,
+		Aggregation: aggregation,
+		Location:    location,
+		Unverified:  failed,
+		Sources:     sources,
+		Builder:     builder,
+	})
+	if err != nil {
+		log.Fatalf("Error during verifying the mirror: %v", err)
+	}
+	report.Print(os.Stdout)
+
+	if report.Drift() || len(failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runPurge(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	projects := flags.String("project", "", "comma separated project paths to remove")
+	since := flags.String("since", "", "remove commits from this day on (YYYY-MM-DD)")
+	until := flags.String("until", "", "remove commits up to this day (YYYY-MM-DD)")
+	shas := flags.String("sha", "", "comma separated source commit SHAs to remove")
+	shaFile := flags.String("sha-file", "", "file with one source commit SHA per line to remove")
+	dryRun := flags.Bool("dry-run", false, "only print what would be removed")
+	flags.Parse(args)
+
+	filter := services.PurgeFilter{
+		Projects: splitFlag(*projects),
+		Since:    *since,
+		Until:    *until,
+		SHAs:     splitFlag(*shas),
+	}
+	for _, day := range []string{filter.Since, filter.Until} {
+		if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+			log.Fatalf("Invalid day %v, expected YYYY-MM-DD.", day)
+		}
+	}
+	if *shaFile != "" {
+		data, err := os.ReadFile(*shaFile)
+		if err != nil {
+			log.Fatalf("Error during reading %v: %v", *shaFile, err)
+		}
+		filter.SHAs = append(filter.SHAs, strings.Fields(string(data))...)
+	}
+	if filter.Empty() {
+		log.Fatal("Usage: purge [-dry-run] [-project paths] [-since YYYY-MM-DD] [-until YYYY-MM-DD] [-sha shas] [-sha-file file]")
+	}
+
+	if err := internal.LoadEnvFile(); err != nil {
+		log.Fatalf("Error during loading environmental variables: %v", err)
+	}
+	if err := services.ConfigureHTTPClient(); err != nil {
+		log.Fatalf("Error during configuring the HTTP client: %v", err)
+	}
+	builder, err := services.NewMessageBuilderFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading commit message settings: %v", err)
+	}
+	destinations, err := services.DestinationsFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading destinations: %v", err)
+	}
+
+	repo := services.OpenOrInitClone()
+	result, err := services.PurgeMirror(repo, filter, builder, *dryRun)
+	if err != nil {
+		log.Fatalf("Error during purging the mirror: %v", err)
+	}
+
+	for _, commit := range result.Removed {
+		title, _, _ := strings.Cut(commit.Message, "\n")
+		fmt.Printf("- %s %s %s\n", commit.Hash.String()[:8], commit.Author.When.Format("2006-01-02"), title)
+	}
+	for _, change := range result.Changes {
+		action, _ := change.Action()
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		fmt.Printf("  %-6s %s\n", strings.ToLower(action.String()), name)
+	}
+	for _, rewritten := range result.Rewritten {
+		title, _, _ := strings.Cut(rewritten.Commit.Message, "\n")
+		fmt.Printf("\n~ %s %s %s\n%s", rewritten.Commit.Hash.String()[:8], rewritten.Commit.Author.When.Format("2006-01-02"), title, rewritten.Patch)
+	}
+	fmt.Printf("%d commits match the purge filter.\n", len(result.Removed))
+	if len(filter.Projects) > 0 && result.Unattributed > 0 {
+		fmt.Printf("%d imported commits carry no project and can only be purged by day or SHA.\n", result.Unattributed)
+	}
+
+	if *dryRun || len(result.Removed) == 0 {
+		return
+	}
+	if err := services.ForcePublishAll(repo, destinations, result.Branches()); err != nil {
+		log.Fatalf("Error during publishing the mirror: %v", err)
+	}
+}
+
+func splitFlag(value string) []string {
+	var values []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	return values
+}
+
+func runImport() {
+	startNow := time.Now()
+	err := services.CheckEnvVariables()
+	if err != nil {
+		log.Fatalf("Error during loading environmental variables: %v", err)
+	}
+
+	if err := services.ConfigureHTTPClient(); err != nil {
+		log.Fatalf("Error during configuring the HTTP client: %v", err)
+	}
+	if _, err := services.NewMessageBuilderFromEnv(); err != nil {
+		log.Fatalf("Error during reading commit message settings: %v", err)
+	}
+	if _, err := services.ContentMirrorMode(); err != nil {
+		log.Fatalf("Error during reading content mirroring settings: %v", err)
+	}
+	datePolicy, err := services.DatePolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading commit date settings: %v", err)
+	}
+	location, err := services.GraphTimezoneFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading graph settings: %v", err)
+	}
+	aggregation, err := services.AggregationModeFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading aggregation settings: %v", err)
+	}
+	obfuscation := obfuscationFromEnv(location, aggregation)
+	destinations, err := services.DestinationsFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading destinations: %v", err)
+	}
+
+	sources, err := services.SourcesFromEnv()
+	if err != nil {
+		log.Fatalf("Error during reading sources: %v", err)
+	}
+
+	window, err := services.TokenExpiryWindow()
+	if err != nil {
+		log.Fatalf("Error during reading token expiry settings: %v", err)
+	}
+	for _, source := range sources {
+		if gitlab, ok := source.(*services.GitLabSource); ok {
+			exitOnExpiredToken(gitlab.CheckTokenExpiry(window, time.Now()))
+		}
+	}
+
+	projects, err := services.ListAllProjects(sources)
+	if err != nil {
+		exitOnExpiredToken(err)
+		log.Fatalf("Error during getting users projects: %v", err)
+	}
+	if len(projects) == 0 {
 		log.Print("No contributions found for this user. Closing the program.")
 		return
 	}
 
-	log.Printf("Found contributions in %v projects \n", len(projectIds))
+	log.Printf("Found contributions in %v projects \n", len(projects))
 
 	repo := services.OpenOrInitClone()
 
-	commitChannel := make(chan []internal.Commit, len(projectIds))
+	commitChannel := make(chan []internal.Commit, len(projects))
 
+	importDone := make(chan struct{})
 	go func() {
+		defer close(importDone)
 		totalCommits := 0
-		for commits := range commitChannel {
-			localCommits := services.CreateLocalCommit(repo, commits)
-			totalCommits += localCommits
+		if aggregation == services.AggregateNone && !obfuscation.Enabled() {
+			importer := services.NewImporter(repo)
+			for commits := range commitChannel {
+				totalCommits += importer.Import(commits)
+			}
+		} else {
+			// Groups and obfuscated days span projects and batches, so they
+			// are built once everything has been fetched.
+			var allCommits []internal.Commit
+			for commits := range commitChannel {
+				allCommits = append(allCommits, commits...)
+			}
+			if aggregation == services.AggregateNone {
+				pending, err := services.ObfuscatePending(repo, allCommits, obfuscation, datePolicy)
+				if err != nil {
+					log.Fatalf("Error during reading the mirror history: %v", err)
+				}
+				totalCommits = services.CreateLocalCommit(repo, pending)
+			} else {
+				totalCommits = services.CreateAggregatedCommits(repo, obfuscation.Apply(allCommits, nil, datePolicy), aggregation)
+			}
 		}
 		log.Printf("Imported %v commits.\n", totalCommits)
 
 	}()
 
-	services.FetchAllCommits(projectIds, os.Getenv("COMMITER_NAME"), commitChannel)
+	services.FetchAllCommits(projects, commitChannel)
+	<-importDone
 
-	services.PushLocalCommits(repo)
+	if err := services.PublishAll(repo, destinations); err != nil {
+		log.Fatalf("Error during publishing the mirror: %v", err)
+	}
 	log.Printf("Operation took: %v in total.", time.Since(startNow))
 }
+
+// obfuscationFromEnv reads the obfuscation policies. Aggregated mirrors
+// count contributions per group, so only jitter applies to them.
+func obfuscationFromEnv(location *time.Location, aggregation string) services.Obfuscation {
+	obfuscation, err := services.ObfuscationFromEnv(location)
+	if err != nil {
+		log.Fatalf("Error during reading obfuscation settings: %v", err)
+	}
+	if aggregation != services.AggregateNone && obfuscation.LimitsCounts() {
+		log.Fatal("OBFUSCATE cap and levels cannot be combined with AGGREGATION, use jitter only.")
+	}
+	return obfuscation
+}
+
+func exitOnExpiredToken(err error) {
+	var expired *services.TokenExpiredError
+	if errors.As(err, &expired) {
+		log.Print(expired)
+		os.Exit(exitTokenExpired)
+	}
+}
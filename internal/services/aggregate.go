@@ -0,0 +1,225 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const (
+	AggregateNone       = "none"
+	AggregateProjectDay = "project-day"
+	AggregateDay        = "day"
+
+	sourceGroupTrailer = "Source-Group"
+	sourceCountTrailer = "Source-Count"
+	sourceKeysTrailer  = "Source-Keys"
+)
+
+// CommitGroup is a set of source commits mirrored as a single commit.
+type CommitGroup struct {
+	// Key identifies the group across runs, e.g. "day:2024-06-10".
+	Key         string
+	Day         string
+	ProjectPath string
+	// Date is the latest commit date of the group, in the timezone the
+	// day was bucketed in.
+	Date    time.Time
+	Commits []internal.Commit
+}
+
+func AggregationModeFromEnv() (string, error) {
+	mode := strings.TrimSpace(os.Getenv("AGGREGATION"))
+	switch mode {
+	case "":
+		return AggregateNone, nil
+	case AggregateNone, AggregateProjectDay, AggregateDay:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown AGGREGATION mode: %v", mode)
+	}
+}
+
+// GroupCommits buckets commits into days in location, or their own offset
+// when location is nil, and per project in project-day mode. Groups are
+// sorted by date.
+func GroupCommits(commits []internal.Commit, mode string, policy DatePolicy, location *time.Location) []CommitGroup {
+	groups := make(map[string]*CommitGroup)
+	seen := make(map[string]bool)
+
+	for _, commit := range commits {
+		if seen[commit.Key()] {
+			continue
+		}
+		seen[commit.Key()] = true
+
+		date := policy.Date(commit)
+		if location != nil {
+			date = date.In(location)
+		}
+		day := date.Format("2006-01-02")
+
+		key := "day:" + day
+		if mode == AggregateProjectDay {
+			key = fmt.Sprintf("project-day:%s:%s", projectKey(commit), day)
+		}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &CommitGroup{Key: key, Day: day}
+			if mode == AggregateProjectDay {
+				group.ProjectPath = commit.ProjectPath
+			}
+			groups[key] = group
+		}
+		group.Commits = append(group.Commits, commit)
+		if date.After(group.Date) {
+			group.Date = date
+		}
+	}
+
+	sorted := make([]CommitGroup, 0, len(groups))
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].Date.Equal(sorted[j].Date) {
+			return sorted[i].Date.Before(sorted[j].Date)
+		}
+		return sorted[i].Key < sorted[j].Key
+	})
+	return sorted
+}
+
+// projectKey identifies the project in group keys without spelling out
+// its path.
+func projectKey(commit internal.Commit) string {
+	return shortHash(commit.Instance + ":" + commit.ProjectPath + ":" + strconv.Itoa(commit.ProjectID))
+}
+
+func shortHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Stats sums the line counts of the group's commits.
+func (g CommitGroup) Stats() internal.CommitStats {
+	var stats internal.CommitStats
+	for _, commit := range g.Commits {
+		stats.Additions += commit.Stats.Additions
+		stats.Deletions += commit.Stats.Deletions
+		stats.Total += commit.Stats.Total
+	}
+	return stats
+}
+
+// Message describes the count new commits of the group, whose hashed
+// source keys are recorded in keys. imported is how many were mirrored by
+// earlier runs already.
+func (g CommitGroup) Message(builder *MessageBuilder, count int, imported int, keys []string) string {
+	var message strings.Builder
+
+	if g.ProjectPath != "" {
+		fmt.Fprintf(&message, "%d contributions to %s on %s", count, builder.ProjectName(g.ProjectPath), g.Day)
+	} else {
+		fmt.Fprintf(&message, "%d contributions on %s", count, g.Day)
+
+		perProject := make(map[string]int)
+		var names []string
+		for _, commit := range g.Commits {
+			name := builder.ProjectName(commit.ProjectPath)
+			if name == "" {
+				name = fmt.Sprintf("project %d", commit.ProjectID)
+			}
+			if perProject[name] == 0 {
+				names = append(names, name)
+			}
+			perProject[name]++
+		}
+		sort.Strings(names)
+
+		message.WriteString("\n")
+		for _, name := range names {
+			fmt.Fprintf(&message, "\n%s: %d", name, perProject[name])
+		}
+	}
+
+	if imported > 0 {
+		fmt.Fprintf(&message, "\n\n%d contributions of this day were imported before.", imported)
+	}
+	provenance := Provenance{
+		Group:           g.Key,
+		Count:           count,
+		Keys:            keys,
+		ProjectPath:     builder.ProjectName(g.ProjectPath),
+		ImporterVersion: ImporterVersion,
+	}
+	message.WriteString("\n\n" + provenance.Trailers())
+	return message.String()
+}
+
+// sourceKeyHash is how an aggregated commit records a source commit it
+// covers, without spelling out its SHA.
+func sourceKeyHash(commit internal.Commit) string {
+	return shortHash(commit.Key())
+}
+
+// groupCoverage tells which source commits of a group the mirror covers,
+// through 1:1 imports, the source keys of aggregated commits and the
+// purge records.
+type groupCoverage struct {
+	existing map[string]bool
+	keys     map[string]bool
+	// legacy counts the commits of groups only mirrored by aggregated
+	// commits without source keys.
+	legacy map[string]int
+}
+
+func newGroupCoverage(messages []string, existing map[string]bool, purgedGroups map[string]int, purgedKeys map[string]bool) *groupCoverage {
+	coverage := &groupCoverage{existing: existing, keys: make(map[string]bool), legacy: make(map[string]int)}
+	keyed := make(map[string]bool)
+	for _, message := range messages {
+		provenance := ParseProvenance(message)
+		if provenance.Group == "" {
+			continue
+		}
+		if len(provenance.Keys) == 0 {
+			coverage.legacy[provenance.Group] += provenance.Count
+			continue
+		}
+		keyed[provenance.Group] = true
+		for _, key := range provenance.Keys {
+			coverage.keys[key] = true
+		}
+	}
+	for group, count := range purgedGroups {
+		coverage.legacy[group] += count
+	}
+	for key := range purgedKeys {
+		coverage.keys[key] = true
+	}
+	// A keyed commit records every commit of its group it took over.
+	for group := range keyed {
+		delete(coverage.legacy, group)
+	}
+	return coverage
+}
+
+// pending returns the commits of group the mirror does not cover yet and
+// how many contributions they add.
+func (c *groupCoverage) pending(group CommitGroup) ([]internal.Commit, int) {
+	var fresh []internal.Commit
+	for _, commit := range group.Commits {
+		if !isMirrored(c.existing, commit) && !c.keys[sourceKeyHash(commit)] {
+			fresh = append(fresh, commit)
+		}
+	}
+	return fresh, len(fresh) - c.legacy[group.Key]
+}
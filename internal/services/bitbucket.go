@@ -0,0 +1,147 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const bitbucketPageSize = 100
+
+// BitbucketSource imports commits from a Bitbucket Server or Data Center
+// instance through its REST API 1.0.
+type BitbucketSource struct {
+	BaseURL    string
+	Token      string
+	Identities []string
+}
+
+type bitbucketPage[T any] struct {
+	Values        []T  `json:"values"`
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+type bitbucketRepo struct {
+	ID      int    `json:"id"`
+	Slug    string `json:"slug"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+	Links struct {
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+type bitbucketCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Author  struct {
+		Name         string `json:"name"`
+		EmailAddress string `json:"emailAddress"`
+	} `json:"author"`
+	AuthorTimestamp    int64 `json:"authorTimestamp"`
+	CommitterTimestamp int64 `json:"committerTimestamp"`
+}
+
+func NewBitbucketSourceFromEnv() *BitbucketSource {
+	return &BitbucketSource{
+		BaseURL:    strings.TrimSuffix(os.Getenv("BITBUCKET_URL"), "/"),
+		Token:      os.Getenv("BITBUCKET_TOKEN"),
+		Identities: authorIdentitiesFromEnv(),
+	}
+}
+
+func (s *BitbucketSource) Name() string {
+	return "bitbucket"
+}
+
+func (s *BitbucketSource) ListProjects() ([]internal.Project, error) {
+	var projects []internal.Project
+	start := 0
+
+	for {
+		var page bitbucketPage[bitbucketRepo]
+		endpoint := fmt.Sprintf("%v/rest/api/1.0/repos?start=%d&limit=%d", s.BaseURL, start, bitbucketPageSize)
+		if err := getJSON(endpoint, s.headers(), &page); err != nil {
+			return nil, err
+		}
+
+		for _, repo := range page.Values {
+			project := internal.Project{
+				ID:   repo.ID,
+				Path: repo.Project.Key + "/" + repo.Slug,
+			}
+			if len(repo.Links.Self) > 0 {
+				project.URL = repo.Links.Self[0].Href
+			}
+			projects = append(projects, project)
+		}
+
+		if page.IsLastPage || len(page.Values) == 0 {
+			break
+		}
+		start = page.NextPageStart
+	}
+
+	return projects, nil
+}
+
+func (s *BitbucketSource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	key, slug, ok := strings.Cut(project.Path, "/")
+	if !ok {
+		return fmt.Errorf("invalid Bitbucket repository path: %v", project.Path)
+	}
+
+	start := 0
+	total := 0
+	for {
+		var page bitbucketPage[bitbucketCommit]
+		endpoint := fmt.Sprintf("%v/rest/api/1.0/projects/%v/repos/%v/commits?start=%d&limit=%d",
+			s.BaseURL, url.PathEscape(key), url.PathEscape(slug), start, bitbucketPageSize)
+		if err := getJSON(endpoint, s.headers(), &page); err != nil {
+			return err
+		}
+
+		for _, c := range page.Values {
+			if !matchesIdentity(s.Identities, c.Author.Name, c.Author.EmailAddress) {
+				continue
+			}
+			commit := internal.Commit{
+				ID:           c.ID,
+				Title:        firstLine(c.Message),
+				Message:      c.Message,
+				AuthorName:   c.Author.Name,
+				AuthorMail:   c.Author.EmailAddress,
+				AuthoredDate: time.UnixMilli(c.AuthorTimestamp).UTC(),
+				ProjectID:    project.ID,
+				ProjectPath:  project.Path,
+			}
+			// Bitbucket only reports epoch timestamps, the offsets are lost.
+			if c.CommitterTimestamp != 0 {
+				commit.CommittedDate = time.UnixMilli(c.CommitterTimestamp).UTC()
+			}
+			commits <- commit
+			total++
+		}
+
+		if page.IsLastPage || len(page.Values) == 0 {
+			break
+		}
+		start = page.NextPageStart
+	}
+
+	log.Printf("Found total of %v commits in %v \n", total, project.Path)
+	return nil
+}
+
+func (s *BitbucketSource) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + s.Token}
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// BranchSettings choose the branches the mirror commits to and publishes.
+type BranchSettings struct {
+	// Target is the branch published to the remotes. When empty the mirror
+	// stays on the branch it was cloned with.
+	Target string
+	// Import, when set, is a side branch getting the imported commits,
+	// which is merged into Target on every publish.
+	Import string
+}
+
+// BranchSettingsFromEnv reads TARGET_BRANCH and IMPORT_BRANCH.
+func BranchSettingsFromEnv() (BranchSettings, error) {
+	settings := BranchSettings{
+		Target: strings.TrimSpace(os.Getenv("TARGET_BRANCH")),
+		Import: strings.TrimSpace(os.Getenv("IMPORT_BRANCH")),
+	}
+	if err := validBranch("TARGET_BRANCH", settings.Target); err != nil {
+		return BranchSettings{}, err
+	}
+	if err := validBranch("IMPORT_BRANCH", settings.Import); err != nil {
+		return BranchSettings{}, err
+	}
+
+	if settings.Import != "" && settings.Target == "" {
+		return BranchSettings{}, fmt.Errorf("IMPORT_BRANCH needs TARGET_BRANCH to merge into")
+	}
+	if settings.Import != "" && settings.Import == settings.Target {
+		return BranchSettings{}, fmt.Errorf("IMPORT_BRANCH and TARGET_BRANCH must differ")
+	}
+	return settings, nil
+}
+
+func validBranch(variable string, name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := plumbing.NewBranchReferenceName(name).Validate(); err != nil {
+		return fmt.Errorf("invalid %v: %v", variable, name)
+	}
+	return nil
+}
+
+// CheckoutBranches switches the mirror to its work branch, creating the
+// target branch first so the import branch starts from it.
+func CheckoutBranches(repo *git.Repository, settings BranchSettings) error {
+	for _, name := range []string{settings.Target, settings.Import} {
+		if name == "" {
+			continue
+		}
+		if err := checkoutBranch(repo, plumbing.NewBranchReferenceName(name)); err != nil {
+			return fmt.Errorf("error checking out %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkoutBranch checks out branch, tracking the branch of origin when the
+// mirror does not have it yet, or starting it from the current HEAD.
+func checkoutBranch(repo *git.Repository, branch plumbing.ReferenceName) error {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		// Nothing is committed yet, the first commit creates the branch.
+		return repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+	}
+	if err != nil {
+		return err
+	}
+	if head.Name() == branch {
+		return nil
+	}
+
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	options := &git.CheckoutOptions{Branch: branch}
+	if _, err := repo.Reference(branch, false); err == plumbing.ErrReferenceNotFound {
+		options.Create = true
+		options.Hash = head.Hash()
+		if tracking, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch.Short()), true); err == nil {
+			options.Hash = tracking.Hash()
+		}
+	}
+	log.Printf("Switching the mirror to %v.\n", branch.Short())
+	return workTree.Checkout(options)
+}
+
+// mergeIntoBranch brings branch up to source, fast-forwarding it when
+// possible and creating a merge commit otherwise. The branch is created
+// when missing.
+func mergeIntoBranch(repo *git.Repository, branch plumbing.ReferenceName, source plumbing.Hash) error {
+	ref, err := repo.Reference(branch, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return repo.Storer.SetReference(plumbing.NewHashReference(branch, source))
+	}
+	if err != nil {
+		return err
+	}
+	if ref.Hash() == source {
+		return nil
+	}
+
+	target, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+	imported, err := repo.CommitObject(source)
+	if err != nil {
+		return err
+	}
+	if merged, err := imported.IsAncestor(target); err != nil || merged {
+		return err
+	}
+
+	result := source
+	if behind, err := target.IsAncestor(imported); err != nil {
+		return err
+	} else if !behind {
+		if result, err = mergeCommits(repo, target, imported, fmt.Sprintf("Merge the imports into %v", branch.Short())); err != nil {
+			return err
+		}
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(branch, result))
+}
+
+// workBranch returns the branch imports are committed to: the import
+// branch, the target branch or the checked out branch, in that order.
+func workBranch(repo *git.Repository) (plumbing.ReferenceName, error) {
+	settings, err := BranchSettingsFromEnv()
+	if err != nil {
+		return "", err
+	}
+	if settings.Import != "" {
+		return plumbing.NewBranchReferenceName(settings.Import), nil
+	}
+	if settings.Target != "" {
+		return plumbing.NewBranchReferenceName(settings.Target), nil
+	}
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err == plumbing.ErrReferenceNotFound || (err == nil && head.Type() != plumbing.SymbolicReference) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return head.Target(), nil
+}
+
+// mirrorTips returns the commits the mirror history is read from: HEAD,
+// the work branch and the work branch of origin as last fetched, so
+// imports published from other machines count as well.
+func mirrorTips(repo *git.Repository) ([]plumbing.Hash, error) {
+	branch, err := workBranch(repo)
+	if err != nil {
+		return nil, err
+	}
+	names := []plumbing.ReferenceName{plumbing.HEAD}
+	if branch != "" {
+		names = append(names, branch, plumbing.NewRemoteReferenceName("origin", branch.Short()))
+	}
+
+	var tips []plumbing.Hash
+	for _, name := range names {
+		ref, err := repo.Reference(name, true)
+		if err == plumbing.ErrReferenceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %v", name, err)
+		}
+		if !containsHash(tips, ref.Hash()) {
+			tips = append(tips, ref.Hash())
+		}
+	}
+	return tips, nil
+}
+
+// walkMirror calls fn once for every commit reachable from the mirror tips.
+func walkMirror(repo *git.Repository, fn func(*object.Commit) error) error {
+	tips, err := mirrorTips(repo)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	for _, tip := range tips {
+		if seen[tip] {
+			continue
+		}
+		commit, err := repo.CommitObject(tip)
+		if err != nil {
+			return fmt.Errorf("failed to read commit %v: %v", tip, err)
+		}
+		err = object.NewCommitPreorderIter(commit, seen, nil).ForEach(func(c *object.Commit) error {
+			seen[c.Hash] = true
+			return fn(c)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to iterate commits: %v", err)
+		}
+	}
+	return nil
+}
+
+// FetchMirror fetches the work branch and the target branch of origin
+// into their remote-tracking branches. Local branches and the work tree
+// are left alone, the mirror history is read from both.
+func FetchMirror(repo *git.Repository) error {
+	remote, err := repo.Remote("origin")
+	if err == git.ErrRemoteNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	auth, err := RemoteAuth(remote.Config().URLs[0])
+	if err != nil {
+		return err
+	}
+
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error listing the branches of origin: %v", err)
+	}
+	published := make(map[plumbing.ReferenceName]bool)
+	for _, ref := range refs {
+		published[ref.Name()] = true
+	}
+
+	settings, err := BranchSettingsFromEnv()
+	if err != nil {
+		return err
+	}
+	branch, err := workBranch(repo)
+	if err != nil {
+		return err
+	}
+	branches := []plumbing.ReferenceName{branch}
+	if target := plumbing.NewBranchReferenceName(settings.Target); settings.Target != "" && target != branch {
+		branches = append(branches, target)
+	}
+
+	for _, branch := range branches {
+		if branch == "" || !published[branch] {
+			continue
+		}
+		if _, err := fetchBranch(repo, "origin", auth, branch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHTTPCacheMaxMB = 100
+
+// CacheTransport stores GET responses that carry an ETag on disk and
+// revalidates them with If-None-Match, so unchanged pages come back as
+// cheap 304 responses.
+type CacheTransport struct {
+	Dir      string
+	MaxBytes int64
+	Next     http.RoundTripper
+
+	mu sync.Mutex
+}
+
+type cacheEntry struct {
+	URL    string      `json:"url"`
+	ETag   string      `json:"etag"`
+	Header http.Header `json:"header"`
+}
+
+// cachedHeaders are the credential headers a response may depend on. They
+// are part of the cache key so tokens never share entries.
+var cachedHeaders = []string{"Authorization", "PRIVATE-TOKEN", "JOB-TOKEN"}
+
+// NewCacheTransportFromEnv returns nil unless HTTP_CACHE_DIR is set.
+func NewCacheTransportFromEnv(next http.RoundTripper) (*CacheTransport, error) {
+	dir := os.Getenv("HTTP_CACHE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	maxMB := defaultHTTPCacheMaxMB
+	if value := os.Getenv("HTTP_CACHE_MAX_MB"); value != "" {
+		var err error
+		maxMB, err = strconv.Atoi(value)
+		if err != nil || maxMB <= 0 {
+			return nil, fmt.Errorf("invalid HTTP_CACHE_MAX_MB: %v", value)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating the HTTP cache directory: %v", err)
+	}
+	return &CacheTransport{Dir: dir, MaxBytes: int64(maxMB) << 20, Next: next}, nil
+}
+
+func (t *CacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.Next.RoundTrip(req)
+	}
+
+	key := cacheKey(req)
+	entry, cached := t.lookup(key)
+	original := req
+	if cached {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+
+	res, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached && res.StatusCode == http.StatusNotModified {
+		body, err := os.Open(t.bodyPath(key))
+		if err == nil {
+			closeBody(res)
+			now := time.Now()
+			os.Chtimes(t.bodyPath(key), now, now)
+
+			info, _ := body.Stat()
+			return &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         res.Proto,
+				ProtoMajor:    res.ProtoMajor,
+				ProtoMinor:    res.ProtoMinor,
+				Header:        entry.Header.Clone(),
+				Body:          body,
+				ContentLength: info.Size(),
+				Request:       req,
+			}, nil
+		}
+
+		// The body went missing since the lookup, so the entry is dropped
+		// and the response fetched in full.
+		closeBody(res)
+		os.Remove(t.metaPath(key))
+		req = original
+		if res, err = t.Next.RoundTrip(req); err != nil {
+			return nil, err
+		}
+	}
+
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		return res, nil
+	}
+
+	file, err := os.CreateTemp(t.Dir, ".tmp-*")
+	if err != nil {
+		return res, nil
+	}
+	res.Body = &cachingBody{
+		body:      res.Body,
+		file:      file,
+		transport: t,
+		key:       key,
+		entry:     cacheEntry{URL: req.URL.String(), ETag: etag, Header: res.Header.Clone()},
+	}
+	return res, nil
+}
+
+func cacheKey(req *http.Request) string {
+	hash := sha256.New()
+	io.WriteString(hash, req.URL.String())
+	for _, header := range cachedHeaders {
+		io.WriteString(hash, "\n"+req.Header.Get(header))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (t *CacheTransport) metaPath(key string) string {
+	return filepath.Join(t.Dir, key+".json")
+}
+
+func (t *CacheTransport) bodyPath(key string) string {
+	return filepath.Join(t.Dir, key+".body")
+}
+
+func (t *CacheTransport) lookup(key string) (cacheEntry, bool) {
+	var entry cacheEntry
+	data, err := os.ReadFile(t.metaPath(key))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil || entry.ETag == "" {
+		return entry, false
+	}
+	if _, err := os.Stat(t.bodyPath(key)); err != nil {
+		return entry, false
+	}
+	return entry, true
+}
+
+func (t *CacheTransport) store(key string, entry cacheEntry, bodyFile string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.metaPath(key), data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(bodyFile, t.bodyPath(key)); err != nil {
+		return err
+	}
+	return t.evict()
+}
+
+// evict removes the least recently used entries until the cache fits in
+// MaxBytes. Cache hits refresh the modification time of the body.
+func (t *CacheTransport) evict() error {
+	files, err := os.ReadDir(t.Dir)
+	if err != nil {
+		return err
+	}
+
+	type cached struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var entries []cached
+	var total int64
+	for _, file := range files {
+		key, ok := strings.CutSuffix(file.Name(), ".body")
+		if !ok {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cached{key, info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	for _, entry := range entries {
+		if total <= t.MaxBytes {
+			break
+		}
+		os.Remove(t.metaPath(entry.key))
+		os.Remove(t.bodyPath(entry.key))
+		total -= entry.size
+	}
+	return nil
+}
+
+// cachingBody copies the response into a temporary file while it is read
+// and stores it once the body was read completely.
+type cachingBody struct {
+	body      io.ReadCloser
+	file      *os.File
+	transport *CacheTransport
+	key       string
+	entry     cacheEntry
+
+	complete bool
+	failed   bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 && !b.failed {
+		if _, writeErr := b.file.Write(p[:n]); writeErr != nil {
+			b.failed = true
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	err := b.body.Close()
+	b.file.Close()
+
+	if b.complete && !b.failed {
+		if storeErr := b.transport.store(b.key, b.entry, b.file.Name()); storeErr == nil {
+			return err
+		}
+	}
+	os.Remove(b.file.Name())
+	return err
+}
+
+// ClearHTTPCache removes every cached response from dir and returns how
+// many were removed.
+func ClearHTTPCache(dir string) (int, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ".body") && !strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return removed, err
+		}
+		if strings.HasSuffix(name, ".body") {
+			removed++
+		}
+	}
+	return removed, nil
+}
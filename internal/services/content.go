@@ -0,0 +1,136 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const (
+	ContentNone    = "none"
+	ContentLog     = "log"
+	ContentCounter = "counter"
+
+	activityDir         = "activity"
+	defaultMaxLineDelta = 1000
+)
+
+func ContentMirrorMode() (string, error) {
+	mode := strings.TrimSpace(os.Getenv("MIRROR_CONTENT"))
+	switch mode {
+	case "":
+		return ContentNone, nil
+	case ContentNone, ContentLog, ContentCounter:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown MIRROR_CONTENT mode: %v", mode)
+	}
+}
+
+// WriteSyntheticChange writes a generated change for the commit into the
+// mirror work tree and returns the path to stage, relative to repoPath.
+// Only the SHA, date and line counts of the original commit are used.
+func WriteSyntheticChange(repoPath string, mode string, projectName string, commit internal.Commit) (string, error) {
+	switch mode {
+	case ContentLog:
+		return appendProjectLog(repoPath, projectName, commit)
+	case ContentCounter:
+		return bumpCounter(repoPath)
+	default:
+		return "", nil
+	}
+}
+
+func appendProjectLog(repoPath string, projectName string, commit internal.Commit) (string, error) {
+	name := strings.ReplaceAll(projectName, "/", "__")
+	if name == "" {
+		name = fmt.Sprintf("project-%d", commit.ProjectID)
+	}
+	relPath := filepath.Join(activityDir, name+".log")
+
+	lines, err := readLines(filepath.Join(repoPath, relPath))
+	if err != nil {
+		return "", err
+	}
+
+	maxDelta := defaultMaxLineDelta
+	if value := os.Getenv("MIRROR_CONTENT_MAX_LINES"); value != "" {
+		maxDelta, err = strconv.Atoi(value)
+		if err != nil || maxDelta < 1 {
+			return "", fmt.Errorf("invalid MIRROR_CONTENT_MAX_LINES: %v", value)
+		}
+	}
+
+	deletions := min(commit.Stats.Deletions, maxDelta, len(lines))
+	additions := min(max(commit.Stats.Additions, 1), maxDelta)
+
+	lines = lines[deletions:]
+	for i := 0; i < additions; i++ {
+		lines = append(lines, fmt.Sprintf("%s %s %d", commit.AuthoredDate.Format("2006-01-02"), shortID(commit.ID), i+1))
+	}
+
+	return relPath, writeLines(filepath.Join(repoPath, relPath), lines)
+}
+
+func bumpCounter(repoPath string) (string, error) {
+	relPath := filepath.Join(activityDir, "counter.txt")
+	fullPath := filepath.Join(repoPath, relPath)
+
+	count := 0
+	data, err := os.ReadFile(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error reading counter file: %v", err)
+	}
+	if len(data) > 0 {
+		count, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return "", fmt.Errorf("error parsing counter file: %v", err)
+		}
+	}
+
+	return relPath, writeLines(fullPath, []string{strconv.Itoa(count + 1)})
+}
+
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error opening %v: %v", path, err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return lines, nil
+}
+
+func writeLines(path string, lines []string) error {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := writeFile(path, content); err != nil {
+		return fmt.Errorf("error writing %v: %v", path, err)
+	}
+	return nil
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
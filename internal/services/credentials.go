@@ -0,0 +1,98 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	AuthPrivateToken = "token"
+	AuthOAuth        = "oauth"
+	AuthJobToken     = "job"
+)
+
+var (
+	// commandSecrets caches the output of token commands, which may prompt
+	// or be slow, for the lifetime of the process.
+	commandSecrets   = make(map[string]string)
+	commandSecretsMu sync.Mutex
+)
+
+// ResolveSecret returns the first configured secret out of a literal value,
+// the contents of a file or the output of a shell command such as
+// "pass show gitlab". Commands run once per process.
+func ResolveSecret(value string, file string, command string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading token file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if command != "" {
+		commandSecretsMu.Lock()
+		defer commandSecretsMu.Unlock()
+		if secret, ok := commandSecrets[command]; ok {
+			return secret, nil
+		}
+
+		shell, flag := "sh", "-c"
+		if runtime.GOOS == "windows" {
+			shell, flag = "cmd", "/C"
+		}
+
+		var stderr bytes.Buffer
+		cmd := exec.Command(shell, flag, command)
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running token command: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		// Tools like pass print the secret on the first line.
+		commandSecrets[command] = firstLine(string(output))
+		return commandSecrets[command], nil
+	}
+
+	return "", nil
+}
+
+func parseAuthMode(mode string) (string, error) {
+	switch mode {
+	case "", AuthPrivateToken:
+		return AuthPrivateToken, nil
+	case AuthOAuth, AuthJobToken:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown GitLab auth mode: %v", mode)
+	}
+}
+
+func (s *GitLabSource) authorize(req *http.Request) error {
+	switch s.AuthMode {
+	case AuthOAuth:
+		token := s.Token
+		if s.OAuth != nil {
+			var err error
+			if token, err = s.OAuth.AccessToken(); err != nil {
+				return err
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case AuthJobToken:
+		req.Header.Set("JOB-TOKEN", s.Token)
+	default:
+		req.Header.Set("PRIVATE-TOKEN", s.Token)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const (
+	MirrorDateAuthored  = "authored"
+	MirrorDateCommitted = "committed"
+
+	TimezoneOriginal = "original"
+)
+
+// DatePolicy decides which date of a source commit the mirror commit gets
+// and in which timezone the committer signature is written.
+type DatePolicy struct {
+	Source string
+	// Location converts the committer date. Nil keeps the offset reported
+	// by the source.
+	Location *time.Location
+}
+
+func NewDatePolicy(source string, timezone string) (DatePolicy, error) {
+	policy := DatePolicy{Source: strings.ToLower(strings.TrimSpace(source))}
+	switch policy.Source {
+	case "":
+		policy.Source = MirrorDateAuthored
+	case MirrorDateAuthored, MirrorDateCommitted:
+	default:
+		return DatePolicy{}, fmt.Errorf("unknown mirror date: %v", source)
+	}
+
+	location, err := ParseTimezone(timezone)
+	if err != nil {
+		return DatePolicy{}, fmt.Errorf("unknown committer timezone %v: %v", timezone, err)
+	}
+	policy.Location = location
+	return policy, nil
+}
+
+// ParseTimezone accepts original, UTC, local or an IANA name. Original
+// returns a nil location, meaning dates keep their own offset.
+func ParseTimezone(timezone string) (*time.Location, error) {
+	switch strings.ToLower(strings.TrimSpace(timezone)) {
+	case "", TimezoneOriginal:
+		return nil, nil
+	case "utc":
+		return time.UTC, nil
+	case "local":
+		return time.Local, nil
+	default:
+		return time.LoadLocation(strings.TrimSpace(timezone))
+	}
+}
+
+// DatePolicyFromEnv reads MIRROR_DATE and COMMITTER_TIMEZONE.
+func DatePolicyFromEnv() (DatePolicy, error) {
+	return NewDatePolicy(os.Getenv("MIRROR_DATE"), os.Getenv("COMMITTER_TIMEZONE"))
+}
+
+// Date is the date the mirror commit is authored at, with its original
+// offset. Sources without a committed date fall back to the authored one.
+func (p DatePolicy) Date(commit internal.Commit) time.Time {
+	if p.Source == MirrorDateCommitted && !commit.CommittedDate.IsZero() {
+		return commit.CommittedDate
+	}
+	return commit.AuthoredDate
+}
+
+func (p DatePolicy) CommitterDate(commit internal.Commit) time.Time {
+	date := p.Date(commit)
+	if p.Location != nil {
+		return date.In(p.Location)
+	}
+	return date
+}
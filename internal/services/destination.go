@@ -0,0 +1,485 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Destination is a place the mirror repository gets published to.
+type Destination interface {
+	Name() string
+	Publish(repo *git.Repository) error
+}
+
+type HTTPSRemote struct {
+	RemoteName string
+	URL        string
+	Username   string
+	Token      string
+}
+
+type SSHRemote struct {
+	RemoteName string
+	URL        string
+	User       string
+	KeyPath    string
+	Passphrase string
+	KnownHosts []string
+}
+
+type BareRepository struct {
+	RemoteName string
+	Path       string
+}
+
+type DirectoryExport struct {
+	Path string
+}
+
+// ParseDestinations reads a comma separated list of destinations. Every
+// entry is a URL or path, optionally prefixed with a remote name as in
+// "gitea=ssh://git@gitea.example.com/me/activity.git". Local bare
+// repositories use a "bare:" prefix and plain exports a "dir:" prefix.
+func ParseDestinations(spec string, originURL string) ([]Destination, error) {
+	var destinations []Destination
+	names := make(map[string]bool)
+	for _, entry := range SplitDestinations(spec, originURL) {
+		if names[entry.Name] {
+			return nil, fmt.Errorf("duplicate destination name: %v", entry.Name)
+		}
+		names[entry.Name] = true
+
+		destination, err := parseDestination(entry.Name, entry.Target)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+	}
+
+	if len(destinations) == 0 {
+		return nil, errors.New("no destinations configured")
+	}
+	return destinations, nil
+}
+
+// DestinationEntry is an entry of the DESTINATIONS list: the remote name
+// and the URL, path or prefixed target it publishes to.
+type DestinationEntry struct {
+	Name   string
+	Target string
+}
+
+// SplitDestinations names the entries of a comma separated DESTINATIONS
+// list, which defaults to originURL. Entries are named by a "name=" prefix,
+// "origin" when they are originURL or by their position otherwise.
+func SplitDestinations(spec string, originURL string) []DestinationEntry {
+	if strings.TrimSpace(spec) == "" {
+		spec = originURL
+	}
+
+	var entries []DestinationEntry
+	for i, target := range strings.Split(spec, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		name := ""
+		if alias, value, found := strings.Cut(target, "="); found && !strings.ContainsAny(alias, ":/@") {
+			name, target = alias, value
+		}
+		if name == "" {
+			name = fmt.Sprintf("destination-%d", i+1)
+			if target == originURL {
+				name = "origin"
+			}
+		}
+		entries = append(entries, DestinationEntry{Name: name, Target: target})
+	}
+	return entries
+}
+
+var envNamePattern = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// DestinationEnvPrefix returns the prefix of the variables configuring the
+// named destination, e.g. "DESTINATION_GITEA_".
+func DestinationEnvPrefix(name string) string {
+	return "DESTINATION_" + envNamePattern.ReplaceAllString(strings.ToUpper(name), "_") + "_"
+}
+
+// CheckEnvVariables reports the required variables that are not set.
+func CheckEnvVariables() error {
+	if err := internal.LoadEnvFile(); err != nil {
+		return err
+	}
+	return internal.CheckEnvVariables(needsOriginToken())
+}
+
+// needsOriginToken reports whether ORIGIN_TOKEN is used to reach a remote
+// over HTTPS: origin itself, which the mirror is cloned and fetched from,
+// or a destination without a token of its own. Without origin the token
+// stays required.
+func needsOriginToken() bool {
+	originURL := os.Getenv("ORIGIN_REPO_URL")
+	if originURL == "" || isHTTPURL(originURL) {
+		return true
+	}
+	for _, entry := range SplitDestinations(os.Getenv("DESTINATIONS"), originURL) {
+		if isHTTPURL(entry.Target) && os.Getenv(DestinationEnvPrefix(entry.Name)+"TOKEN") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func isHTTPURL(url string) bool {
+	if strings.HasPrefix(url, "bare:") || strings.HasPrefix(url, "dir:") {
+		return false
+	}
+	endpoint, err := transport.NewEndpoint(url)
+	return err == nil && (endpoint.Protocol == "https" || endpoint.Protocol == "http")
+}
+
+func DestinationsFromEnv() ([]Destination, error) {
+	return ParseDestinations(os.Getenv("DESTINATIONS"), os.Getenv("ORIGIN_REPO_URL"))
+}
+
+func parseDestination(name string, entry string) (Destination, error) {
+	if path, found := strings.CutPrefix(entry, "dir:"); found {
+		return &DirectoryExport{Path: path}, nil
+	}
+	if path, found := strings.CutPrefix(entry, "bare:"); found {
+		return &BareRepository{RemoteName: name, Path: path}, nil
+	}
+
+	endpoint, err := transport.NewEndpoint(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %v: %v", entry, err)
+	}
+
+	switch endpoint.Protocol {
+	case "https", "http":
+		username, token := destinationCredentials(name)
+		return &HTTPSRemote{
+			RemoteName: name,
+			URL:        entry,
+			Username:   username,
+			Token:      token,
+		}, nil
+	case "ssh":
+		return newSSHRemote(name, entry, endpoint.User), nil
+	case "file":
+		return &BareRepository{RemoteName: name, Path: endpoint.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported destination protocol %v in %v", endpoint.Protocol, entry)
+	}
+}
+
+// destinationCredentials returns the HTTPS username and token of the named
+// destination from DESTINATION_<NAME>_USERNAME and DESTINATION_<NAME>_TOKEN,
+// falling back to COMMITER_NAME and ORIGIN_TOKEN.
+func destinationCredentials(name string) (string, string) {
+	prefix := DestinationEnvPrefix(name)
+
+	username := os.Getenv(prefix + "USERNAME")
+	if username == "" {
+		username = os.Getenv("COMMITER_NAME")
+	}
+	token := os.Getenv(prefix + "TOKEN")
+	if token == "" {
+		token = os.Getenv("ORIGIN_TOKEN")
+	}
+	return username, token
+}
+
+func newSSHRemote(name string, url string, user string) *SSHRemote {
+	var knownHosts []string
+	if value := os.Getenv("SSH_KNOWN_HOSTS"); value != "" {
+		knownHosts = filepath.SplitList(value)
+	}
+
+	return &SSHRemote{
+		RemoteName: name,
+		URL:        url,
+		User:       user,
+		KeyPath:    os.Getenv("SSH_KEY_PATH"),
+		Passphrase: os.Getenv("SSH_KEY_PASSPHRASE"),
+		KnownHosts: knownHosts,
+	}
+}
+
+// RemoteAuth returns the credentials used to talk to url, picked by its
+// transport: SSH keys or agent, HTTPS basic auth or none for local paths.
+func RemoteAuth(url string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote URL %v: %v", url, err)
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		return newSSHRemote("", url, endpoint.User).auth()
+	case "file":
+		return nil, nil
+	default:
+		username, token := destinationCredentials("origin")
+		return &http.BasicAuth{
+			Username: username,
+			Password: token,
+		}, nil
+	}
+}
+
+func PublishAll(repo *git.Repository, destinations []Destination) error {
+	// origin is published first, so the other destinations get the
+	// history as caught up with it.
+	ordered := make([]Destination, 0, len(destinations))
+	for _, destination := range destinations {
+		if destination.Name() == "origin" {
+			ordered = append(ordered, destination)
+		}
+	}
+	for _, destination := range destinations {
+		if destination.Name() != "origin" {
+			ordered = append(ordered, destination)
+		}
+	}
+
+	var failed []string
+	for _, destination := range ordered {
+		log.Printf("Publishing to %v.\n", destination.Name())
+		if err := destination.Publish(repo); err != nil {
+			log.Printf("Error publishing to %v: %v", destination.Name(), err)
+			failed = append(failed, destination.Name())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("publishing failed for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (d *HTTPSRemote) Name() string {
+	return d.RemoteName
+}
+
+func (d *HTTPSRemote) Publish(repo *git.Repository) error {
+	return pushToRemote(repo, d.RemoteName, d.URL, d.auth())
+}
+
+func (d *HTTPSRemote) auth() transport.AuthMethod {
+	return &http.BasicAuth{
+		Username: d.Username,
+		Password: d.Token,
+	}
+}
+
+func (d *SSHRemote) Name() string {
+	return d.RemoteName
+}
+
+func (d *SSHRemote) Publish(repo *git.Repository) error {
+	auth, err := d.auth()
+	if err != nil {
+		return err
+	}
+	return pushToRemote(repo, d.RemoteName, d.URL, auth)
+}
+
+func (d *SSHRemote) auth() (transport.AuthMethod, error) {
+	user := d.User
+	if user == "" {
+		user = "git"
+	}
+
+	hostKeyCallback, err := ssh.NewKnownHostsCallback(d.KnownHosts...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading known_hosts: %v", err)
+	}
+
+	if d.KeyPath != "" {
+		auth, err := ssh.NewPublicKeysFromFile(user, d.KeyPath, d.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("error loading SSH key %v: %v", d.KeyPath, err)
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	}
+
+	auth, err := ssh.NewSSHAgentAuth(user)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SSH agent: %v", err)
+	}
+	auth.HostKeyCallback = hostKeyCallback
+	return auth, nil
+}
+
+func (d *BareRepository) Name() string {
+	return d.RemoteName
+}
+
+func (d *BareRepository) Publish(repo *git.Repository) error {
+	if _, err := git.PlainOpen(d.Path); err == git.ErrRepositoryNotExists {
+		if _, err := git.PlainInit(d.Path, true); err != nil {
+			return fmt.Errorf("error creating bare repository %v: %v", d.Path, err)
+		}
+	}
+
+	absPath, err := filepath.Abs(d.Path)
+	if err != nil {
+		return err
+	}
+	return pushToRemote(repo, d.RemoteName, absPath, nil)
+}
+
+func (d *DirectoryExport) Name() string {
+	return "dir:" + d.Path
+}
+
+// Publish writes the files of the current HEAD and a plain text history of
+// the mirror into the directory. Files not in HEAD, such as those of purged
+// commits, are removed.
+func (d *DirectoryExport) Publish(repo *git.Repository) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("error reading HEAD: %v", err)
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return err
+	}
+	exported := map[string]bool{"history.log": true}
+	err = files.ForEach(func(f *object.File) error {
+		content, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		exported[filepath.FromSlash(f.Name)] = true
+		return writeFile(filepath.Join(d.Path, filepath.FromSlash(f.Name)), content)
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting files: %v", err)
+	}
+	if err := pruneExport(d.Path, exported); err != nil {
+		return fmt.Errorf("error removing stale files: %v", err)
+	}
+
+	iter, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		return fmt.Errorf("failed to get commit log: %v", err)
+	}
+	defer iter.Close()
+
+	var history strings.Builder
+	err = iter.ForEach(func(c *object.Commit) error {
+		fmt.Fprintf(&history, "%s %s %s\n", c.Hash, c.Author.When.Format("2006-01-02T15:04:05-07:00"), firstLine(c.Message))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to iterate commits: %v", err)
+	}
+
+	return writeFile(filepath.Join(d.Path, "history.log"), history.String())
+}
+
+func ensureRemote(repo *git.Repository, name string, url string) error {
+	remote, err := repo.Remote(name)
+	if err == nil {
+		if urls := remote.Config().URLs; len(urls) > 0 && urls[0] == url {
+			return nil
+		}
+		if err := repo.DeleteRemote(name); err != nil {
+			return err
+		}
+	} else if err != git.ErrRemoteNotFound {
+		return err
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: name,
+		URLs: []string{url},
+	})
+	return err
+}
+
+func pushToRemote(repo *git.Repository, remoteName string, url string, auth transport.AuthMethod) error {
+	if err := ensureRemote(repo, remoteName, url); err != nil {
+		return fmt.Errorf("error configuring remote %v: %v", remoteName, err)
+	}
+
+	settings, err := PushSettingsFromEnv(remoteName)
+	if err != nil {
+		return err
+	}
+	return SafePush(repo, remoteName, auth, settings)
+}
+
+// pruneExport removes the files of dir that are not in exported, named
+// relative to dir, and the directories left empty.
+func pruneExport(dir string, exported map[string]bool) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name != "." {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if exported[name] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deeper directories come later in the walk.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeFile(path string, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating %v: %v", filepath.Dir(path), err)
+	}
+	return os.WriteFile(path, []byte(content), 0o644)
+}
@@ -0,0 +1,355 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+const (
+	CheckPass = "PASS"
+	CheckWarn = "WARN"
+	CheckFail = "FAIL"
+	CheckSkip = "SKIP"
+
+	preflightBranch = "gitlab-activity-importer-preflight"
+)
+
+type CheckResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// DoctorFromEnv runs every preflight check for the current configuration.
+func DoctorFromEnv() []CheckResult {
+	var results []CheckResult
+
+	if err := CheckEnvVariables(); err != nil {
+		return append(results, CheckResult{"Environment variables", CheckFail, err.Error()})
+	}
+	results = append(results, CheckResult{"Environment variables", CheckPass, "all required variables are set"})
+
+	if err := ConfigureHTTPClient(); err != nil {
+		return append(results, CheckResult{"HTTP settings", CheckFail, err.Error()})
+	}
+
+	sources, err := SourcesFromEnv()
+	if err != nil {
+		return append(results, CheckResult{"Sources", CheckFail, err.Error()})
+	}
+	destinations, err := DestinationsFromEnv()
+	if err != nil {
+		return append(results, CheckResult{"Destinations", CheckFail, err.Error()})
+	}
+
+	return append(results, RunDoctor(sources, destinations)...)
+}
+
+func RunDoctor(sources []Source, destinations []Destination) []CheckResult {
+	var results []CheckResult
+
+	for _, source := range sources {
+		if gitlab, ok := source.(*GitLabSource); ok {
+			results = append(results, checkGitLab(gitlab)...)
+			continue
+		}
+
+		name := fmt.Sprintf("Source %v: access", source.Name())
+		projects, err := source.ListProjects()
+		if err != nil {
+			results = append(results, CheckResult{name, CheckFail, err.Error()})
+		} else {
+			results = append(results, CheckResult{name, CheckPass, fmt.Sprintf("%d projects found", len(projects))})
+		}
+	}
+
+	for _, destination := range destinations {
+		results = append(results, checkDestination(destination)...)
+	}
+
+	if apiURL, token := githubDestination(destinations); apiURL != "" {
+		results = append(results, checkCommitterEmail(apiURL, token, os.Getenv("COMMITER_EMAIL")))
+	}
+
+	return results
+}
+
+// PrintChecklist writes the results and reports whether none of them failed.
+func PrintChecklist(w io.Writer, results []CheckResult) bool {
+	ok := true
+	for _, result := range results {
+		fmt.Fprintf(w, "[%s] %s", result.Status, result.Name)
+		if result.Detail != "" {
+			fmt.Fprintf(w, ": %s", result.Detail)
+		}
+		fmt.Fprintln(w)
+		if result.Status == CheckFail {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func checkGitLab(source *GitLabSource) []CheckResult {
+	prefix := fmt.Sprintf("GitLab %v", source.Name())
+
+	user, err := source.GetUser()
+	if err != nil {
+		return []CheckResult{{prefix + ": authentication", CheckFail, err.Error()}}
+	}
+	results := []CheckResult{{prefix + ": authentication", CheckPass, "authenticated as " + user.Username}}
+
+	if source.AuthMode != AuthPrivateToken {
+		return append(results, CheckResult{prefix + ": token scopes", CheckSkip, "only personal access tokens can be inspected"})
+	}
+
+	info, err := source.GetTokenInfo()
+	if err != nil {
+		return append(results, CheckResult{prefix + ": token scopes", CheckFail, err.Error()})
+	}
+
+	if slices.Contains(info.Scopes, "read_api") || slices.Contains(info.Scopes, "api") {
+		results = append(results, CheckResult{prefix + ": token scopes", CheckPass, strings.Join(info.Scopes, ", ")})
+	} else {
+		results = append(results, CheckResult{prefix + ": token scopes", CheckFail, fmt.Sprintf("read_api scope is missing, token has: %s", strings.Join(info.Scopes, ", "))})
+	}
+
+	window, err := TokenExpiryWindow()
+	if err != nil {
+		return append(results, CheckResult{prefix + ": token expiry", CheckFail, err.Error()})
+	}
+	return append(results, checkTokenExpiry(prefix, info, time.Now(), window))
+}
+
+func checkTokenExpiry(prefix string, info internal.TokenInfo, now time.Time, window time.Duration) CheckResult {
+	name := prefix + ": token expiry"
+	_, state, err := tokenExpiryState(info.ExpiresAt, now, window)
+	if err != nil {
+		return CheckResult{name, CheckWarn, fmt.Sprintf("unable to parse expiry date %v", info.ExpiresAt)}
+	}
+
+	switch state {
+	case tokenNeverExpires:
+		return CheckResult{name, CheckPass, "token does not expire"}
+	case tokenExpired:
+		return CheckResult{name, CheckFail, "token expired on " + info.ExpiresAt}
+	case tokenExpiring:
+		return CheckResult{name, CheckWarn, "token expires on " + info.ExpiresAt}
+	default:
+		return CheckResult{name, CheckPass, "token expires on " + info.ExpiresAt}
+	}
+}
+
+func checkDestination(destination Destination) []CheckResult {
+	prefix := "Destination " + destination.Name()
+
+	if export, ok := destination.(*DirectoryExport); ok {
+		return []CheckResult{checkDirectoryWritable(prefix, export.Path)}
+	}
+
+	if bare, ok := destination.(*BareRepository); ok {
+		if _, err := os.Stat(bare.Path); os.IsNotExist(err) {
+			return []CheckResult{{prefix + ": access", CheckSkip, fmt.Sprintf("bare repository %v does not exist yet and is created on the first publish", bare.Path)}}
+		}
+	}
+
+	remoteURL, auth, err := destinationRemote(destination)
+	if err != nil {
+		return []CheckResult{{prefix + ": access", CheckFail, err.Error()}}
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "preflight", URLs: []string{remoteURL}})
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	var results []CheckResult
+	switch {
+	case errors.Is(err, transport.ErrEmptyRemoteRepository):
+		results = append(results, CheckResult{prefix + ": ls-remote", CheckPass, "repository is empty"})
+	case err != nil:
+		return append(results, CheckResult{prefix + ": ls-remote", CheckFail, err.Error()})
+	default:
+		results = append(results, CheckResult{prefix + ": ls-remote", CheckPass, fmt.Sprintf("%d refs", len(refs))})
+	}
+
+	if err := probePush(remoteURL, auth); err != nil {
+		return append(results, CheckResult{prefix + ": push", CheckFail, err.Error()})
+	}
+	return append(results, CheckResult{prefix + ": push", CheckPass, "pushed and deleted a temporary branch"})
+}
+
+func destinationRemote(destination Destination) (string, transport.AuthMethod, error) {
+	switch d := destination.(type) {
+	case *HTTPSRemote:
+		return d.URL, d.auth(), nil
+	case *SSHRemote:
+		auth, err := d.auth()
+		return d.URL, auth, err
+	case *BareRepository:
+		path, err := filepath.Abs(d.Path)
+		return path, nil, err
+	default:
+		return "", nil, fmt.Errorf("unsupported destination type %T", destination)
+	}
+}
+
+// probePush pushes an unrelated empty commit to a temporary branch and
+// deletes it again, proving write access without touching real branches.
+func probePush(remoteURL string, auth transport.AuthMethod) error {
+	storage := memory.NewStorage()
+	repo, err := git.Init(storage, nil)
+	if err != nil {
+		return err
+	}
+
+	tree := storage.NewEncodedObject()
+	if err := (&object.Tree{}).Encode(tree); err != nil {
+		return err
+	}
+	treeHash, err := storage.SetEncodedObject(tree)
+	if err != nil {
+		return err
+	}
+
+	signature := object.Signature{Name: "gitlab-activity-importer", Email: "preflight@localhost", When: time.Now()}
+	commit := storage.NewEncodedObject()
+	err = (&object.Commit{Author: signature, Committer: signature, Message: "preflight check", TreeHash: treeHash}).Encode(commit)
+	if err != nil {
+		return err
+	}
+	commitHash, err := storage.SetEncodedObject(commit)
+	if err != nil {
+		return err
+	}
+
+	ref := plumbing.NewBranchReferenceName(preflightBranch)
+	if err := storage.SetReference(plumbing.NewHashReference(ref, commitHash)); err != nil {
+		return err
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "preflight", URLs: []string{remoteURL}}); err != nil {
+		return err
+	}
+
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "preflight",
+		RefSpecs:   []config.RefSpec{config.RefSpec(ref + ":" + ref)},
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil {
+		return fmt.Errorf("push rejected: %v", err)
+	}
+
+	err = repo.Push(&git.PushOptions{
+		RemoteName: "preflight",
+		RefSpecs:   []config.RefSpec{config.RefSpec(":" + ref)},
+		Auth:       auth,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete temporary branch %v: %v", preflightBranch, err)
+	}
+	return nil
+}
+
+func checkDirectoryWritable(prefix string, path string) CheckResult {
+	name := prefix + ": write access"
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return CheckResult{name, CheckFail, err.Error()}
+	}
+
+	file, err := os.CreateTemp(path, ".preflight-*")
+	if err != nil {
+		return CheckResult{name, CheckFail, err.Error()}
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return CheckResult{name, CheckPass, path + " is writable"}
+}
+
+// githubDestination returns the GitHub API to verify the committer email
+// against, if any destination is hosted on GitHub, and the token of that
+// destination. Without a matching HTTPS destination, ORIGIN_TOKEN is used.
+func githubDestination(destinations []Destination) (string, string) {
+	apiURL := strings.TrimSuffix(os.Getenv("GITHUB_API_URL"), "/")
+	apiHost := "api.github.com"
+	if apiURL != "" {
+		parsed, err := url.Parse(apiURL)
+		if err != nil {
+			return apiURL, os.Getenv("ORIGIN_TOKEN")
+		}
+		apiHost = parsed.Host
+	}
+
+	for _, destination := range destinations {
+		remote, ok := destination.(*HTTPSRemote)
+		if !ok {
+			continue
+		}
+		parsed, err := url.Parse(remote.URL)
+		if err != nil || (parsed.Host != apiHost && "api."+parsed.Host != apiHost) {
+			continue
+		}
+		if apiURL == "" {
+			apiURL = "https://api.github.com"
+		}
+		return apiURL, remote.Token
+	}
+	return apiURL, os.Getenv("ORIGIN_TOKEN")
+}
+
+func checkCommitterEmail(apiURL string, token string, email string) CheckResult {
+	name := "Committer email attribution"
+	headers := map[string]string{
+		"Authorization": "Bearer " + token,
+		"Accept":        "application/vnd.github+json",
+	}
+
+	var user struct {
+		ID    int    `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := getJSON(apiURL+"/user", headers, &user); err != nil {
+		return CheckResult{name, CheckWarn, "unable to read the GitHub user: " + err.Error()}
+	}
+
+	noreply := []string{
+		fmt.Sprintf("%d+%s@users.noreply.github.com", user.ID, user.Login),
+		user.Login + "@users.noreply.github.com",
+	}
+	for _, address := range noreply {
+		if strings.EqualFold(address, email) {
+			return CheckResult{name, CheckPass, fmt.Sprintf("%v is the noreply address of %v", email, user.Login)}
+		}
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(apiURL+"/user/emails", headers, &emails); err != nil {
+		return CheckResult{name, CheckWarn, "unable to list GitHub emails, the token needs the user:email scope: " + err.Error()}
+	}
+
+	for _, address := range emails {
+		if strings.EqualFold(address.Email, email) {
+			if !address.Verified {
+				return CheckResult{name, CheckFail, fmt.Sprintf("%v is not verified on %v, commits will not be attributed", email, user.Login)}
+			}
+			return CheckResult{name, CheckPass, fmt.Sprintf("%v is a verified email of %v", email, user.Login)}
+		}
+	}
+	return CheckResult{name, CheckFail, fmt.Sprintf("%v is not an email of %v, commits will not be attributed", email, user.Login)}
+}
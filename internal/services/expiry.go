@@ -0,0 +1,125 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTokenExpiryWarnDays = 7
+
+type tokenExpiry int
+
+const (
+	tokenNeverExpires tokenExpiry = iota
+	tokenValid
+	tokenExpiring
+	tokenExpired
+)
+
+// tokenExpiryState parses the expiry date GitLab reports for a token and
+// tells whether it expired or expires within window.
+func tokenExpiryState(expiresAt string, now time.Time, window time.Duration) (time.Time, tokenExpiry, error) {
+	if expiresAt == "" {
+		return time.Time{}, tokenNeverExpires, nil
+	}
+
+	date, err := time.Parse("2006-01-02", expiresAt)
+	if err != nil {
+		return time.Time{}, tokenValid, err
+	}
+
+	remaining := date.Sub(now)
+	switch {
+	case remaining <= 0:
+		return date, tokenExpired, nil
+	case remaining < window:
+		return date, tokenExpiring, nil
+	default:
+		return date, tokenValid, nil
+	}
+}
+
+// TokenExpiredError is returned when GitLab rejects a token because it has
+// expired, so callers can stop with an actionable message.
+type TokenExpiredError struct {
+	Instance  string
+	BaseURL   string
+	ExpiresAt string
+	// Err is the rejected request, when GitLab reported the expiry.
+	Err error
+}
+
+func (e *TokenExpiredError) Error() string {
+	expired := "has expired"
+	if e.ExpiresAt != "" {
+		expired = "expired on " + e.ExpiresAt
+	}
+	return fmt.Sprintf("GitLab token of %v %v. Create a new personal access token with the read_api scope at %v/-/user_settings/personal_access_tokens and update the importer configuration", e.Instance, expired, e.BaseURL)
+}
+
+// TokenExpiryWindow reads TOKEN_EXPIRY_WARN_DAYS, how long before the
+// expiry date the importer starts warning about it.
+func TokenExpiryWindow() (time.Duration, error) {
+	days := defaultTokenExpiryWarnDays
+	if value := os.Getenv("TOKEN_EXPIRY_WARN_DAYS"); value != "" {
+		var err error
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid TOKEN_EXPIRY_WARN_DAYS: %v", value)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// CheckTokenExpiry logs a rotation reminder when the personal access token
+// expires within window and returns a TokenExpiredError once it expired.
+// Other failures are only logged, older GitLab versions do not expose the
+// token details.
+func (s *GitLabSource) CheckTokenExpiry(window time.Duration, now time.Time) error {
+	if s.AuthMode != AuthPrivateToken {
+		return nil
+	}
+
+	info, err := s.GetTokenInfo()
+	if err != nil {
+		var expired *TokenExpiredError
+		if errors.As(err, &expired) {
+			return err
+		}
+		log.Printf("Unable to check the expiry of the GitLab token of %v: %v", s.Name(), err)
+		return nil
+	}
+	_, state, err := tokenExpiryState(info.ExpiresAt, now, window)
+	if err != nil {
+		log.Printf("Unable to parse the expiry date %v of the GitLab token of %v", info.ExpiresAt, s.Name())
+		return nil
+	}
+
+	switch state {
+	case tokenExpired:
+		return &TokenExpiredError{Instance: s.Name(), BaseURL: s.BaseURL, ExpiresAt: info.ExpiresAt}
+	case tokenExpiring:
+		log.Printf("WARNING: the GitLab token of %v expires on %v, rotate it at %v/-/user_settings/personal_access_tokens", s.Name(), info.ExpiresAt, s.BaseURL)
+	}
+	return nil
+}
+
+func (e *TokenExpiredError) Unwrap() error {
+	return e.Err
+}
+
+// statusError turns a failed GitLab response into an APIError, recognising
+// the invalid_token response GitLab sends for expired tokens.
+func (s *GitLabSource) statusError(res *http.Response) error {
+	apiErr := newAPIError(res)
+	if apiErr.StatusCode == http.StatusUnauthorized && strings.Contains(apiErr.Message, "Token has expired") {
+		return &TokenExpiredError{Instance: s.Name(), BaseURL: s.BaseURL, Err: apiErr}
+	}
+	return apiErr
+}
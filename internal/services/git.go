@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/furmanp/gitlab-activity-importer/internal"
 	"github.com/go-git/go-git/v5"
@@ -11,17 +15,122 @@ import (
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 )
 
+const (
+	sourceSHATrailer       = "Source-SHA"
+	sourceInstanceTrailer  = "Source-Instance"
+	sourceProjectTrailer   = "Source-Project"
+	sourceProjectIDTrailer = "Source-Project-ID"
+	sourceDateTrailer      = "Source-Date"
+	importerVersionTrailer = "Importer-Version"
+)
+
+// ImporterVersion is recorded on every mirror commit. It is set to the
+// version the binary was released as.
+var ImporterVersion = "dev"
+
+// Provenance links a mirror commit back to the commit it was imported
+// from. It is written as trailers of the mirror commit message.
+type Provenance struct {
+	SHA      string
+	Instance string
+	// ProjectPath and ProjectID are hashed when the hash-project
+	// redaction mode is enabled.
+	ProjectPath     string
+	ProjectID       string
+	AuthoredDate    time.Time
+	ImporterVersion string
+	// Group, Count and the hashed source keys are set on aggregated
+	// commits instead of SHA.
+	Group string
+	Count int
+	Keys  []string
+}
+
+func (b *MessageBuilder) Provenance(commit internal.Commit) Provenance {
+	return Provenance{
+		SHA:             commit.ID,
+		Instance:        commit.Instance,
+		ProjectPath:     b.ProjectName(commit.ProjectPath),
+		ProjectID:       b.ProjectID(commit.ProjectID),
+		AuthoredDate:    commit.AuthoredDate,
+		ImporterVersion: ImporterVersion,
+	}
+}
+
+// Trailers formats the provenance as git trailers, leaving out unknown
+// values.
+func (p Provenance) Trailers() string {
+	var trailers []string
+	add := func(trailer string, value string) {
+		if value != "" {
+			trailers = append(trailers, trailer+": "+value)
+		}
+	}
+	add(sourceGroupTrailer, p.Group)
+	if p.Group != "" {
+		add(sourceCountTrailer, strconv.Itoa(p.Count))
+	}
+	add(sourceKeysTrailer, strings.Join(p.Keys, " "))
+	add(sourceSHATrailer, p.SHA)
+	add(sourceInstanceTrailer, p.Instance)
+	add(sourceProjectTrailer, p.ProjectPath)
+	add(sourceProjectIDTrailer, p.ProjectID)
+	if !p.AuthoredDate.IsZero() {
+		add(sourceDateTrailer, p.AuthoredDate.Format(time.RFC3339))
+	}
+	add(importerVersionTrailer, p.ImporterVersion)
+	return strings.Join(trailers, "\n")
+}
+
+// Key returns the same key as internal.Commit.Key for the source commit.
+func (p Provenance) Key() string {
+	if p.Instance != "" {
+		return p.Instance + ":" + p.SHA
+	}
+	return p.SHA
+}
+
+// ParseProvenance reads the trailers of a mirror commit message. Mirrors
+// created by older versions used the bare SHA as the whole message and
+// only have the SHA set.
+func ParseProvenance(message string) Provenance {
+	provenance := Provenance{
+		SHA:             trailerValue(message, sourceSHATrailer),
+		Instance:        trailerValue(message, sourceInstanceTrailer),
+		ProjectPath:     trailerValue(message, sourceProjectTrailer),
+		ProjectID:       trailerValue(message, sourceProjectIDTrailer),
+		ImporterVersion: trailerValue(message, importerVersionTrailer),
+		Group:           trailerValue(message, sourceGroupTrailer),
+	}
+	provenance.Count, _ = strconv.Atoi(trailerValue(message, sourceCountTrailer))
+	if keys := trailerValue(message, sourceKeysTrailer); keys != "" {
+		provenance.Keys = strings.Fields(keys)
+	}
+	if provenance.SHA == "" && provenance.Group == "" {
+		provenance.SHA = strings.TrimSpace(message)
+	}
+	if date, err := time.Parse(time.RFC3339, trailerValue(message, sourceDateTrailer)); err == nil {
+		provenance.AuthoredDate = date
+	}
+	return provenance
+}
+
 func OpenOrInitClone() *git.Repository {
 	repoPath := internal.GetHomeDirectory() + "/commits-importer/"
 
+	branches, err := BranchSettingsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	repo, err := git.PlainOpen(repoPath)
 	if err != nil {
 		if err == git.ErrRepositoryNotExists {
 			log.Println("Repository doesn't exist. Cloning new repository from remote.")
-			repo, err = cloneRemoteRepo()
+			repo, err = cloneRemoteRepo(branches.Target)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -31,25 +140,87 @@ func OpenOrInitClone() *git.Repository {
 	} else {
 		log.Println("Opened existing repository.")
 	}
+
+	if err := CheckoutBranches(repo, branches); err != nil {
+		log.Fatal(err)
+	}
 	return repo
 }
 
-func cloneRemoteRepo() (*git.Repository, error) {
+// OpenMirrorReadOnly opens the mirror for commands that only read it. The
+// branches of origin are fetched into the remote-tracking branches, but no
+// branch is checked out or moved. Without a local mirror, origin is cloned
+// into memory.
+func OpenMirrorReadOnly() (*git.Repository, error) {
+	repo, err := git.PlainOpen(internal.GetHomeDirectory() + "/commits-importer/")
+	if err == nil {
+		return repo, FetchMirror(repo)
+	}
+	if err != git.ErrRepositoryNotExists {
+		return nil, fmt.Errorf("failed to open the repository: %v", err)
+	}
+
+	branches, err := BranchSettingsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	repoURL := os.Getenv("ORIGIN_REPO_URL")
+	auth, err := RemoteAuth(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	options := &git.CloneOptions{URL: repoURL, Auth: auth}
+	if branches.Target != "" {
+		options.ReferenceName = plumbing.NewBranchReferenceName(branches.Target)
+	}
+	repo, err = git.Clone(memory.NewStorage(), nil, options)
+	if err == plumbing.ErrReferenceNotFound && branches.Target != "" {
+		options.ReferenceName = ""
+		repo, err = git.Clone(memory.NewStorage(), nil, options)
+	}
+	if err == transport.ErrEmptyRemoteRepository {
+		return git.Init(memory.NewStorage(), nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error cloning repository: %v", err)
+	}
+	return repo, nil
+}
+
+// cloneRemoteRepo clones the origin mirror. An empty remote is initialised
+// on target, or on master when no target branch is set.
+func cloneRemoteRepo(target string) (*git.Repository, error) {
 	homeDir := internal.GetHomeDirectory() + "/commits-importer/"
 	repoURL := os.Getenv("ORIGIN_REPO_URL")
 
-	repo, err := git.PlainClone(homeDir, false, &git.CloneOptions{
-		URL: repoURL,
-		Auth: &http.BasicAuth{
-			Username: os.Getenv("COMMITER_NAME"),
-			Password: os.Getenv("ORIGIN_TOKEN"),
-		},
+	auth, err := RemoteAuth(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &git.CloneOptions{
+		URL:      repoURL,
+		Auth:     auth,
 		Progress: os.Stdout,
-	})
+	}
+	if target != "" {
+		options.ReferenceName = plumbing.NewBranchReferenceName(target)
+	}
+	repo, err := git.PlainClone(homeDir, false, options)
+	if err == plumbing.ErrReferenceNotFound && target != "" {
+		// The remote does not have the target branch yet, it is created
+		// from the default branch.
+		options.ReferenceName = ""
+		repo, err = git.PlainClone(homeDir, false, options)
+	}
 
 	if err != nil {
 		if err == transport.ErrEmptyRemoteRepository {
-			newRepo, initErr := git.PlainInit(homeDir, false)
+			initOptions := &git.PlainInitOptions{}
+			if target != "" {
+				initOptions.InitOptions.DefaultBranch = plumbing.NewBranchReferenceName(target)
+			}
+			newRepo, initErr := git.PlainInitWithOptions(homeDir, initOptions)
 			if initErr != nil {
 				_ = os.RemoveAll(homeDir)
 				return nil, initErr
@@ -72,57 +243,74 @@ func cloneRemoteRepo() (*git.Repository, error) {
 }
 
 func CreateLocalCommit(repo *git.Repository, commits []internal.Commit) int {
-	workTree, err := repo.Worktree()
+	return NewImporter(repo).Import(commits)
+}
+
+// Importer mirrors commits one batch after another. The mirror history is
+// read once and the commits it imports are added as it goes, so batches of
+// a large import do not walk the history again.
+type Importer struct {
+	repo        *git.Repository
+	workTree    *git.Worktree
+	repoPath    string
+	existing    map[string]bool
+	builder     *MessageBuilder
+	contentMode string
+	datePolicy  DatePolicy
+}
+
+func NewImporter(repo *git.Repository) *Importer {
+	workTree, repoPath := prepareWorkTree(repo)
+
+	existingCommitSet, err := getAllExistingCommitSHAs(repo)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Something went wrong with reading local commits: %v", err)
 	}
 
-	repoPath := internal.GetHomeDirectory() + "/commits-importer/"
-	filePath := repoPath + "/readme.md"
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		file, err := os.Create(filePath)
-		if err != nil {
-			log.Fatal(err)
-		}
-		file.WriteString("Just a readme.")
-		file.Close()
+	messageBuilder, err := NewMessageBuilderFromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	_, err = workTree.Add("readme.md")
+	contentMode, err := ContentMirrorMode()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	existingCommitSet, err := getAllExistingCommitSHAs(repo)
+	datePolicy, err := DatePolicyFromEnv()
 	if err != nil {
-		log.Fatalf("Something went wrong with reading local commits: %v", err)
+		log.Fatal(err)
+	}
+
+	return &Importer{
+		repo:        repo,
+		workTree:    workTree,
+		repoPath:    repoPath,
+		existing:    existingCommitSet,
+		builder:     messageBuilder,
+		contentMode: contentMode,
+		datePolicy:  datePolicy,
 	}
+}
 
+// Import mirrors the commits that are not in the mirror yet and returns
+// how many it created.
+func (i *Importer) Import(commits []internal.Commit) int {
 	totalCommits := 0
 	for _, commit := range commits {
-		if !existingCommitSet[commit.ID] {
-			newCommit, err := workTree.Commit(commit.ID, &git.CommitOptions{
-				Author: &object.Signature{
-					Name:  os.Getenv("COMMITER_NAME"),
-					Email: os.Getenv("COMMITER_EMAIL"),
-					When:  commit.AuthoredDate,
-				},
-				Committer: &object.Signature{
-					Name:  os.Getenv("COMMITER_NAME"),
-					Email: os.Getenv("COMMITER_EMAIL"),
-					When:  commit.AuthoredDate,
-				},
-			})
+		if !isMirrored(i.existing, commit) {
+			message, err := i.builder.Build(commit)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			obj, err := repo.CommitObject(newCommit)
+			changedPath, err := WriteSyntheticChange(i.repoPath, i.contentMode, i.builder.ProjectName(commit.ProjectPath), commit)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			log.Printf("Created commit: %s\n", obj.Hash)
+			commitMirror(i.repo, i.workTree, changedPath, message, i.datePolicy.Date(commit), i.datePolicy.CommitterDate(commit))
+			i.existing[commit.Key()] = true
 			totalCommits++
 		} else {
 			log.Printf("Commit: %v is already imported \n", commit.ID)
@@ -131,47 +319,243 @@ func CreateLocalCommit(repo *git.Repository, commits []internal.Commit) int {
 	return totalCommits
 }
 
-func getAllExistingCommitSHAs(repo *git.Repository) (map[string]bool, error) {
-	existingCommits := make(map[string]bool)
-	ref, err := repo.Reference("HEAD", true)
+// CreateAggregatedCommits mirrors the commits as one commit per group of
+// the aggregation mode. It needs all fetched commits at once: groups that
+// are already mirrored only get a commit for the difference in count, so
+// runs can be repeated without duplicating contributions.
+func CreateAggregatedCommits(repo *git.Repository, commits []internal.Commit, mode string) int {
+	workTree, repoPath := prepareWorkTree(repo)
+
+	coverage, err := readGroupCoverage(repo)
+	if err != nil {
+		log.Fatalf("Something went wrong with reading local commits: %v", err)
+	}
+
+	messageBuilder, err := NewMessageBuilderFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	contentMode, err := ContentMirrorMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	datePolicy, err := DatePolicyFromEnv()
 	if err != nil {
-		if err == plumbing.ErrReferenceNotFound {
-			return existingCommits, nil
+		log.Fatal(err)
+	}
+
+	location, err := GraphTimezoneFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	totalCommits := 0
+	for _, group := range GroupCommits(commits, mode, datePolicy, location) {
+		fresh, count := coverage.pending(group)
+		if count <= 0 {
+			log.Printf("Group: %v is already imported \n", group.Key)
+			continue
+		}
+
+		projectName := "all-projects"
+		if group.ProjectPath != "" {
+			projectName = messageBuilder.ProjectName(group.ProjectPath)
 		}
-		return nil, fmt.Errorf("failed to get HEAD reference: %v", err)
+		synthetic := internal.Commit{
+			ID:           shortHash(group.Key),
+			AuthoredDate: group.Date,
+			Stats:        group.Stats(),
+		}
+		changedPath, err := WriteSyntheticChange(repoPath, contentMode, projectName, synthetic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		committerDate := group.Date
+		if datePolicy.Location != nil {
+			committerDate = committerDate.In(datePolicy.Location)
+		}
+		keys := make([]string, len(fresh))
+		for i, commit := range fresh {
+			keys[i] = sourceKeyHash(commit)
+		}
+		message := group.Message(messageBuilder, count, len(group.Commits)-count, keys)
+		commitMirror(repo, workTree, changedPath, message, group.Date, committerDate)
+		totalCommits++
 	}
+	return totalCommits
+}
 
-	iter, err := repo.Log(&git.LogOptions{From: ref.Hash()})
+// prepareWorkTree makes sure the mirror has its readme staged and returns
+// the work tree and its path.
+func prepareWorkTree(repo *git.Repository) (*git.Worktree, string) {
+	workTree, err := repo.Worktree()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get commit log: %v", err)
+		log.Fatal(err)
 	}
-	defer iter.Close()
 
-	err = iter.ForEach(func(c *object.Commit) error {
-		existingCommits[c.Message] = true
-		return nil
+	repoPath := internal.GetHomeDirectory() + "/commits-importer/"
+	filePath := repoPath + "/readme.md"
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		file, err := os.Create(filePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file.WriteString("Just a readme.")
+		file.Close()
+	}
+
+	_, err = workTree.Add("readme.md")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return workTree, repoPath
+}
+
+func commitMirror(repo *git.Repository, workTree *git.Worktree, changedPath string, message string, authorDate time.Time, committerDate time.Time) {
+	if changedPath != "" {
+		if _, err := workTree.Add(filepath.ToSlash(changedPath)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	newCommit, err := workTree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  os.Getenv("COMMITER_NAME"),
+			Email: os.Getenv("COMMITER_EMAIL"),
+			When:  authorDate,
+		},
+		Committer: &object.Signature{
+			Name:  os.Getenv("COMMITER_NAME"),
+			Email: os.Getenv("COMMITER_EMAIL"),
+			When:  committerDate,
+		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to iterate commits: %v", err)
+		log.Fatal(err)
 	}
 
-	return existingCommits, nil
+	obj, err := repo.CommitObject(newCommit)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Created commit: %s\n", obj.Hash)
 }
 
-func PushLocalCommits(repo *git.Repository) {
-	err := repo.Push(&git.PushOptions{
-		Auth: &http.BasicAuth{
-			Username: os.Getenv("COMMITER_NAME"),
-			Password: os.Getenv("ORIGIN_TOKEN"),
-		},
-		Progress: os.Stdout,
+func getAllExistingCommitSHAs(repo *git.Repository) (map[string]bool, error) {
+	messages, err := mirrorMessages(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	purged, _, _, err := purgedSources(repo)
+	if err != nil {
+		return nil, err
+	}
+	return existingCommitSet(messages, purged), nil
+}
+
+func existingCommitSet(messages []string, purged map[string]bool) map[string]bool {
+	existingCommits := make(map[string]bool)
+	for _, message := range messages {
+		existingCommits[SourceKey(message)] = true
+	}
+	for key := range purged {
+		existingCommits["purged:"+key] = true
+	}
+	return existingCommits
+}
+
+// isMirrored reports whether the commit is in the mirror already or was
+// removed from it by the purge command.
+func isMirrored(existingCommits map[string]bool, commit internal.Commit) bool {
+	return existingCommits[commit.Key()] || existingCommits[commit.ID] || existingCommits["purged:"+purgedKey(commit.ID)]
+}
+
+// readGroupCoverage reads which source commits the mirror covers for the
+// aggregation modes, including purged ones.
+func readGroupCoverage(repo *git.Repository) (*groupCoverage, error) {
+	messages, err := mirrorMessages(repo)
+	if err != nil {
+		return nil, err
+	}
+	purgedSHAs, purgedGroups, purgedKeys, err := purgedSources(repo)
+	if err != nil {
+		return nil, err
+	}
+	return newGroupCoverage(messages, existingCommitSet(messages, purgedSHAs), purgedGroups, purgedKeys), nil
+}
+
+// mirrorMessages returns the messages of the mirror history.
+func mirrorMessages(repo *git.Repository) ([]string, error) {
+	var messages []string
+	err := walkMirror(repo, func(c *object.Commit) error {
+		messages = append(messages, c.Message)
+		return nil
 	})
+	return messages, err
+}
 
+// PendingCommits returns the commits CreateLocalCommit would import into
+// the mirror, without writing anything.
+func PendingCommits(repo *git.Repository, commits []internal.Commit) ([]internal.Commit, error) {
+	existingCommitSet, err := getAllExistingCommitSHAs(repo)
 	if err != nil {
-		if err == git.NoErrAlreadyUpToDate {
-			log.Println("No changes to push, everything is up to date.")
-		} else {
-			log.Fatalf("Error pushing to Github: %v", err)
+		return nil, err
+	}
+
+	var pending []internal.Commit
+	for _, commit := range commits {
+		if isMirrored(existingCommitSet, commit) {
+			continue
+		}
+		existingCommitSet[commit.Key()] = true
+		pending = append(pending, commit)
+	}
+	return pending, nil
+}
+
+// ObfuscatePending returns the commits that are not mirrored yet after the
+// obfuscation policies, which count the days of the mirror history in.
+func ObfuscatePending(repo *git.Repository, commits []internal.Commit, obfuscation Obfuscation, policy DatePolicy) ([]internal.Commit, error) {
+	pending, err := PendingCommits(repo, commits)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := MirrorCommitDates(repo)
+	if err != nil {
+		return nil, err
+	}
+	return obfuscation.Apply(pending, existing, policy), nil
+}
+
+// PendingGroups returns the groups CreateAggregatedCommits would write a
+// commit for.
+func PendingGroups(repo *git.Repository, commits []internal.Commit, mode string, policy DatePolicy, location *time.Location) ([]CommitGroup, error) {
+	coverage, err := readGroupCoverage(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []CommitGroup
+	for _, group := range GroupCommits(commits, mode, policy, location) {
+		if _, count := coverage.pending(group); count > 0 {
+			pending = append(pending, group)
 		}
 	}
+	return pending, nil
+}
+
+// MirrorCommitDates returns the author dates of the mirror history, which
+// contribution graphs are built from.
+func MirrorCommitDates(repo *git.Repository) ([]time.Time, error) {
+	var dates []time.Time
+	err := walkMirror(repo, func(c *object.Commit) error {
+		dates = append(dates, c.Author.When)
+		return nil
+	})
+	return dates, err
 }
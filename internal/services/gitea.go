@@ -0,0 +1,130 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const giteaPageSize = 50
+
+// GiteaSource imports commits from a Gitea or Forgejo instance, both of
+// which share the /api/v1 REST API.
+type GiteaSource struct {
+	BaseURL    string
+	Token      string
+	Identities []string
+}
+
+type giteaRepo struct {
+	ID       int    `json:"id"`
+	FullName string `json:"full_name"`
+	HTMLURL  string `json:"html_url"`
+	Empty    bool   `json:"empty"`
+}
+
+type giteaCommit struct {
+	SHA    string `json:"sha"`
+	Commit struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name  string    `json:"name"`
+			Email string    `json:"email"`
+			Date  time.Time `json:"date"`
+		} `json:"author"`
+		Committer struct {
+			Date time.Time `json:"date"`
+		} `json:"committer"`
+	} `json:"commit"`
+	Stats internal.CommitStats `json:"stats"`
+}
+
+func NewGiteaSourceFromEnv() *GiteaSource {
+	return &GiteaSource{
+		BaseURL:    strings.TrimSuffix(os.Getenv("GITEA_URL"), "/"),
+		Token:      os.Getenv("GITEA_TOKEN"),
+		Identities: authorIdentitiesFromEnv(),
+	}
+}
+
+func (s *GiteaSource) Name() string {
+	return "gitea"
+}
+
+func (s *GiteaSource) ListProjects() ([]internal.Project, error) {
+	var projects []internal.Project
+
+	for page := 1; ; page++ {
+		var repos []giteaRepo
+		endpoint := fmt.Sprintf("%v/api/v1/user/repos?page=%d&limit=%d", s.BaseURL, page, giteaPageSize)
+		if err := getJSON(endpoint, s.headers(), &repos); err != nil {
+			return nil, err
+		}
+
+		for _, repo := range repos {
+			if repo.Empty {
+				continue
+			}
+			projects = append(projects, internal.Project{ID: repo.ID, Path: repo.FullName, URL: repo.HTMLURL})
+		}
+
+		if len(repos) < giteaPageSize {
+			break
+		}
+	}
+
+	return projects, nil
+}
+
+func (s *GiteaSource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	owner, name, ok := strings.Cut(project.Path, "/")
+	if !ok {
+		return fmt.Errorf("invalid Gitea repository path: %v", project.Path)
+	}
+
+	total := 0
+	for page := 1; ; page++ {
+		var pageCommits []giteaCommit
+		endpoint := fmt.Sprintf("%v/api/v1/repos/%v/%v/commits?stat=true&verification=false&files=false&page=%d&limit=%d",
+			s.BaseURL, url.PathEscape(owner), url.PathEscape(name), page, giteaPageSize)
+		if err := getJSON(endpoint, s.headers(), &pageCommits); err != nil {
+			return err
+		}
+
+		for _, c := range pageCommits {
+			author := c.Commit.Author
+			if !matchesIdentity(s.Identities, author.Name, author.Email) {
+				continue
+			}
+			commits <- internal.Commit{
+				ID:            c.SHA,
+				Title:         firstLine(c.Commit.Message),
+				Message:       c.Commit.Message,
+				AuthorName:    author.Name,
+				AuthorMail:    author.Email,
+				AuthoredDate:  author.Date,
+				CommittedDate: c.Commit.Committer.Date,
+				Stats:         c.Stats,
+				ProjectID:     project.ID,
+				ProjectPath:   project.Path,
+			}
+			total++
+		}
+
+		if len(pageCommits) < giteaPageSize {
+			break
+		}
+	}
+
+	log.Printf("Found total of %v commits in %v \n", total, project.Path)
+	return nil
+}
+
+func (s *GiteaSource) headers() map[string]string {
+	return map[string]string{"Authorization": "token " + s.Token}
+}
@@ -6,75 +6,249 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"sync"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/furmanp/gitlab-activity-importer/internal"
 )
 
-func GetGitlabUser() (internal.GitLabUser, error) {
-	url := os.Getenv("BASE_URL")
+var unsafeFileNamePattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+type GitLabSource struct {
+	BaseURL string
+	Token   string
+	Author  string
+	// InstanceName keys imported commits by instance when several GitLab
+	// instances are configured. It is empty for the BASE_URL instance.
+	InstanceName    string
+	IncludeProjects []string
+	ExcludeProjects []string
+	Since           time.Time
+	// AuthMode is one of AuthPrivateToken, AuthOAuth or AuthJobToken.
+	AuthMode string
+	// OAuth refreshes the bearer token in AuthOAuth mode. Token is used
+	// as a static bearer token when it is nil.
+	OAuth *OAuthTokenSource
+	// ProjectIDs replaces the contributed projects lookup, which job
+	// tokens are not allowed to call.
+	ProjectIDs []int
+}
+
+// gitlabInstanceConfig is one entry of the GITLAB_INSTANCES JSON list.
+type gitlabInstanceConfig struct {
+	Name            string   `json:"name"`
+	BaseURL         string   `json:"base_url"`
+	Auth            string   `json:"auth"`
+	Token           string   `json:"token"`
+	TokenEnv        string   `json:"token_env"`
+	TokenFile       string   `json:"token_file"`
+	TokenCommand    string   `json:"token_command"`
+	Author          string   `json:"author"`
+	IncludeProjects []string `json:"include_projects"`
+	ExcludeProjects []string `json:"exclude_projects"`
+	Since           string   `json:"since"`
+	// ProjectIDs are the projects imported with a job token.
+	ProjectIDs []int `json:"project_ids"`
+	// OAuthTokenFile stores the token of the login command, next to the
+	// default token file by default.
+	OAuthTokenFile string `json:"oauth_token_file"`
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%v/api/v4/user", url), nil)
+func (c gitlabInstanceConfig) oauthTokenFile() string {
+	if c.OAuthTokenFile != "" {
+		return c.OAuthTokenFile
+	}
+	return filepath.Join(filepath.Dir(DefaultOAuthTokenPath()), "oauth-token-"+unsafeFileNamePattern.ReplaceAllString(c.Name, "-")+".json")
+}
+
+func NewGitLabSourceFromEnv() (*GitLabSource, error) {
+	authMode, err := parseAuthMode(os.Getenv("GITLAB_AUTH"))
 	if err != nil {
-		return internal.GitLabUser{}, fmt.Errorf("failed to create request: %v", err)
+		return nil, err
 	}
-	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
 
-	res, err := client.Do(req)
+	token, err := ResolveSecret(os.Getenv("GITLAB_TOKEN"), os.Getenv("GITLAB_TOKEN_FILE"), os.Getenv("GITLAB_TOKEN_COMMAND"))
 	if err != nil {
-		return internal.GitLabUser{}, fmt.Errorf("error making the request: %v", err)
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		return internal.GitLabUser{}, fmt.Errorf("request failed with status code: %v", res.StatusCode)
+	source := &GitLabSource{
+		BaseURL:  os.Getenv("BASE_URL"),
+		Token:    token,
+		Author:   os.Getenv("COMMITER_NAME"),
+		AuthMode: authMode,
 	}
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return internal.GitLabUser{}, fmt.Errorf("error reading the response body: %v", err)
+	var projectIDs []int
+	if authMode == AuthJobToken {
+		ids := os.Getenv("GITLAB_PROJECT_IDS")
+		if ids == "" {
+			ids = os.Getenv("CI_PROJECT_ID")
+		}
+		for _, id := range splitList(ids) {
+			projectId, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid project id %v: %v", id, err)
+			}
+			projectIDs = append(projectIDs, projectId)
+		}
 	}
 
-	var user internal.GitLabUser
-	if err := json.Unmarshal(body, &user); err != nil {
-		return internal.GitLabUser{}, fmt.Errorf("error parsing JSON: %v", err)
+	oauth := func() (*OAuthTokenSource, error) {
+		return NewOAuthTokenSourceFromEnv(source.BaseURL)
 	}
+	if err := source.configureAuth(projectIDs, oauth); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
 
-	return user, nil
+// configureAuth completes the source for its auth mode. Job tokens fall
+// back to CI_JOB_TOKEN and import projectIDs, OAuth sources without a
+// static token refresh the token of the login command.
+func (s *GitLabSource) configureAuth(projectIDs []int, oauth func() (*OAuthTokenSource, error)) error {
+	switch s.AuthMode {
+	case AuthJobToken:
+		if s.Token == "" {
+			s.Token = os.Getenv("CI_JOB_TOKEN")
+		}
+		s.ProjectIDs = projectIDs
+	case AuthOAuth:
+		if s.Token == "" {
+			var err error
+			if s.OAuth, err = oauth(); err != nil {
+				return err
+			}
+			if !s.OAuth.HasToken() {
+				return fmt.Errorf("no OAuth token found in %v, run the login command first", s.OAuth.Path)
+			}
+		}
+	}
+	return nil
 }
 
-func GetUsersProjectsIds(userId int) ([]int, error) {
-	url := os.Getenv("BASE_URL")
+// gitlabInstanceConfigsFromEnv parses the GITLAB_INSTANCES JSON list.
+func gitlabInstanceConfigsFromEnv() ([]gitlabInstanceConfig, error) {
+	value := os.Getenv("GITLAB_INSTANCES")
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%v/api/v4/users/%v/contributed_projects", url, userId), nil)
+	var configs []gitlabInstanceConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("error parsing GITLAB_INSTANCES: %v", err)
+	}
+	return configs, nil
+}
+
+// NewInstanceOAuthTokenSource returns the OAuth token source of the named
+// GITLAB_INSTANCES entry, which the login command stores its token in.
+func NewInstanceOAuthTokenSource(name string) (*OAuthTokenSource, error) {
+	configs, err := gitlabInstanceConfigsFromEnv()
 	if err != nil {
-		return nil, fmt.Errorf("error creating the request: %v", err)
+		return nil, err
+	}
+	for _, config := range configs {
+		if config.Name == name {
+			return newOAuthTokenSource(strings.TrimSuffix(config.BaseURL, "/"), config.oauthTokenFile(), "")
+		}
 	}
+	return nil, fmt.Errorf("no GitLab instance named %v in GITLAB_INSTANCES", name)
+}
 
-	req.Header.Set("PRIVATE-TOKEN", os.Getenv("GITLAB_TOKEN"))
-	res, err := client.Do(req)
+// GitLabInstancesFromEnv parses GITLAB_INSTANCES, a JSON list of GitLab
+// instances with their own URL, token, author and project filters.
+func GitLabInstancesFromEnv() ([]*GitLabSource, error) {
+	configs, err := gitlabInstanceConfigsFromEnv()
 	if err != nil {
-		return nil, fmt.Errorf("error making the request: %v", err)
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed with status code: %v", res.StatusCode)
+	names := make(map[string]bool)
+	sources := make([]*GitLabSource, 0, len(configs))
+	for i, config := range configs {
+		if config.Name == "" || config.BaseURL == "" {
+			return nil, fmt.Errorf("GITLAB_INSTANCES entry %d needs a name and a base_url", i+1)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate GitLab instance name: %v", config.Name)
+		}
+		names[config.Name] = true
+
+		authMode, err := parseAuthMode(config.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("GitLab instance %v: %v", config.Name, err)
+		}
+
+		token := config.Token
+		if config.TokenEnv != "" {
+			token = os.Getenv(config.TokenEnv)
+		}
+		token, err = ResolveSecret(token, config.TokenFile, config.TokenCommand)
+		if err != nil {
+			return nil, fmt.Errorf("GitLab instance %v: %v", config.Name, err)
+		}
+
+		source := &GitLabSource{
+			BaseURL:         strings.TrimSuffix(config.BaseURL, "/"),
+			Token:           token,
+			Author:          config.Author,
+			InstanceName:    config.Name,
+			IncludeProjects: config.IncludeProjects,
+			ExcludeProjects: config.ExcludeProjects,
+			AuthMode:        authMode,
+		}
+		oauth := func() (*OAuthTokenSource, error) {
+			return newOAuthTokenSource(source.BaseURL, config.oauthTokenFile(), "")
+		}
+		if err := source.configureAuth(config.ProjectIDs, oauth); err != nil {
+			return nil, fmt.Errorf("GitLab instance %v: %v", config.Name, err)
+		}
+		if source.Token == "" && source.OAuth == nil {
+			return nil, fmt.Errorf("no token configured for GitLab instance %v", config.Name)
+		}
+		if source.Author == "" {
+			source.Author = os.Getenv("COMMITER_NAME")
+		}
+		if config.Since != "" {
+			since, err := time.Parse("2006-01-02", config.Since)
+			if err != nil {
+				return nil, fmt.Errorf("invalid since date for GitLab instance %v: %v", config.Name, err)
+			}
+			source.Since = since
+		}
+
+		sources = append(sources, source)
 	}
+	return sources, nil
+}
 
-	body, err := io.ReadAll(res.Body)
+func GetGitlabUser() (internal.GitLabUser, error) {
+	source, err := NewGitLabSourceFromEnv()
 	if err != nil {
-		return nil, fmt.Errorf("error reading response: %w", err)
+		return internal.GitLabUser{}, err
 	}
+	return source.GetUser()
+}
 
-	var projects []struct {
-		ID int `json:"id"`
+func GetUsersProjects(userId int) ([]internal.Project, error) {
+	source, err := NewGitLabSourceFromEnv()
+	if err != nil {
+		return nil, err
 	}
-	if err := json.Unmarshal(body, &projects); err != nil {
-		return nil, fmt.Errorf("error parsing JSON: %w", err)
+	return source.GetUsersProjects(userId)
+}
+
+func GetUsersProjectsIds(userId int) ([]int, error) {
+	projects, err := GetUsersProjects(userId)
+	if err != nil {
+		return nil, err
 	}
 
 	projectIds := make([]int, len(projects))
@@ -86,81 +260,272 @@ func GetUsersProjectsIds(userId int) ([]int, error) {
 }
 
 func GetProjectCommits(projectId int, userName string) ([]internal.Commit, error) {
-	url := os.Getenv("BASE_URL")
-	token := os.Getenv("GITLAB_TOKEN")
+	source, err := NewGitLabSourceFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	source.Author = userName
+	return source.GetProjectCommits(projectId)
+}
 
-	var allCommits []internal.Commit
-	client := &http.Client{}
-	page := 1
+func (s *GitLabSource) Name() string {
+	if s.InstanceName != "" {
+		return s.InstanceName
+	}
+	return "gitlab"
+}
 
-	for {
-		req, err := http.NewRequest("GET", fmt.Sprintf("%v/api/v4/projects/%v/repository/commits?author=%v&per_page=100&page=%d", url, projectId, userName, page), nil)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching the commits: %v", err)
+func (s *GitLabSource) ListProjects() ([]internal.Project, error) {
+	if s.AuthMode == AuthJobToken && len(s.ProjectIDs) == 0 {
+		return nil, fmt.Errorf("job tokens cannot list the projects of %v, configure the project IDs to import", s.Name())
+	}
+	if len(s.ProjectIDs) > 0 {
+		projects := make([]internal.Project, len(s.ProjectIDs))
+		for i, id := range s.ProjectIDs {
+			projects[i] = internal.Project{ID: id}
+			if strconv.Itoa(id) == os.Getenv("CI_PROJECT_ID") {
+				projects[i].Path = os.Getenv("CI_PROJECT_PATH")
+			}
 		}
+		return projects, nil
+	}
 
-		req.Header.Set("PRIVATE-TOKEN", token)
-		res, err := client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error making the request: %v", err)
-		}
-		defer res.Body.Close()
+	user, err := s.GetUser()
+	if err != nil {
+		return nil, fmt.Errorf("error reading GitLab user data: %w", err)
+	}
+
+	projects, err := s.GetUsersProjects(user.ID)
+	if err != nil {
+		return nil, err
+	}
 
-		if res.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("request failed with status code: %v", res.StatusCode)
+	var filtered []internal.Project
+	for _, project := range projects {
+		if s.includesProject(project.Path) {
+			filtered = append(filtered, project)
 		}
+	}
+	return filtered, nil
+}
 
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error reading the response body: %v", err)
+func (s *GitLabSource) includesProject(projectPath string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, projectPath); ok {
+				return true
+			}
 		}
+		return false
+	}
 
-		var commits []internal.Commit
-		err = json.Unmarshal(body, &commits)
+	if len(s.IncludeProjects) > 0 && !matches(s.IncludeProjects) {
+		return false
+	}
+	return !matches(s.ExcludeProjects)
+}
+
+func (s *GitLabSource) outOfScope(provenance Provenance, hashedPaths bool) bool {
+	if provenance.Instance != s.InstanceName {
+		return false
+	}
+	if !s.Since.IsZero() && !provenance.AuthoredDate.IsZero() && provenance.AuthoredDate.Before(s.Since) {
+		return true
+	}
+	// Hashed paths cannot be matched against the project filters.
+	return !hashedPaths && provenance.ProjectPath != "" && !s.includesProject(provenance.ProjectPath)
+}
+
+func (s *GitLabSource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	return s.StreamProjectCommits(project.ID, func(commit internal.Commit) error {
+		commit.ProjectID = project.ID
+		commit.ProjectPath = project.Path
+		commit.Instance = s.InstanceName
+		commits <- commit
+		return nil
+	})
+}
+
+func (s *GitLabSource) GetUser() (internal.GitLabUser, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/api/v4/user", s.BaseURL), nil)
+	if err != nil {
+		return internal.GitLabUser{}, fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := s.authorize(req); err != nil {
+		return internal.GitLabUser{}, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return internal.GitLabUser{}, fmt.Errorf("error making the request: %v", err)
+	}
+	defer closeBody(res)
+
+	if res.StatusCode != http.StatusOK {
+		return internal.GitLabUser{}, s.statusError(res)
+	}
+
+	var user internal.GitLabUser
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+		return internal.GitLabUser{}, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return user, nil
+}
+
+func (s *GitLabSource) GetTokenInfo() (internal.TokenInfo, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/api/v4/personal_access_tokens/self", s.BaseURL), nil)
+	if err != nil {
+		return internal.TokenInfo{}, fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := s.authorize(req); err != nil {
+		return internal.TokenInfo{}, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return internal.TokenInfo{}, fmt.Errorf("error making the request: %v", err)
+	}
+	defer closeBody(res)
+
+	if res.StatusCode != http.StatusOK {
+		return internal.TokenInfo{}, s.statusError(res)
+	}
+
+	var info internal.TokenInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return internal.TokenInfo{}, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	return info, nil
+}
+
+func (s *GitLabSource) GetUsersProjects(userId int) ([]internal.Project, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/api/v4/users/%v/contributed_projects", s.BaseURL, userId), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the request: %v", err)
+	}
+
+	if err := s.authorize(req); err != nil {
+		return nil, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making the request: %v", err)
+	}
+	defer closeBody(res)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, s.statusError(res)
+	}
+
+	var projects []internal.Project
+	if err := json.NewDecoder(res.Body).Decode(&projects); err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %w", err)
+	}
+
+	return projects, nil
+}
+
+// GetProjectCommits collects every commit of the author in the project.
+// Prefer StreamProjectCommits for large histories.
+func (s *GitLabSource) GetProjectCommits(projectId int) ([]internal.Commit, error) {
+	var allCommits []internal.Commit
+	err := s.StreamProjectCommits(projectId, func(commit internal.Commit) error {
+		allCommits = append(allCommits, commit)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allCommits, nil
+}
+
+// StreamProjectCommits pages through the author's commits in the project
+// and hands them to fn one at a time as they are decoded, so memory use
+// does not grow with the size of the history.
+func (s *GitLabSource) StreamProjectCommits(projectId int, fn func(internal.Commit) error) error {
+	page := 1
+	total := 0
+
+	since := ""
+	if !s.Since.IsZero() {
+		since = "&since=" + url.QueryEscape(s.Since.Format(time.RFC3339))
+	}
+
+	for {
+		endpoint := fmt.Sprintf("%v/api/v4/projects/%v/repository/commits?author=%v&with_stats=true%v&per_page=100&page=%d", s.BaseURL, projectId, url.QueryEscape(s.Author), since, page)
+		count, err := s.streamCommitPage(endpoint, fn)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing JSON: %v", err)
+			return err
 		}
 
-		if len(commits) == 0 {
+		if count == 0 {
 			break
 		}
 
-		allCommits = append(allCommits, commits...)
-
+		total += count
 		page++
 	}
 
-	if len(allCommits) == 0 {
-		return nil, fmt.Errorf("found no commits in project no.:%v", projectId)
+	if total == 0 {
+		return fmt.Errorf("found no commits in project no.:%v", projectId)
 	}
 
-	log.Printf("Found total of %v commits in project no.:%v \n", len(allCommits), projectId)
+	log.Printf("Found total of %v commits in project no.:%v \n", total, projectId)
 
-	return allCommits, nil
+	return nil
 }
 
-func FetchAllCommits(projectIds []int, commiterName string, commitChannel chan []internal.Commit) {
-	var wg sync.WaitGroup
+// streamCommitPage decodes a single page of commits. The body is drained and
+// closed before the next page is requested, so the connection is reused.
+func (s *GitLabSource) streamCommitPage(endpoint string, fn func(internal.Commit) error) (int, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching the commits: %v", err)
+	}
+
+	if err := s.authorize(req); err != nil {
+		return 0, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error making the request: %v", err)
+	}
+	defer closeBody(res)
 
-	for _, projectId := range projectIds {
-		wg.Add(1)
+	if res.StatusCode != http.StatusOK {
+		return 0, s.statusError(res)
+	}
 
-		go func(projId int) {
-			defer wg.Done()
+	return DecodeCommits(res.Body, fn)
+}
 
-			commits, err := GetProjectCommits(projId, commiterName)
-			if err != nil {
-				log.Printf("Error fetching commits for project %d: %v", projId, err)
-				return
-			}
-			if len(commits) > 0 {
-				commitChannel <- commits
-			}
+// DecodeCommits decodes a JSON array of commits element by element and
+// calls fn for each of them. It returns the number of decoded commits.
+func DecodeCommits(r io.Reader, fn func(internal.Commit) error) (int, error) {
+	decoder := json.NewDecoder(r)
 
-		}(projectId)
+	if token, err := decoder.Token(); err != nil {
+		return 0, fmt.Errorf("error parsing JSON: %v", err)
+	} else if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return 0, fmt.Errorf("error parsing JSON: expected an array, got %v", token)
 	}
 
-	wg.Wait()
-	close(commitChannel)
+	count := 0
+	for decoder.More() {
+		var commit internal.Commit
+		if err := decoder.Decode(&commit); err != nil {
+			return count, fmt.Errorf("error parsing JSON: %v", err)
+		}
+		if err := fn(commit); err != nil {
+			return count, err
+		}
+		count++
+	}
 
+	if _, err := decoder.Token(); err != nil {
+		return count, fmt.Errorf("error parsing JSON: %v", err)
+	}
+	return count, nil
 }
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpClient is shared by all forge requests, so keep-alive connections
+// are reused across pages and projects.
+var httpClient = &http.Client{Transport: newTransport()}
+
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Commits of every project are fetched concurrently from the same host.
+	transport.MaxIdleConnsPerHost = 32
+	return transport
+}
+
+// ConfigureHTTPClient applies the HTTP settings of the environment to the
+// shared client. It has to run after the environment has been loaded.
+func ConfigureHTTPClient() error {
+	base, err := newTransportFromEnv()
+	if err != nil {
+		return err
+	}
+	installGitTransport(base)
+
+	var transport http.RoundTripper = base
+	cache, err := NewCacheTransportFromEnv(base)
+	if err != nil {
+		return err
+	}
+	if cache != nil {
+		transport = cache
+	}
+
+	httpClient.Transport = transport
+	return nil
+}
+
+// closeBody drains what is left of the body before closing it, otherwise
+// the connection cannot be reused.
+func closeBody(res *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(res.Body, 256<<10))
+	res.Body.Close()
+}
+
+// APIError describes a failed forge API request. Callers can tell the
+// status codes apart with errors.As.
+type APIError struct {
+	StatusCode int
+	Method     string
+	// Path is the request path and query with token parameters redacted.
+	Path      string
+	Message   string
+	RequestID string
+
+	RateLimitLimit     int
+	RateLimitRemaining int
+	RateLimitReset     time.Time
+	RetryAfter         time.Duration
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("request failed with status code: %v (%v %v)", e.StatusCode, e.Method, e.Path)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %v", e.RetryAfter)
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" [request id %v]", e.RequestID)
+	}
+	return msg
+}
+
+var redactedQueryParams = []string{"private_token", "access_token", "job_token", "token"}
+
+// newAPIError reads the error details out of a failed response.
+func newAPIError(res *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		RequestID:  res.Header.Get("X-Request-Id"),
+	}
+
+	if res.Request != nil {
+		apiErr.Method = res.Request.Method
+		apiErr.Path = redactPath(res.Request.URL)
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	apiErr.Message = errorMessage(body)
+
+	apiErr.RateLimitLimit, _ = strconv.Atoi(res.Header.Get("RateLimit-Limit"))
+	apiErr.RateLimitRemaining, _ = strconv.Atoi(res.Header.Get("RateLimit-Remaining"))
+	if reset, err := strconv.ParseInt(res.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		apiErr.RateLimitReset = time.Unix(reset, 0)
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return apiErr
+}
+
+func redactPath(u *url.URL) string {
+	query := u.Query()
+	for _, param := range redactedQueryParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+		}
+	}
+	if len(query) == 0 {
+		return u.EscapedPath()
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// errorMessage extracts the message of GitLab, Gitea, Bitbucket and OAuth
+// error bodies, falling back to the plain body.
+func errorMessage(body []byte) string {
+	var parsed struct {
+		Message          any    `json:"message"`
+		Error            any    `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		Errors           []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return strings.TrimSpace(string(body))
+	}
+
+	switch {
+	case parsed.ErrorDescription != "":
+		return parsed.ErrorDescription
+	case parsed.Message != nil:
+		return formatMessage(parsed.Message)
+	case parsed.Error != nil:
+		return formatMessage(parsed.Error)
+	case len(parsed.Errors) > 0:
+		return parsed.Errors[0].Message
+	}
+	return ""
+}
+
+// formatMessage flattens GitLab validation messages like {"base":["..."]}.
+func formatMessage(message any) string {
+	switch m := message.(type) {
+	case string:
+		return m
+	default:
+		data, _ := json.Marshal(m)
+		return string(data)
+	}
+}
+
+func getJSON(url string, headers map[string]string, v any) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating the request: %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making the request: %v", err)
+	}
+	defer closeBody(res)
+
+	if res.StatusCode != http.StatusOK {
+		return newAPIError(res)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("error reading the response body: %v", err)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error parsing JSON: %v", err)
+	}
+	return nil
+}
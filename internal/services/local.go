@@ -0,0 +1,198 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// LocalSource imports commits from git repositories on disk. Every path is
+// either a repository or a directory that is scanned for repositories.
+type LocalSource struct {
+	Paths      []string
+	Identities []string
+	WithStats  bool
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func NewLocalSourceFromEnv() *LocalSource {
+	contentMode, _ := ContentMirrorMode()
+
+	return &LocalSource{
+		Paths:      splitList(os.Getenv("LOCAL_REPOS")),
+		Identities: authorIdentitiesFromEnv(),
+		WithStats:  contentMode == ContentLog,
+	}
+}
+
+func (s *LocalSource) Name() string {
+	return "local"
+}
+
+func (s *LocalSource) ListProjects() ([]internal.Project, error) {
+	var projects []internal.Project
+	for _, root := range s.Paths {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if _, err := git.PlainOpen(path); err != nil {
+				if d.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			name, err := filepath.Rel(filepath.Dir(root), path)
+			if err != nil {
+				return err
+			}
+			projects = append(projects, internal.Project{
+				ID:   localProjectID(path),
+				Path: filepath.ToSlash(strings.TrimSuffix(name, ".git")),
+				URL:  path,
+			})
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error scanning %v: %v", root, err)
+		}
+	}
+	return projects, nil
+}
+
+func (s *LocalSource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	repo, err := git.PlainOpen(project.URL)
+	if err != nil {
+		return fmt.Errorf("error opening %v: %v", project.URL, err)
+	}
+
+	iter, err := repo.Log(&git.LogOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("failed to get commit log: %v", err)
+	}
+	defer iter.Close()
+
+	found := 0
+	err = iter.ForEach(func(c *object.Commit) error {
+		if !s.matchesAuthor(c.Author) || !s.markSeen(c.Hash.String()) {
+			return nil
+		}
+
+		commit := internal.Commit{
+			ID:            c.Hash.String(),
+			Title:         firstLine(c.Message),
+			Message:       c.Message,
+			AuthorName:    c.Author.Name,
+			AuthorMail:    c.Author.Email,
+			AuthoredDate:  c.Author.When,
+			CommittedDate: c.Committer.When,
+			ProjectID:     project.ID,
+			ProjectPath:   project.Path,
+		}
+		if s.WithStats {
+			commit.Stats = localCommitStats(c)
+		}
+
+		commits <- commit
+		found++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to iterate commits: %v", err)
+	}
+
+	log.Printf("Found total of %v commits in %v \n", found, project.Path)
+	return nil
+}
+
+func (s *LocalSource) matchesAuthor(author object.Signature) bool {
+	return matchesIdentity(s.Identities, author.Name, author.Email)
+}
+
+// markSeen reports whether sha was not seen before, so the same commit in
+// several clones is only imported once.
+func (s *LocalSource) markSeen(sha string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if s.seen[sha] {
+		return false
+	}
+	s.seen[sha] = true
+	return true
+}
+
+func localCommitStats(c *object.Commit) internal.CommitStats {
+	var stats internal.CommitStats
+	fileStats, err := c.Stats()
+	if err != nil {
+		if !errors.Is(err, object.ErrParentNotFound) {
+			log.Printf("Unable to compute stats of %v: %v", c.Hash, err)
+		}
+		return stats
+	}
+
+	for _, file := range fileStats {
+		stats.Additions += file.Addition
+		stats.Deletions += file.Deletion
+	}
+	stats.Total = stats.Additions + stats.Deletions
+	return stats
+}
+
+func localProjectID(path string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(path))
+	return int(hash.Sum32() & 0x7fffffff)
+}
+
+func authorIdentitiesFromEnv() []string {
+	identities := splitList(os.Getenv("AUTHOR_IDENTITIES"))
+	if len(identities) == 0 {
+		identities = splitList(os.Getenv("COMMITER_EMAIL") + "," + os.Getenv("COMMITER_NAME"))
+	}
+	return identities
+}
+
+func matchesIdentity(identities []string, name string, email string) bool {
+	for _, identity := range identities {
+		if strings.EqualFold(identity, email) || strings.EqualFold(identity, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
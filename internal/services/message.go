@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const (
+	RedactHashProject = "hash-project"
+	RedactFirstLine   = "first-line"
+	RedactStripRefs   = "strip-refs"
+
+	defaultMessageTemplate = "{{.SHA}}"
+)
+
+var (
+	urlPattern        = regexp.MustCompile(`https?://\S+`)
+	ticketPattern     = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-\d+\b`)
+	issueRefPattern   = regexp.MustCompile(`(?:[\w.-]+/)*[\w.-]*[#!]\d+\b`)
+	emptyBracePattern = regexp.MustCompile(`\(\s*\)|\[\s*\]`)
+	whitespacePattern = regexp.MustCompile(`[ \t]+`)
+)
+
+// MessageFields are the values available to COMMIT_MESSAGE_TEMPLATE.
+type MessageFields struct {
+	SHA         string
+	ShortSHA    string
+	Title       string
+	Message     string
+	ProjectID   string
+	ProjectPath string
+	Date        string
+}
+
+type MessageBuilder struct {
+	template *template.Template
+	redact   map[string]bool
+	salt     string
+}
+
+func NewMessageBuilder(messageTemplate string, redactModes []string, salt string) (*MessageBuilder, error) {
+	if strings.TrimSpace(messageTemplate) == "" {
+		messageTemplate = defaultMessageTemplate
+	}
+
+	tmpl, err := template.New("message").Option("missingkey=error").Parse(messageTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit message template: %v", err)
+	}
+
+	redact := make(map[string]bool)
+	for _, mode := range redactModes {
+		mode = strings.TrimSpace(mode)
+		if mode == "" {
+			continue
+		}
+		switch mode {
+		case RedactHashProject, RedactFirstLine, RedactStripRefs:
+			redact[mode] = true
+		default:
+			return nil, fmt.Errorf("unknown redaction mode: %v", mode)
+		}
+	}
+
+	return &MessageBuilder{template: tmpl, redact: redact, salt: salt}, nil
+}
+
+func NewMessageBuilderFromEnv() (*MessageBuilder, error) {
+	return NewMessageBuilder(
+		os.Getenv("COMMIT_MESSAGE_TEMPLATE"),
+		strings.Split(os.Getenv("COMMIT_MESSAGE_REDACT"), ","),
+		os.Getenv("REDACT_SALT"),
+	)
+}
+
+func (b *MessageBuilder) Fields(commit internal.Commit) MessageFields {
+	title := commit.Title
+	if title == "" {
+		title = firstLine(commit.Message)
+	}
+	message := strings.TrimSpace(commit.Message)
+
+	if b.redact[RedactFirstLine] {
+		message = firstLine(message)
+	}
+	if b.redact[RedactStripRefs] {
+		title = stripRefs(title)
+		message = stripRefs(message)
+	}
+
+	return MessageFields{
+		SHA:         commit.ID,
+		ShortSHA:    shortID(commit.ID),
+		Title:       title,
+		Message:     message,
+		ProjectID:   b.ProjectID(commit.ProjectID),
+		ProjectPath: b.ProjectName(commit.ProjectPath),
+		Date:        commit.AuthoredDate.Format("2006-01-02"),
+	}
+}
+
+// ProjectName returns the project path as it may appear in the mirror,
+// hashed when the hash-project redaction mode is enabled.
+func (b *MessageBuilder) ProjectName(path string) string {
+	if !b.redact[RedactHashProject] || path == "" {
+		return path
+	}
+	sum := sha256.Sum256([]byte(b.salt + path))
+	return "project-" + hex.EncodeToString(sum[:])[:12]
+}
+
+func (b *MessageBuilder) Build(commit internal.Commit) (string, error) {
+	var buf bytes.Buffer
+	if err := b.template.Execute(&buf, b.Fields(commit)); err != nil {
+		return "", fmt.Errorf("error rendering commit message: %v", err)
+	}
+
+	message := strings.TrimSpace(buf.String())
+	if message == "" {
+		message = commit.ID
+	}
+	return message + "\n\n" + b.Provenance(commit).Trailers(), nil
+}
+
+// ProjectID returns the project ID as it may appear in the mirror, hashed
+// like the project path when the hash-project redaction mode is enabled.
+func (b *MessageBuilder) ProjectID(id int) string {
+	if id == 0 {
+		return ""
+	}
+	if !b.redact[RedactHashProject] {
+		return strconv.Itoa(id)
+	}
+	sum := sha256.Sum256([]byte(b.salt + "#" + strconv.Itoa(id)))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// SourceSHA extracts the original commit SHA from a mirror commit message.
+func SourceSHA(message string) string {
+	return ParseProvenance(message).SHA
+}
+
+// SourceKey returns the same key as internal.Commit.Key for the commit a
+// mirror commit message was created from.
+func SourceKey(message string) string {
+	return ParseProvenance(message).Key()
+}
+
+func trailerValue(message string, trailer string) string {
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		key, value, found := strings.Cut(lines[i], ":")
+		if found && strings.TrimSpace(key) == trailer {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(line)
+}
+
+func stripRefs(s string) string {
+	s = urlPattern.ReplaceAllString(s, "")
+	s = issueRefPattern.ReplaceAllString(s, "")
+	s = ticketPattern.ReplaceAllString(s, "")
+	s = emptyBracePattern.ReplaceAllString(s, "")
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = whitespacePattern.ReplaceAllString(line, " ")
+		line = strings.TrimSpace(line)
+		line = strings.Trim(line, ":-,")
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// newTransportFromEnv builds the transport for API requests and git pushes
+// from the proxy and TLS settings. Without them it behaves like
+// http.DefaultTransport, including HTTPS_PROXY and NO_PROXY.
+func newTransportFromEnv() (*http.Transport, error) {
+	transport := newTransport()
+
+	if proxy := os.Getenv("HTTP_PROXY_URL"); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid HTTP_PROXY_URL: %v", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
+
+func tlsConfigFromEnv() (*tls.Config, error) {
+	caBundle := os.Getenv("TLS_CA_BUNDLE")
+	clientCert := os.Getenv("TLS_CLIENT_CERT")
+	clientKey := os.Getenv("TLS_CLIENT_KEY")
+
+	insecure := false
+	if value := os.Getenv("TLS_INSECURE_SKIP_VERIFY"); value != "" {
+		var err error
+		insecure, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_INSECURE_SKIP_VERIFY: %v", value)
+		}
+	}
+
+	if caBundle == "" && clientCert == "" && clientKey == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS_CA_BUNDLE: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS_CA_BUNDLE %v", caBundle)
+		}
+		config.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New("TLS_CLIENT_CERT and TLS_CLIENT_KEY have to be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the TLS client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if insecure {
+		log.Print("WARNING: TLS_INSECURE_SKIP_VERIFY is enabled, server certificates are NOT verified and connections can be intercepted. Only use this in test environments.")
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// installGitTransport makes go-git clone and push over HTTP(S) with the
+// same proxy and TLS settings as the API requests.
+func installGitTransport(transport *http.Transport) {
+	gitClient := githttp.NewClient(&http.Client{Transport: transport})
+	client.InstallProtocol("https", gitClient)
+	client.InstallProtocol("http", gitClient)
+}
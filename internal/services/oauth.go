@@ -0,0 +1,276 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const (
+	oauthScopes      = "read_api read_user"
+	defaultOAuthPort = "7171"
+)
+
+type OAuthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// OAuthTokenSource hands out GitLab OAuth2 access tokens and refreshes them
+// with the stored refresh token shortly before they expire.
+type OAuthTokenSource struct {
+	BaseURL      string
+	ClientID     string
+	ClientSecret string
+	// Path is where the token is persisted, so rotated refresh tokens
+	// survive between runs.
+	Path string
+
+	mu    sync.Mutex
+	token OAuthToken
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+func DefaultOAuthTokenPath() string {
+	return filepath.Join(internal.GetHomeDirectory(), ".config", "gitlab-activity-importer", "oauth-token.json")
+}
+
+func NewOAuthTokenSourceFromEnv(baseURL string) (*OAuthTokenSource, error) {
+	return newOAuthTokenSource(baseURL, os.Getenv("GITLAB_OAUTH_TOKEN_FILE"), os.Getenv("GITLAB_OAUTH_REFRESH_TOKEN"))
+}
+
+// newOAuthTokenSource reads the token stored at path, or the default path
+// when empty. refreshToken seeds the refresh flow when nothing is stored.
+func newOAuthTokenSource(baseURL string, path string, refreshToken string) (*OAuthTokenSource, error) {
+	source := &OAuthTokenSource{
+		BaseURL:      baseURL,
+		ClientID:     os.Getenv("GITLAB_OAUTH_CLIENT_ID"),
+		ClientSecret: os.Getenv("GITLAB_OAUTH_CLIENT_SECRET"),
+		Path:         path,
+	}
+	if source.Path == "" {
+		source.Path = DefaultOAuthTokenPath()
+	}
+
+	data, err := os.ReadFile(source.Path)
+	if err == nil {
+		if err := json.Unmarshal(data, &source.token); err != nil {
+			return nil, fmt.Errorf("error parsing OAuth token file: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading OAuth token file: %v", err)
+	}
+
+	if refreshToken != "" && source.token.RefreshToken == "" {
+		source.token.RefreshToken = refreshToken
+	}
+
+	return source, nil
+}
+
+func (o *OAuthTokenSource) HasToken() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.token.AccessToken != "" || o.token.RefreshToken != ""
+}
+
+func (o *OAuthTokenSource) AccessToken() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token.AccessToken != "" && (o.token.ExpiresAt.IsZero() || time.Until(o.token.ExpiresAt) > time.Minute) {
+		return o.token.AccessToken, nil
+	}
+	if o.token.RefreshToken == "" {
+		return "", errors.New("OAuth access token expired and no refresh token is available, run the login command again")
+	}
+
+	token, err := o.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {o.token.RefreshToken},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error refreshing OAuth token: %v", err)
+	}
+
+	o.token = token
+	if err := o.save(); err != nil {
+		log.Printf("Unable to store refreshed OAuth token: %v", err)
+	}
+	return o.token.AccessToken, nil
+}
+
+func (o *OAuthTokenSource) requestToken(form url.Values) (OAuthToken, error) {
+	form.Set("client_id", o.ClientID)
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+
+	res, err := httpClient.PostForm(fmt.Sprintf("%v/oauth/token", o.BaseURL), form)
+	if err != nil {
+		return OAuthToken{}, fmt.Errorf("error making the request: %v", err)
+	}
+	defer closeBody(res)
+
+	if res.StatusCode != http.StatusOK {
+		return OAuthToken{}, newAPIError(res)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return OAuthToken{}, fmt.Errorf("error reading the response body: %v", err)
+	}
+
+	var response oauthTokenResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return OAuthToken{}, fmt.Errorf("error parsing JSON: %v", err)
+	}
+
+	token := OAuthToken{AccessToken: response.AccessToken, RefreshToken: response.RefreshToken}
+	if response.ExpiresIn > 0 {
+		created := time.Now()
+		if response.CreatedAt > 0 {
+			created = time.Unix(response.CreatedAt, 0)
+		}
+		token.ExpiresAt = created.Add(time.Duration(response.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+func (o *OAuthTokenSource) save() error {
+	data, err := json.MarshalIndent(o.token, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.Path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(o.Path, data, 0o600)
+}
+
+// Login runs the authorization code flow with PKCE. It prints the
+// GitLab authorization URL, waits for the redirect on a local callback and
+// stores the resulting tokens.
+func (o *OAuthTokenSource) Login(port string) error {
+	if o.ClientID == "" {
+		return errors.New("GITLAB_OAUTH_CLIENT_ID is required for the OAuth login")
+	}
+	if port == "" {
+		port = defaultOAuthPort
+	}
+
+	verifier, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	state, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	redirectURI := fmt.Sprintf("http://127.0.0.1:%v/callback", port)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return fmt.Errorf("error starting the OAuth callback listener: %v", err)
+	}
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "Invalid state.", http.StatusBadRequest)
+			notify(errs, errors.New("OAuth callback state mismatch"))
+			return
+		}
+		if query.Get("error") != "" {
+			http.Error(w, "Authorization failed.", http.StatusBadRequest)
+			notify(errs, fmt.Errorf("authorization failed: %v", query.Get("error_description")))
+			return
+		}
+		fmt.Fprint(w, "Login successful, you can close this window.")
+		notify(codes, query.Get("code"))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authorizeURL := fmt.Sprintf("%v/oauth/authorize?%v", o.BaseURL, url.Values{
+		"client_id":             {o.ClientID},
+		"redirect_uri":          {redirectURI},
+		"response_type":         {"code"},
+		"scope":                 {oauthScopes},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode())
+	log.Printf("Open the following URL in your browser to log in to GitLab:\n%v\n", authorizeURL)
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Minute):
+		return errors.New("timed out waiting for the OAuth callback")
+	}
+
+	token, err := o.requestToken(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return fmt.Errorf("error exchanging the authorization code: %v", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = token
+	if err := o.save(); err != nil {
+		return fmt.Errorf("error storing the OAuth token: %v", err)
+	}
+	log.Printf("Stored OAuth token in %v.\n", o.Path)
+	return nil
+}
+
+// notify sends without blocking, only the first callback result counts.
+func notify[T any](channel chan T, value T) {
+	select {
+	case channel <- value:
+	default:
+	}
+}
+
+func randomString(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+const (
+	ObfuscateCap    = "cap"
+	ObfuscateLevels = "levels"
+	ObfuscateJitter = "jitter"
+
+	defaultObfuscateCap    = 10
+	defaultObfuscateLevels = "1,3,6,10"
+	defaultObfuscateJitter = 3 * time.Hour
+)
+
+// Obfuscation hides exact activity before it is mirrored. Every policy is
+// derived from the commits and Seed only, so repeated runs make the same
+// choices and the mirror stays stable.
+type Obfuscation struct {
+	// Cap limits the contributions per day, zero disables it.
+	Cap int
+	// Levels rounds the contributions of a day down to the closest level,
+	// like the shades of a contribution graph. Empty disables it.
+	Levels []int
+	// Jitter moves commits by up to this much, without leaving their day.
+	Jitter time.Duration
+	Seed   string
+	// Location is the timezone days are bucketed in, nil keeps the offset
+	// of each commit.
+	Location *time.Location
+}
+
+// ObfuscationFromEnv reads OBFUSCATE, a comma separated list of policies,
+// and their settings OBFUSCATE_CAP, OBFUSCATE_LEVELS, OBFUSCATE_JITTER and
+// OBFUSCATE_SEED.
+func ObfuscationFromEnv(location *time.Location) (Obfuscation, error) {
+	obfuscation := Obfuscation{Seed: os.Getenv("OBFUSCATE_SEED"), Location: location}
+
+	for _, policy := range splitList(os.Getenv("OBFUSCATE")) {
+		switch strings.ToLower(policy) {
+		case ObfuscateCap:
+			obfuscation.Cap = defaultObfuscateCap
+			if value := os.Getenv("OBFUSCATE_CAP"); value != "" {
+				limit, err := strconv.Atoi(value)
+				if err != nil || limit < 1 {
+					return Obfuscation{}, fmt.Errorf("invalid OBFUSCATE_CAP: %v", value)
+				}
+				obfuscation.Cap = limit
+			}
+		case ObfuscateLevels:
+			value := os.Getenv("OBFUSCATE_LEVELS")
+			if value == "" {
+				value = defaultObfuscateLevels
+			}
+			levels, err := parseLevels(value)
+			if err != nil {
+				return Obfuscation{}, fmt.Errorf("invalid OBFUSCATE_LEVELS %v: %v", value, err)
+			}
+			obfuscation.Levels = levels
+		case ObfuscateJitter:
+			obfuscation.Jitter = defaultObfuscateJitter
+			if value := os.Getenv("OBFUSCATE_JITTER"); value != "" {
+				jitter, err := time.ParseDuration(value)
+				if err != nil || jitter <= 0 {
+					return Obfuscation{}, fmt.Errorf("invalid OBFUSCATE_JITTER: %v", value)
+				}
+				obfuscation.Jitter = jitter
+			}
+		default:
+			return Obfuscation{}, fmt.Errorf("unknown OBFUSCATE policy: %v", policy)
+		}
+	}
+	return obfuscation, nil
+}
+
+func parseLevels(value string) ([]int, error) {
+	var levels []int
+	for _, entry := range splitList(value) {
+		level, err := strconv.Atoi(entry)
+		if err != nil || level < 1 {
+			return nil, fmt.Errorf("levels must be positive numbers")
+		}
+		if len(levels) > 0 && level <= levels[len(levels)-1] {
+			return nil, fmt.Errorf("levels must be ascending")
+		}
+		levels = append(levels, level)
+	}
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("no levels given")
+	}
+	return levels, nil
+}
+
+func (o Obfuscation) Enabled() bool {
+	return o.LimitsCounts() || o.Jitter > 0
+}
+
+// LimitsCounts reports whether commits are dropped, which needs to know
+// every commit of a day at once.
+func (o Obfuscation) LimitsCounts() bool {
+	return o.Cap > 0 || len(o.Levels) > 0
+}
+
+func (o Obfuscation) day(date time.Time) string {
+	if o.Location != nil {
+		date = date.In(o.Location)
+	}
+	return date.Format("2006-01-02")
+}
+
+// target is how many contributions a day with total contributions shows.
+func (o Obfuscation) target(total int) int {
+	target := total
+	if len(o.Levels) > 0 {
+		target = o.Levels[0]
+		for _, level := range o.Levels {
+			if level <= total {
+				target = level
+			}
+		}
+	}
+	if o.Cap > 0 && target > o.Cap {
+		target = o.Cap
+	}
+	return target
+}
+
+// Apply returns the commits to mirror. commits must not contain commits
+// that are mirrored already, existing are the dates of the mirror history.
+// Days keep their earliest commits up to the target count, counting the
+// commits mirrored by earlier runs first.
+func (o Obfuscation) Apply(commits []internal.Commit, existing []time.Time, policy DatePolicy) []internal.Commit {
+	if o.LimitsCounts() {
+		existingPerDay := make(map[string]int)
+		for _, date := range existing {
+			existingPerDay[o.day(date)]++
+		}
+
+		sorted := append([]internal.Commit(nil), commits...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			a, b := policy.Date(sorted[i]), policy.Date(sorted[j])
+			if !a.Equal(b) {
+				return a.Before(b)
+			}
+			return sorted[i].Key() < sorted[j].Key()
+		})
+
+		perDay := make(map[string]int)
+		for _, commit := range sorted {
+			perDay[o.day(policy.Date(commit))]++
+		}
+
+		kept := make(map[string]int)
+		commits = commits[:0:0]
+		for _, commit := range sorted {
+			day := o.day(policy.Date(commit))
+			allowed := o.target(existingPerDay[day]+perDay[day]) - existingPerDay[day]
+			if kept[day] >= allowed {
+				continue
+			}
+			kept[day]++
+			commits = append(commits, commit)
+		}
+	}
+
+	if o.Jitter > 0 {
+		jittered := make([]internal.Commit, 0, len(commits))
+		for _, commit := range commits {
+			jittered = append(jittered, o.jitter(commit, policy))
+		}
+		commits = jittered
+	}
+	return commits
+}
+
+// jitter moves both dates of the commit by the same seeded offset, clamped
+// to the day the commit was made on.
+func (o Obfuscation) jitter(commit internal.Commit, policy DatePolicy) internal.Commit {
+	date := policy.Date(commit)
+	if o.Location != nil {
+		date = date.In(o.Location)
+	}
+	start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	end := start.AddDate(0, 0, 1).Add(-time.Second)
+
+	sum := sha256.Sum256([]byte(o.Seed + ":" + commit.Key()))
+	span := uint64(2*o.Jitter/time.Second) + 1
+	offset := time.Duration(binary.BigEndian.Uint64(sum[:8])%span)*time.Second - o.Jitter
+
+	shifted := date.Add(offset)
+	if shifted.Before(start) {
+		shifted = start
+	}
+	if shifted.After(end) {
+		shifted = end
+	}
+
+	delta := shifted.Sub(date)
+	commit.AuthoredDate = commit.AuthoredDate.Add(delta)
+	if !commit.CommittedDate.IsZero() {
+		commit.CommittedDate = commit.CommittedDate.Add(delta)
+	}
+	return commit
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const calendarWeeks = 53
+
+var (
+	calendarShades = []string{"·", "░", "▒", "▓", "█"}
+	calendarColors = []string{"#ebedf0", "#9be9a8", "#40c463", "#30a14e", "#216e39"}
+)
+
+// Calendar counts contributions per day, like the contribution graph of a
+// profile. Days are bucketed in Location, or in the commit's own offset
+// when Location is nil.
+type Calendar struct {
+	Location *time.Location
+	// Start is the Sunday the graph begins with and End its last day.
+	Start time.Time
+	End   time.Time
+
+	existing map[string]int
+	pending  map[string]int
+}
+
+func NewCalendar(now time.Time, location *time.Location) *Calendar {
+	if location != nil {
+		now = now.In(location)
+	}
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	start := end.AddDate(0, 0, -7*(calendarWeeks-1)-int(end.Weekday()))
+
+	return &Calendar{
+		Location: location,
+		Start:    start,
+		End:      end,
+		existing: make(map[string]int),
+		pending:  make(map[string]int),
+	}
+}
+
+// GraphTimezoneFromEnv reads GRAPH_TIMEZONE. It defaults to the commit's
+// own offset, which is what GitHub buckets commits by.
+func GraphTimezoneFromEnv() (*time.Location, error) {
+	location, err := ParseTimezone(os.Getenv("GRAPH_TIMEZONE"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown graph timezone %v: %v", os.Getenv("GRAPH_TIMEZONE"), err)
+	}
+	return location, nil
+}
+
+func (c *Calendar) Day(date time.Time) string {
+	if c.Location != nil {
+		date = date.In(c.Location)
+	}
+	return date.Format("2006-01-02")
+}
+
+func (c *Calendar) AddExisting(date time.Time) {
+	c.existing[c.Day(date)]++
+}
+
+func (c *Calendar) AddPending(date time.Time) {
+	c.pending[c.Day(date)]++
+}
+
+// Count returns the existing and pending contributions of a day.
+func (c *Calendar) Count(day string) (int, int) {
+	return c.existing[day], c.pending[day]
+}
+
+func (c *Calendar) days() []time.Time {
+	var days []time.Time
+	for day := c.Start; !day.After(c.End); day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+	return days
+}
+
+func (c *Calendar) maxCount() int {
+	max := 0
+	for _, day := range c.days() {
+		existing, pending := c.Count(day.Format("2006-01-02"))
+		if existing+pending > max {
+			max = existing + pending
+		}
+	}
+	return max
+}
+
+// level maps a count to one of the five shades, relative to the busiest day.
+func level(count int, max int) int {
+	if count <= 0 || max <= 0 {
+		return 0
+	}
+	return min((count*4+max-1)/max, 4)
+}
+
+func (c *Calendar) RenderText(w io.Writer) {
+	days := c.days()
+	max := c.maxCount()
+	weeks := (len(days) + 6) / 7
+
+	var header strings.Builder
+	header.WriteString("    ")
+	for week := 0; week < weeks; week++ {
+		first := days[week*7]
+		// Month labels are wider than a week, skip those that would overlap.
+		if (week == 0 || first.Month() != days[(week-1)*7].Month()) && (week == 0 || header.Len() < week+4) && week+3 <= weeks {
+			header.WriteString(strings.Repeat(" ", week+4-header.Len()))
+			header.WriteString(first.Format("Jan"))
+		}
+	}
+	fmt.Fprintln(w, header.String())
+
+	labels := []string{"", "Mon", "", "Wed", "", "Fri", ""}
+	for weekday := 0; weekday < 7; weekday++ {
+		var row strings.Builder
+		fmt.Fprintf(&row, "%-4s", labels[weekday])
+		for week := 0; week < weeks; week++ {
+			index := week*7 + weekday
+			if index >= len(days) {
+				break
+			}
+			existing, pending := c.Count(days[index].Format("2006-01-02"))
+			row.WriteString(calendarShades[level(existing+pending, max)])
+		}
+		fmt.Fprintln(w, row.String())
+	}
+
+	existingTotal, pendingTotal, active := 0, 0, 0
+	for _, day := range days {
+		existing, pending := c.Count(day.Format("2006-01-02"))
+		existingTotal += existing
+		pendingTotal += pending
+		if existing+pending > 0 {
+			active++
+		}
+	}
+	fmt.Fprintf(w, "\n%d existing and %d new contributions on %d days, at most %d on a single day.\n", existingTotal, pendingTotal, active, max)
+}
+
+func (c *Calendar) RenderSVG(w io.Writer) error {
+	const cell, gap, left, top = 10, 3, 30, 20
+
+	days := c.days()
+	max := c.maxCount()
+	weeks := (len(days) + 6) / 7
+	width := left + weeks*(cell+gap)
+	height := top + 7*(cell+gap)
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="9" fill="#57606a">`+"\n", width, height)
+
+	for weekday, label := range []string{"", "Mon", "", "Wed", "", "Fri", ""} {
+		if label != "" {
+			fmt.Fprintf(&svg, `<text x="0" y="%d">%s</text>`+"\n", top+weekday*(cell+gap)+cell-1, label)
+		}
+	}
+
+	for index, day := range days {
+		week, weekday := index/7, index%7
+		x := left + week*(cell+gap)
+		if weekday == 0 && (week == 0 || day.Month() != days[index-7].Month()) {
+			fmt.Fprintf(&svg, `<text x="%d" y="%d">%s</text>`+"\n", x, top-6, day.Format("Jan"))
+		}
+
+		key := day.Format("2006-01-02")
+		existing, pending := c.Count(key)
+		fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="%d" height="%d" rx="2" fill="%s"><title>%s: %d existing, %d new</title></rect>`+"\n",
+			x, top+weekday*(cell+gap), cell, cell, calendarColors[level(existing+pending, max)], key, existing, pending)
+	}
+
+	svg.WriteString("</svg>\n")
+	_, err := io.WriteString(w, svg.String())
+	return err
+}
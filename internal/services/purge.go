@@ -0,0 +1,768 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// purgedFile records what the purge command removed, so later imports do
+// not bring it back. Source SHAs are stored hashed.
+const purgedFile = ".purged"
+
+var legacyMessagePattern = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+// PurgeFilter selects the mirror commits to remove. Every criterion that is
+// set has to match.
+type PurgeFilter struct {
+	// Projects are project paths, or their hashed names in the mirror.
+	Projects []string
+	// Since and Until are inclusive days in the "2006-01-02" format.
+	Since string
+	Until string
+	// SHAs are source commit SHAs or prefixes of them.
+	SHAs []string
+}
+
+func (f PurgeFilter) Empty() bool {
+	return len(f.Projects) == 0 && f.Since == "" && f.Until == "" && len(f.SHAs) == 0
+}
+
+type PurgeResult struct {
+	Branch  plumbing.ReferenceName
+	OldHead plumbing.Hash
+	NewHead plumbing.Hash
+	// Target is the target branch when the mirror is on the import
+	// branch. It reaches the removed commits through its merges and is
+	// rewritten as well.
+	Target  PurgedBranch
+	Removed []*object.Commit
+	// Unattributed counts mirror commits a project filter cannot match
+	// because they carry no project, such as older imports and per-day
+	// aggregates.
+	Unattributed int
+	Changes      object.Changes
+	// Rewritten are the kept commits whose files the purge changes. They
+	// are only listed with dryRun.
+	Rewritten []RewrittenCommit
+}
+
+type RewrittenCommit struct {
+	Commit *object.Commit
+	Patch  *object.Patch
+}
+
+type PurgedBranch struct {
+	Name    plumbing.ReferenceName
+	OldHead plumbing.Hash
+	NewHead plumbing.Hash
+}
+
+// PurgeMirror rewrites the current branch of the mirror without the
+// imported commits matching filter. Their lines are removed from the
+// activity logs, the counter is lowered and they are recorded in the
+// .purged file, so later imports skip them. With dryRun the branch and
+// work tree are left untouched.
+func PurgeMirror(repo *git.Repository, filter PurgeFilter, builder *MessageBuilder, dryRun bool) (PurgeResult, error) {
+	if filter.Empty() {
+		return PurgeResult{}, fmt.Errorf("no purge filter given")
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return PurgeResult{}, fmt.Errorf("failed to get HEAD reference: %v", err)
+	}
+	result := PurgeResult{Branch: head.Name(), OldHead: head.Hash()}
+
+	branches, err := BranchSettingsFromEnv()
+	if err != nil {
+		return PurgeResult{}, err
+	}
+	heads := []plumbing.Hash{head.Hash()}
+	if branches.Import != "" && head.Name().Short() == branches.Import {
+		target, err := repo.Reference(plumbing.NewBranchReferenceName(branches.Target), true)
+		if err != nil && err != plumbing.ErrReferenceNotFound {
+			return PurgeResult{}, fmt.Errorf("failed to read %v: %v", branches.Target, err)
+		}
+		if err == nil {
+			result.Target = PurgedBranch{Name: target.Name(), OldHead: target.Hash()}
+			heads = append(heads, target.Hash())
+		}
+	}
+
+	commits, err := topologicalCommits(repo, heads...)
+	if err != nil {
+		return PurgeResult{}, err
+	}
+
+	rewriter := &historyRewriter{
+		storer:      repo.Storer,
+		removedIDs:  make(map[string]bool),
+		trees:       make(map[string]plumbing.Hash),
+		rewrittenTo: make(map[plumbing.Hash]plumbing.Hash),
+	}
+	removed := make(map[plumbing.Hash]bool)
+	for _, commit := range commits {
+		matched, attributed := filter.matches(commit, builder)
+		if !attributed {
+			result.Unattributed++
+		}
+		if !matched {
+			continue
+		}
+		removed[commit.Hash] = true
+		result.Removed = append(result.Removed, commit)
+		rewriter.removedIDs[shortID(ParseProvenance(commit.Message).contentID())] = true
+	}
+	if len(result.Removed) == 0 {
+		result.NewHead = result.OldHead
+		result.Target.NewHead = result.Target.OldHead
+		return result, nil
+	}
+
+	var entries []string
+	recorded := make(map[string]bool)
+	for _, hash := range heads {
+		headEntries, err := purgedEntries(repo, hash)
+		if err != nil {
+			return PurgeResult{}, err
+		}
+		for _, entry := range headEntries {
+			if !recorded[entry] {
+				recorded[entry] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	for _, commit := range result.Removed {
+		if provenance := ParseProvenance(commit.Message); len(provenance.Keys) > 0 {
+			for _, key := range provenance.Keys {
+				entries = append(entries, "key "+key)
+			}
+		} else if provenance.Group != "" {
+			entries = append(entries, fmt.Sprintf("group %s %d", provenance.Group, provenance.Count))
+		} else {
+			entries = append(entries, "sha "+purgedKey(provenance.SHA))
+		}
+	}
+
+	// counterDrops are the removed commits that bumped the counter in the
+	// history of a commit, which the rewritten counter is lowered by.
+	// Merges add up the increments of both sides, so every parent counts.
+	counterDrops := make(map[plumbing.Hash]map[plumbing.Hash]bool)
+	for _, commit := range commits {
+		var inherited map[plumbing.Hash]bool
+		var added []plumbing.Hash
+		for i, parent := range commit.ParentHashes {
+			if i == 0 {
+				inherited = counterDrops[parent]
+				continue
+			}
+			for hash := range counterDrops[parent] {
+				if !inherited[hash] && !containsHash(added, hash) {
+					added = append(added, hash)
+				}
+			}
+		}
+		if removed[commit.Hash] && touchesCounter(commit) {
+			added = append(added, commit.Hash)
+		}
+		if len(added) > 0 {
+			merged := make(map[plumbing.Hash]bool, len(inherited)+len(added))
+			for hash := range inherited {
+				merged[hash] = true
+			}
+			for _, hash := range added {
+				merged[hash] = true
+			}
+			inherited = merged
+		}
+		counterDrops[commit.Hash] = inherited
+		drops := len(inherited)
+
+		var parents []plumbing.Hash
+		for _, parent := range commit.ParentHashes {
+			if mapped := rewriter.rewrittenTo[parent]; !mapped.IsZero() && !containsHash(parents, mapped) {
+				parents = append(parents, mapped)
+			}
+		}
+
+		if removed[commit.Hash] {
+			if len(parents) > 0 {
+				rewriter.rewrittenTo[commit.Hash] = parents[0]
+			}
+			continue
+		}
+
+		tree, err := rewriter.rewriteTree(commit.TreeHash, "", drops)
+		if err != nil {
+			return PurgeResult{}, err
+		}
+
+		if tree == commit.TreeHash && equalHashes(parents, commit.ParentHashes) {
+			rewriter.rewrittenTo[commit.Hash] = commit.Hash
+			continue
+		}
+		if dryRun && tree != commit.TreeHash {
+			patch, err := treePatch(repo, commit.TreeHash, tree)
+			if err != nil {
+				return PurgeResult{}, err
+			}
+			result.Rewritten = append(result.Rewritten, RewrittenCommit{Commit: commit, Patch: patch})
+		}
+		rewritten := *commit
+		rewritten.TreeHash = tree
+		rewritten.ParentHashes = parents
+		// The signature would no longer match the rewritten commit.
+		rewritten.PGPSignature = ""
+		hash, err := rewriter.store(&rewritten)
+		if err != nil {
+			return PurgeResult{}, err
+		}
+		rewriter.rewrittenTo[commit.Hash] = hash
+	}
+
+	if result.NewHead, err = rewriter.recordPurged(repo, result.OldHead, entries); err != nil {
+		return PurgeResult{}, err
+	}
+	if result.Target.Name != "" {
+		if result.Target.NewHead, err = rewriter.recordPurged(repo, result.Target.OldHead, entries); err != nil {
+			return PurgeResult{}, err
+		}
+	}
+
+	result.Changes, err = treeChanges(repo, result.OldHead, result.NewHead)
+	if err != nil {
+		return PurgeResult{}, err
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(result.Branch, result.NewHead)); err != nil {
+		return PurgeResult{}, fmt.Errorf("failed to update %v: %v", result.Branch, err)
+	}
+	if result.Target.Name != "" {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(result.Target.Name, result.Target.NewHead)); err != nil {
+			return PurgeResult{}, fmt.Errorf("failed to update %v: %v", result.Target.Name, err)
+		}
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return PurgeResult{}, err
+	}
+	if err := workTree.Reset(&git.ResetOptions{Commit: result.NewHead, Mode: git.HardReset}); err != nil {
+		return PurgeResult{}, fmt.Errorf("failed to reset the work tree: %v", err)
+	}
+	return result, nil
+}
+
+// matches reports whether the mirror commit is an import selected by the
+// filter, and whether a project filter could be applied to it.
+func (f PurgeFilter) matches(commit *object.Commit, builder *MessageBuilder) (bool, bool) {
+	provenance := ParseProvenance(commit.Message)
+	if !provenance.imported() {
+		return false, true
+	}
+
+	project := provenance.ProjectPath
+	attributed := project != "" || len(f.Projects) == 0
+	if len(f.Projects) > 0 {
+		found := false
+		for _, candidate := range f.Projects {
+			if project != "" && (project == candidate || project == builder.ProjectName(candidate)) {
+				found = true
+			}
+		}
+		if !found {
+			return false, attributed
+		}
+	}
+
+	day := commit.Author.When.Format("2006-01-02")
+	if (f.Since != "" && day < f.Since) || (f.Until != "" && day > f.Until) {
+		return false, attributed
+	}
+
+	if len(f.SHAs) > 0 {
+		found := false
+		for _, candidate := range f.SHAs {
+			if provenance.Group == "" && strings.HasPrefix(provenance.SHA, candidate) {
+				found = true
+			}
+		}
+		if !found {
+			return false, attributed
+		}
+	}
+	return true, attributed
+}
+
+// imported tells imports apart from commits made in the mirror by hand,
+// like the initial commit of a new repository.
+func (p Provenance) imported() bool {
+	return p.Group != "" || legacyMessagePattern.MatchString(p.SHA)
+}
+
+// contentID is the ID the synthetic change of a mirror commit was written
+// with.
+func (p Provenance) contentID() string {
+	if p.Group != "" {
+		return shortHash(p.Group)
+	}
+	return p.SHA
+}
+
+func purgedKey(sha string) string {
+	sum := sha256.Sum256([]byte(sha))
+	return hex.EncodeToString(sum[:])
+}
+
+// purgedEntries reads the lines of the .purged file of a mirror commit.
+func purgedEntries(repo *git.Repository, hash plumbing.Hash) ([]string, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %v: %v", hash, err)
+	}
+	file, err := commit.File(purgedFile)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", purgedFile, err)
+	}
+	lines, err := file.Lines()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", purgedFile, err)
+	}
+
+	var entries []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// purgedSources returns the hashed source SHAs, the group counts and the
+// source keys of aggregated commits the purge command removed from the
+// mirror.
+func purgedSources(repo *git.Repository) (map[string]bool, map[string]int, map[string]bool, error) {
+	shas := make(map[string]bool)
+	groups := make(map[string]int)
+	keys := make(map[string]bool)
+
+	tips, err := mirrorTips(repo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var entries []string
+	recorded := make(map[string]bool)
+	for _, tip := range tips {
+		tipEntries, err := purgedEntries(repo, tip)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, entry := range tipEntries {
+			if !recorded[entry] {
+				recorded[entry] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		switch {
+		case len(fields) == 2 && fields[0] == "sha":
+			shas[fields[1]] = true
+		case len(fields) == 2 && fields[0] == "key":
+			keys[fields[1]] = true
+		case len(fields) == 3 && fields[0] == "group":
+			count, err := strconv.Atoi(fields[2])
+			if err == nil {
+				groups[fields[1]] += count
+			}
+		}
+	}
+	return shas, groups, keys, nil
+}
+
+// recordPurged returns the rewritten head, whose commit carries the record
+// of everything purged so far.
+func (r *historyRewriter) recordPurged(repo *git.Repository, oldHead plumbing.Hash, entries []string) (plumbing.Hash, error) {
+	newHead := r.rewrittenTo[oldHead]
+	if newHead.IsZero() {
+		return plumbing.ZeroHash, fmt.Errorf("the purge would remove every commit of the mirror, delete the repository instead")
+	}
+
+	last, err := repo.CommitObject(newHead)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read commit %v: %v", newHead, err)
+	}
+	rewritten := *last
+	rewritten.PGPSignature = ""
+	if rewritten.TreeHash, err = r.withPurgedFile(last.TreeHash, entries); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.store(&rewritten)
+}
+
+// topologicalCommits returns the history of heads with parents before
+// their children.
+func topologicalCommits(repo *git.Repository, heads ...plumbing.Hash) ([]*object.Commit, error) {
+	var ordered []*object.Commit
+	visited := make(map[plumbing.Hash]bool)
+
+	type frame struct {
+		commit *object.Commit
+		next   int
+	}
+	for _, hash := range heads {
+		if visited[hash] {
+			continue
+		}
+		root, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %v: %v", hash, err)
+		}
+		stack := []*frame{{commit: root}}
+		visited[hash] = true
+
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.next < len(top.commit.ParentHashes) {
+				parent := top.commit.ParentHashes[top.next]
+				top.next++
+				if visited[parent] {
+					continue
+				}
+				visited[parent] = true
+				commit, err := repo.CommitObject(parent)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read commit %v: %v", parent, err)
+				}
+				stack = append(stack, &frame{commit: commit})
+				continue
+			}
+			ordered = append(ordered, top.commit)
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return ordered, nil
+}
+
+func touchesCounter(commit *object.Commit) bool {
+	file, err := commit.File(path.Join(activityDir, "counter.txt"))
+	if err != nil {
+		return false
+	}
+	if commit.NumParents() == 0 {
+		return true
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return true
+	}
+	previous, err := parent.File(path.Join(activityDir, "counter.txt"))
+	return err != nil || previous.Hash != file.Hash
+}
+
+func treeChanges(repo *git.Repository, from plumbing.Hash, to plumbing.Hash) (object.Changes, error) {
+	var trees []*object.Tree
+	for _, hash := range []plumbing.Hash{from, to} {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %v: %v", hash, err)
+		}
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the tree of %v: %v", hash, err)
+		}
+		trees = append(trees, tree)
+	}
+	return object.DiffTree(trees[0], trees[1])
+}
+
+func treePatch(repo *git.Repository, from plumbing.Hash, to plumbing.Hash) (*object.Patch, error) {
+	var trees []*object.Tree
+	for _, hash := range []plumbing.Hash{from, to} {
+		tree, err := repo.TreeObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tree %v: %v", hash, err)
+		}
+		trees = append(trees, tree)
+	}
+	return trees[0].Patch(trees[1])
+}
+
+func containsHash(hashes []plumbing.Hash, hash plumbing.Hash) bool {
+	for _, candidate := range hashes {
+		if candidate == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func equalHashes(a []plumbing.Hash, b []plumbing.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// historyRewriter writes the rewritten trees and commits of a purge.
+type historyRewriter struct {
+	storer storer.EncodedObjectStorer
+	// removedIDs are the short IDs the activity log lines of removed
+	// commits were written with.
+	removedIDs  map[string]bool
+	trees       map[string]plumbing.Hash
+	rewrittenTo map[plumbing.Hash]plumbing.Hash
+}
+
+// rewriteTree drops the lines of removed commits from the activity logs
+// below dir and lowers the counter by counterDrops. Other files are kept
+// as they are.
+func (r *historyRewriter) rewriteTree(hash plumbing.Hash, dir string, counterDrops int) (plumbing.Hash, error) {
+	cacheKey := fmt.Sprintf("%v:%v:%d", hash, dir, counterDrops)
+	if rewritten, ok := r.trees[cacheKey]; ok {
+		return rewritten, nil
+	}
+
+	tree, err := object.GetTree(r.storer, hash)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read tree %v: %v", hash, err)
+	}
+
+	var entries []object.TreeEntry
+	for _, entry := range tree.Entries {
+		entryPath := path.Join(dir, entry.Name)
+		switch {
+		case entry.Mode == filemode.Dir && (dir != "" || entry.Name == activityDir):
+			rewritten, err := r.rewriteTree(entry.Hash, entryPath, counterDrops)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			if rewritten.IsZero() {
+				continue
+			}
+			entry.Hash = rewritten
+		case dir != "" && strings.HasSuffix(entry.Name, ".log"):
+			lines, err := r.blobLines(entry.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			var kept []string
+			for _, line := range lines {
+				if fields := strings.Fields(line); len(fields) < 2 || !r.removedIDs[fields[1]] {
+					kept = append(kept, line)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+			if len(kept) != len(lines) {
+				if entry.Hash, err = r.storeBlob(strings.Join(kept, "\n") + "\n"); err != nil {
+					return plumbing.ZeroHash, err
+				}
+			}
+		case entryPath == path.Join(activityDir, "counter.txt") && counterDrops > 0:
+			lines, err := r.blobLines(entry.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			count := 0
+			if len(lines) > 0 {
+				count, _ = strconv.Atoi(strings.TrimSpace(lines[0]))
+			}
+			if count -= counterDrops; count <= 0 {
+				continue
+			}
+			if entry.Hash, err = r.storeBlob(strconv.Itoa(count) + "\n"); err != nil {
+				return plumbing.ZeroHash, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	var rewritten plumbing.Hash
+	if len(entries) > 0 || dir == "" {
+		rewritten, err = r.store(&object.Tree{Entries: entries})
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	r.trees[cacheKey] = rewritten
+	return rewritten, nil
+}
+
+// withPurgedFile adds the .purged file with entries to the root tree.
+func (r *historyRewriter) withPurgedFile(hash plumbing.Hash, entries []string) (plumbing.Hash, error) {
+	tree, err := object.GetTree(r.storer, hash)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read tree %v: %v", hash, err)
+	}
+
+	sort.Strings(entries)
+	content := "# Imports removed by the purge command, skipped by later imports.\n" + strings.Join(entries, "\n") + "\n"
+	blob, err := r.storeBlob(content)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var treeEntries []object.TreeEntry
+	for _, entry := range tree.Entries {
+		if entry.Name != purgedFile {
+			treeEntries = append(treeEntries, entry)
+		}
+	}
+	treeEntries = append(treeEntries, object.TreeEntry{Name: purgedFile, Mode: filemode.Regular, Hash: blob})
+	sort.Slice(treeEntries, func(i, j int) bool {
+		return treeEntryKey(treeEntries[i]) < treeEntryKey(treeEntries[j])
+	})
+	return r.store(&object.Tree{Entries: treeEntries})
+}
+
+// treeEntryKey sorts entries the way git does, directories as if their
+// name ended with a slash.
+func treeEntryKey(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return entry.Name + "/"
+	}
+	return entry.Name
+}
+
+func (r *historyRewriter) blobLines(hash plumbing.Hash) ([]string, error) {
+	blob, err := object.GetBlob(r.storer, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %v: %v", hash, err)
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func (r *historyRewriter) storeBlob(content string) (plumbing.Hash, error) {
+	obj := r.storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	writer, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.WriteString(writer, content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := writer.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.storer.SetEncodedObject(obj)
+}
+
+func (r *historyRewriter) store(encoder interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := r.storer.NewEncodedObject()
+	if err := encoder.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.storer.SetEncodedObject(obj)
+}
+
+// Branches are the rewritten branches, the current branch first.
+func (r PurgeResult) Branches() []PurgedBranch {
+	branches := []PurgedBranch{{Name: r.Branch, OldHead: r.OldHead, NewHead: r.NewHead}}
+	if r.Target.Name != "" {
+		branches = append(branches, r.Target)
+	}
+	return branches
+}
+
+// ForcePublishAll publishes the rewritten branches to every destination.
+// Remotes only accept a branch while it still points at its old head, the
+// head the rewrite started from, so imports pushed in the meantime are not
+// lost. Directory exports are written once from HEAD.
+func ForcePublishAll(repo *git.Repository, destinations []Destination, branches []PurgedBranch) error {
+	var names []string
+	for _, branch := range branches {
+		names = append(names, branch.Name.Short())
+	}
+
+	var failed []string
+	for _, destination := range destinations {
+		log.Printf("Publishing the rewritten %v to %v.\n", strings.Join(names, " and "), destination.Name())
+
+		var err error
+		if _, ok := destination.(*DirectoryExport); ok {
+			err = destination.Publish(repo)
+		} else {
+			for _, branch := range branches {
+				if err = forcePushWithLease(repo, destination, branch.Name, branch.OldHead); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Error publishing to %v: %v", destination.Name(), err)
+			failed = append(failed, destination.Name())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("publishing failed for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func forcePushWithLease(repo *git.Repository, destination Destination, branch plumbing.ReferenceName, lease plumbing.Hash) error {
+	if bare, ok := destination.(*BareRepository); ok {
+		if _, err := git.PlainOpen(bare.Path); err == git.ErrRepositoryNotExists {
+			return fmt.Errorf("bare repository %v does not exist", bare.Path)
+		}
+	}
+	url, auth, err := destinationRemote(destination)
+	if err != nil {
+		return err
+	}
+	if err := ensureRemote(repo, destination.Name(), url); err != nil {
+		return fmt.Errorf("error configuring remote %v: %v", destination.Name(), err)
+	}
+
+	err = pushWithLease(repo, destination.Name(), auth, branch, lease)
+	var stale *staleLeaseError
+	if errors.As(err, &stale) {
+		return fmt.Errorf("%v changed since the mirror was last published, run the import and the purge again", destination.Name())
+	}
+	return err
+}
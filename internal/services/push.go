@@ -0,0 +1,609 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	PushConflictRebase = "rebase"
+	PushConflictMerge  = "merge"
+	PushConflictFail   = "fail"
+
+	// pushAttempts bounds how often a rejected push is retried after
+	// catching up with the remote.
+	pushAttempts = 3
+)
+
+// PushSettings decide what happens when a remote moved since the mirror
+// last published to it.
+type PushSettings struct {
+	Conflict string
+	// Lease, when set, force pushes as long as the remote branch is at
+	// this hash, without catching up.
+	Lease    plumbing.Hash
+	Branches BranchSettings
+}
+
+// PushSettingsFromEnv reads PUSH_CONFLICT, the branch settings and the
+// lease of the named remote. Each destination has its own lease in
+// DESTINATION_<NAME>_LEASE_HASH, origin may use PUSH_LEASE_HASH as well.
+func PushSettingsFromEnv(remoteName string) (PushSettings, error) {
+	settings := PushSettings{Conflict: strings.ToLower(strings.TrimSpace(os.Getenv("PUSH_CONFLICT")))}
+	switch settings.Conflict {
+	case "":
+		settings.Conflict = PushConflictRebase
+	case PushConflictRebase, PushConflictMerge, PushConflictFail:
+	default:
+		return PushSettings{}, fmt.Errorf("unknown PUSH_CONFLICT mode: %v", settings.Conflict)
+	}
+
+	variable := DestinationEnvPrefix(remoteName) + "LEASE_HASH"
+	if os.Getenv(variable) == "" && remoteName == "origin" {
+		variable = "PUSH_LEASE_HASH"
+	}
+	if value := strings.TrimSpace(os.Getenv(variable)); value != "" {
+		if !plumbing.IsHash(value) {
+			return PushSettings{}, fmt.Errorf("invalid %v: %v", variable, value)
+		}
+		settings.Lease = plumbing.NewHash(value)
+	}
+
+	branches, err := BranchSettingsFromEnv()
+	if err != nil {
+		return PushSettings{}, err
+	}
+	settings.Branches = branches
+	return settings, nil
+}
+
+// SafePush pushes the current branch. When the remote moved, its branch
+// is fetched and the mirror either rebases its imported commits onto it or
+// merges it, then the push is retried. On the import branch, the target
+// branch is brought up to it and pushed as well.
+func SafePush(repo *git.Repository, remoteName string, auth transport.AuthMethod, settings PushSettings) error {
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		log.Printf("Nothing to push to %v, the mirror has no commits yet.\n", remoteName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD reference: %v", err)
+	}
+	branch := head.Name()
+
+	// Only origin is caught up with. Other destinations that moved would
+	// otherwise rewrite the history the mirror shares with origin.
+	conflict := settings.Conflict
+	if remoteName != "origin" {
+		conflict = PushConflictFail
+	}
+
+	if !settings.Lease.IsZero() {
+		err = pushWithLease(repo, remoteName, auth, branch, settings.Lease)
+	} else {
+		err = pushBranch(repo, remoteName, auth, branch, conflict)
+	}
+	if err == nil && settings.Branches.Import != "" && branch.Short() == settings.Branches.Import {
+		err = pushTarget(repo, remoteName, auth, branch, plumbing.NewBranchReferenceName(settings.Branches.Target), conflict)
+	}
+	if isRejectedPush(err) && remoteName != "origin" {
+		return fmt.Errorf("%v has commits the mirror does not have, only origin is caught up with: %v", remoteName, err)
+	}
+	return err
+}
+
+func pushBranch(repo *git.Repository, remoteName string, auth transport.AuthMethod, branch plumbing.ReferenceName, conflict string) error {
+	for attempt := 1; ; attempt++ {
+		err := pushRefSpec(repo, remoteName, auth, branch)
+		if err == nil || !isRejectedPush(err) || conflict == PushConflictFail || attempt == pushAttempts {
+			return err
+		}
+
+		log.Printf("%v moved since the last import, fetching it to %v the mirror.\n", remoteName, conflict)
+		remoteHead, err := fetchBranch(repo, remoteName, auth, branch)
+		if err != nil {
+			return err
+		}
+		if err := integrateRemote(repo, branch, remoteHead, conflict); err != nil {
+			return err
+		}
+	}
+}
+
+// pushTarget merges the import branch into target and pushes it. The
+// local target only ever holds what was published, so when the remote
+// moved it is replaced by the remote branch and merged again.
+func pushTarget(repo *git.Repository, remoteName string, auth transport.AuthMethod, imports plumbing.ReferenceName, target plumbing.ReferenceName, conflict string) error {
+	source, err := repo.Reference(imports, true)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", imports, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := mergeIntoBranch(repo, target, source.Hash()); err != nil {
+			return fmt.Errorf("error merging %v into %v: %v", imports.Short(), target.Short(), err)
+		}
+		err := pushRefSpec(repo, remoteName, auth, target)
+		if err == nil || !isRejectedPush(err) || conflict == PushConflictFail || attempt == pushAttempts {
+			return err
+		}
+
+		log.Printf("%v moved on %v, merging the imports into it again.\n", remoteName, target.Short())
+		remoteHead, err := fetchBranch(repo, remoteName, auth, target)
+		if err != nil {
+			return err
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(target, remoteHead)); err != nil {
+			return fmt.Errorf("failed to update %v: %v", target, err)
+		}
+	}
+}
+
+// pushRefSpec pushes branch to the branch of the same name on the remote.
+// A push the remote rejects because it moved is reported as
+// git.ErrNonFastForwardUpdate.
+func pushRefSpec(repo *git.Repository, remoteName string, auth transport.AuthMethod, branch plumbing.ReferenceName) error {
+	err := repo.Push(&git.PushOptions{
+		RemoteName: remoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", branch, branch))},
+		Auth:       auth,
+		Progress:   os.Stdout,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		log.Printf("No changes to push %v to %v, everything is up to date.\n", branch.Short(), remoteName)
+		return nil
+	}
+	if err != nil && remoteMoved(repo, remoteName, auth, branch) {
+		return fmt.Errorf("%w: %v on %v", git.ErrNonFastForwardUpdate, branch.Short(), remoteName)
+	}
+	return err
+}
+
+func isRejectedPush(err error) bool {
+	return errors.Is(err, git.ErrNonFastForwardUpdate)
+}
+
+// remoteMoved reports whether the remote branch has commits the local
+// branch does not have. go-git does not tell a rejected push apart from
+// other failures, so the remote is listed to find out.
+func remoteMoved(repo *git.Repository, remoteName string, auth transport.AuthMethod, branch plumbing.ReferenceName) bool {
+	remoteHead, err := remoteBranchHash(repo, remoteName, auth, branch)
+	if err != nil || remoteHead.IsZero() {
+		return false
+	}
+	local, err := repo.Reference(branch, true)
+	if err != nil || local.Hash() == remoteHead {
+		return false
+	}
+	remote, err := repo.CommitObject(remoteHead)
+	if err != nil {
+		// The mirror has never seen the remote head.
+		return true
+	}
+	head, err := repo.CommitObject(local.Hash())
+	if err != nil {
+		return false
+	}
+	ancestor, err := remote.IsAncestor(head)
+	return err == nil && !ancestor
+}
+
+// remoteBranchHash returns where branch is on the remote, or the zero hash
+// when the remote does not have it.
+func remoteBranchHash(repo *git.Repository, remoteName string, auth transport.AuthMethod, branch plumbing.ReferenceName) (plumbing.Hash, error) {
+	remote, err := repo.Remote(remoteName)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	for _, ref := range refs {
+		if ref.Name() == branch {
+			return ref.Hash(), nil
+		}
+	}
+	return plumbing.ZeroHash, nil
+}
+
+// staleLeaseError is returned when a remote branch moved away from the
+// lease a force push expected it at.
+type staleLeaseError struct {
+	remote string
+	lease  plumbing.Hash
+}
+
+func (e *staleLeaseError) Error() string {
+	return fmt.Sprintf("%v is no longer at the expected %v, fetch it and try again", e.remote, shortID(e.lease.String()))
+}
+
+// pushWithLease force pushes branch as long as the remote branch is still
+// at lease.
+func pushWithLease(repo *git.Repository, remoteName string, auth transport.AuthMethod, branch plumbing.ReferenceName, lease plumbing.Hash) error {
+	// go-git checks the lease against the remote tracking branch, which
+	// is missing when the mirror has never fetched from this remote. It is
+	// planted at the lease for the push and removed again when the push
+	// does not replace it.
+	tracking := plumbing.NewRemoteReferenceName(remoteName, branch.Short())
+	planted := false
+	if _, err := repo.Reference(tracking, false); err == plumbing.ErrReferenceNotFound {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(tracking, lease)); err != nil {
+			return err
+		}
+		planted = true
+	}
+
+	err := repo.Push(&git.PushOptions{
+		RemoteName:     remoteName,
+		RefSpecs:       []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", branch, branch))},
+		Auth:           auth,
+		Progress:       os.Stdout,
+		ForceWithLease: &git.ForceWithLease{RefName: branch, Hash: lease},
+	})
+	if ref, refErr := repo.Reference(tracking, false); planted && refErr == nil && ref.Hash() == lease {
+		if err := repo.Storer.RemoveReference(tracking); err != nil {
+			return err
+		}
+	}
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	if err != nil {
+		if remoteHead, listErr := remoteBranchHash(repo, remoteName, auth, branch); listErr == nil && remoteHead != lease {
+			return &staleLeaseError{remote: remoteName, lease: lease}
+		}
+	}
+	return err
+}
+
+func fetchBranch(repo *git.Repository, remoteName string, auth transport.AuthMethod, branch plumbing.ReferenceName) (plumbing.Hash, error) {
+	tracking := plumbing.NewRemoteReferenceName(remoteName, branch.Short())
+	err := repo.Fetch(&git.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", branch, tracking))},
+		Auth:       auth,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, fmt.Errorf("error fetching %v from %v: %v", branch.Short(), remoteName, err)
+	}
+
+	ref, err := repo.Reference(tracking, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error reading %v: %v", tracking, err)
+	}
+	return ref.Hash(), nil
+}
+
+// integrateRemote moves branch onto remoteHead, rebasing or merging the
+// local commits, and resets the work tree to the result.
+func integrateRemote(repo *git.Repository, branch plumbing.ReferenceName, remoteHead plumbing.Hash, mode string) error {
+	head, err := repo.Reference(branch, true)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", branch, err)
+	}
+	local, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	remote, err := repo.CommitObject(remoteHead)
+	if err != nil {
+		return err
+	}
+
+	behind, err := local.IsAncestor(remote)
+	if err != nil {
+		return err
+	}
+	result := remote.Hash
+	if !behind && mode == PushConflictMerge {
+		result, err = mergeCommits(repo, local, remote, "Merge the remote mirror history")
+	} else if !behind {
+		result, err = rebaseCommits(repo, local, remote)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, result)); err != nil {
+		return fmt.Errorf("failed to update %v: %v", branch, err)
+	}
+	workTree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := workTree.Reset(&git.ResetOptions{Commit: result, Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("failed to reset the work tree: %v", err)
+	}
+	return nil
+}
+
+// rebaseCommits replays the commits of local that remote does not have on
+// top of remote. Imports the remote already has, for example from another
+// machine running at the same time, are dropped.
+func rebaseCommits(repo *git.Repository, local *object.Commit, remote *object.Commit) (plumbing.Hash, error) {
+	remoteCommits := make(map[plumbing.Hash]bool)
+	remoteKeys := make(map[string]bool)
+	iter, err := repo.Log(&git.LogOptions{From: remote.Hash})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get commit log: %v", err)
+	}
+	err = iter.ForEach(func(c *object.Commit) error {
+		remoteCommits[c.Hash] = true
+		if ParseProvenance(c.Message).imported() {
+			remoteKeys[mirrorKey(c.Message)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to iterate commits: %v", err)
+	}
+
+	var replay []*object.Commit
+	for commit := local; commit != nil && !remoteCommits[commit.Hash]; {
+		replay = append(replay, commit)
+		if commit.NumParents() == 0 {
+			break
+		}
+		if commit, err = commit.Parent(0); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	rewriter := &historyRewriter{storer: repo.Storer}
+	onto := remote
+	for i := len(replay) - 1; i >= 0; i-- {
+		commit := replay[i]
+		if ParseProvenance(commit.Message).imported() && remoteKeys[mirrorKey(commit.Message)] {
+			log.Printf("Dropping %v, the remote already has it.\n", shortID(commit.Hash.String()))
+			continue
+		}
+
+		var parentTree plumbing.Hash
+		if commit.NumParents() > 0 {
+			parent, err := commit.Parent(0)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			parentTree = parent.TreeHash
+		}
+		tree, err := rewriter.mergeTrees(parentTree, onto.TreeHash, commit.TreeHash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		rebased := *commit
+		rebased.TreeHash = tree
+		rebased.ParentHashes = []plumbing.Hash{onto.Hash}
+		rebased.PGPSignature = ""
+		hash, err := rewriter.store(&rebased)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if onto, err = repo.CommitObject(hash); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	return onto.Hash, nil
+}
+
+// mirrorKey identifies the source of an imported commit, aggregated ones
+// by their group and count.
+func mirrorKey(message string) string {
+	provenance := ParseProvenance(message)
+	if provenance.Group != "" {
+		return provenance.Group + "/" + strconv.Itoa(provenance.Count)
+	}
+	return provenance.Key()
+}
+
+// mergeCommits creates a merge commit of local and remote.
+func mergeCommits(repo *git.Repository, local *object.Commit, remote *object.Commit, message string) (plumbing.Hash, error) {
+	var baseTree plumbing.Hash
+	bases, err := local.MergeBase(remote)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(bases) > 0 {
+		baseTree = bases[0].TreeHash
+	}
+
+	rewriter := &historyRewriter{storer: repo.Storer}
+	tree, err := rewriter.mergeTrees(baseTree, remote.TreeHash, local.TreeHash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	signature := object.Signature{Name: os.Getenv("COMMITER_NAME"), Email: os.Getenv("COMMITER_EMAIL"), When: time.Now()}
+	return rewriter.store(&object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      message,
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{local.Hash, remote.Hash},
+	})
+}
+
+type treeFile struct {
+	Hash plumbing.Hash
+	Mode filemode.FileMode
+}
+
+// mergeTrees applies the changes from base to theirs on top of ours, file
+// by file. Activity logs and the counter are merged line by line, other
+// files changed on both sides keep the version of ours, the remote.
+func (r *historyRewriter) mergeTrees(base plumbing.Hash, ours plumbing.Hash, theirs plumbing.Hash) (plumbing.Hash, error) {
+	var files [3]map[string]treeFile
+	for i, hash := range []plumbing.Hash{base, ours, theirs} {
+		var err error
+		if files[i], err = r.flattenTree(hash); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	baseFiles, ourFiles, theirFiles := files[0], files[1], files[2]
+
+	paths := make(map[string]bool)
+	for _, set := range files {
+		for name := range set {
+			paths[name] = true
+		}
+	}
+
+	merged := make(map[string]treeFile)
+	for name := range paths {
+		b, o, t := baseFiles[name], ourFiles[name], theirFiles[name]
+		switch {
+		case o == t, b == t:
+			if !o.Hash.IsZero() {
+				merged[name] = o
+			}
+		case b == o:
+			if !t.Hash.IsZero() {
+				merged[name] = t
+			}
+		case path.Dir(name) == activityDir && strings.HasSuffix(name, ".log"):
+			file, err := r.mergeLog(b, o, t)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			merged[name] = file
+		case name == path.Join(activityDir, "counter.txt"):
+			file, err := r.mergeCounter(b, o, t)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			merged[name] = file
+		default:
+			if !o.Hash.IsZero() {
+				merged[name] = o
+			}
+		}
+	}
+	return r.buildTree(merged)
+}
+
+func (r *historyRewriter) flattenTree(hash plumbing.Hash) (map[string]treeFile, error) {
+	files := make(map[string]treeFile)
+	if hash.IsZero() {
+		return files, nil
+	}
+	tree, err := object.GetTree(r.storer, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree %v: %v", hash, err)
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files[f.Name] = treeFile{Hash: f.Hash, Mode: f.Mode}
+		return nil
+	})
+	return files, err
+}
+
+func (r *historyRewriter) fileLines(file treeFile) ([]string, error) {
+	if file.Hash.IsZero() {
+		return nil, nil
+	}
+	return r.blobLines(file.Hash)
+}
+
+// mergeLog removes the lines theirs removed from ours and appends the
+// lines theirs added.
+func (r *historyRewriter) mergeLog(base treeFile, ours treeFile, theirs treeFile) (treeFile, error) {
+	var lines [3][]string
+	for i, file := range []treeFile{base, ours, theirs} {
+		var err error
+		if lines[i], err = r.fileLines(file); err != nil {
+			return treeFile{}, err
+		}
+	}
+	inBase, inTheirs := lineSet(lines[0]), lineSet(lines[2])
+
+	var merged []string
+	for _, line := range lines[1] {
+		if !inBase[line] || inTheirs[line] {
+			merged = append(merged, line)
+		}
+	}
+	inMerged := lineSet(merged)
+	for _, line := range lines[2] {
+		if !inBase[line] && !inMerged[line] {
+			merged = append(merged, line)
+		}
+	}
+
+	hash, err := r.storeBlob(strings.Join(merged, "\n") + "\n")
+	return treeFile{Hash: hash, Mode: filemode.Regular}, err
+}
+
+// mergeCounter adds the increments of theirs to ours.
+func (r *historyRewriter) mergeCounter(base treeFile, ours treeFile, theirs treeFile) (treeFile, error) {
+	var counts [3]int
+	for i, file := range []treeFile{base, ours, theirs} {
+		lines, err := r.fileLines(file)
+		if err != nil {
+			return treeFile{}, err
+		}
+		if len(lines) > 0 {
+			counts[i], _ = strconv.Atoi(strings.TrimSpace(lines[0]))
+		}
+	}
+
+	hash, err := r.storeBlob(strconv.Itoa(counts[1]+counts[2]-counts[0]) + "\n")
+	return treeFile{Hash: hash, Mode: filemode.Regular}, err
+}
+
+func lineSet(lines []string) map[string]bool {
+	set := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		set[line] = true
+	}
+	return set
+}
+
+// buildTree writes files, keyed by their slash separated path, as nested
+// trees.
+func (r *historyRewriter) buildTree(files map[string]treeFile) (plumbing.Hash, error) {
+	children := make(map[string]map[string]treeFile)
+	var entries []object.TreeEntry
+	for name, file := range files {
+		first, rest, nested := strings.Cut(name, "/")
+		if !nested {
+			entries = append(entries, object.TreeEntry{Name: first, Mode: file.Mode, Hash: file.Hash})
+			continue
+		}
+		if children[first] == nil {
+			children[first] = make(map[string]treeFile)
+		}
+		children[first][rest] = file
+	}
+
+	for name, nested := range children {
+		hash, err := r.buildTree(nested)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return treeEntryKey(entries[i]) < treeEntryKey(entries[j])
+	})
+	return r.store(&object.Tree{Entries: entries})
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+)
+
+// Source is a forge or repository collection that commits get imported from.
+type Source interface {
+	Name() string
+	ListProjects() ([]internal.Project, error)
+	// ListCommits sends the configured author's commits in project to commits.
+	// It does not close the channel.
+	ListCommits(project internal.Project, commits chan<- internal.Commit) error
+}
+
+// scopedSource is implemented by sources that fetch only part of the
+// history, so verify does not report the rest of the mirror as orphaned.
+type scopedSource interface {
+	// outOfScope tells whether a mirror commit belongs to the source but
+	// is no longer fetched by it. hashedPaths is set when the mirror
+	// hashes project paths.
+	outOfScope(provenance Provenance, hashedPaths bool) bool
+}
+
+type ProjectRef struct {
+	Source  Source
+	Project internal.Project
+}
+
+func SourcesFromEnv() ([]Source, error) {
+	var sources []Source
+	if os.Getenv("BASE_URL") != "" {
+		gitlab, err := NewGitLabSourceFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, gitlab)
+	}
+	instances, err := GitLabInstancesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		sources = append(sources, instance)
+	}
+	if os.Getenv("LOCAL_REPOS") != "" {
+		sources = append(sources, NewLocalSourceFromEnv())
+	}
+	if os.Getenv("BITBUCKET_URL") != "" {
+		sources = append(sources, NewBitbucketSourceFromEnv())
+	}
+	if os.Getenv("GITEA_URL") != "" {
+		sources = append(sources, NewGiteaSourceFromEnv())
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no sources configured")
+	}
+	return sources, nil
+}
+
+func ListAllProjects(sources []Source) ([]ProjectRef, error) {
+	var projects []ProjectRef
+	for _, source := range sources {
+		sourceProjects, err := source.ListProjects()
+		if err != nil {
+			return nil, fmt.Errorf("error listing projects of %v: %w", source.Name(), err)
+		}
+
+		log.Printf("Found contributions in %v projects of %v \n", len(sourceProjects), source.Name())
+		for _, project := range sourceProjects {
+			projects = append(projects, ProjectRef{Source: source, Project: project})
+		}
+	}
+	return projects, nil
+}
+
+// commitBatchSize bounds how many commits of a project are held in memory
+// before they are handed to the importer.
+const commitBatchSize = 1000
+
+// fetchConcurrency bounds how many projects are fetched at the same time,
+// which keeps the number of open connections and files in check.
+const fetchConcurrency = 8
+
+func FetchAllCommits(projects []ProjectRef, commitChannel chan []internal.Commit) {
+	forEachProject(projects, func(ref ProjectRef) {
+		if err := sendCommits(ref, commitChannel); err != nil {
+			logFetchError(ref, err)
+		}
+	})
+	close(commitChannel)
+}
+
+// forEachProject calls fn for every project from at most fetchConcurrency
+// goroutines and returns once all calls are done.
+func forEachProject(projects []ProjectRef, fn func(ProjectRef)) {
+	refs := make(chan ProjectRef)
+	var wg sync.WaitGroup
+
+	for i := 0; i < fetchConcurrency && i < len(projects); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range refs {
+				fn(ref)
+			}
+		}()
+	}
+
+	for _, ref := range projects {
+		refs <- ref
+	}
+	close(refs)
+	wg.Wait()
+}
+
+// logFetchError keeps a project that disappeared apart from credential
+// problems, which affect every project of the source.
+func logFetchError(ref ProjectRef, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		log.Printf("Error fetching commits for project %v of %v: %v", ref.Project.ID, ref.Source.Name(), err)
+		return
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusNotFound:
+		log.Printf("Skipping project %v of %v, it no longer exists or is not visible: %v", ref.Project.ID, ref.Source.Name(), err)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		log.Printf("Access to project %v of %v was denied, check the token and its scopes: %v", ref.Project.ID, ref.Source.Name(), err)
+	case http.StatusTooManyRequests:
+		log.Printf("Rate limited while fetching project %v of %v: %v", ref.Project.ID, ref.Source.Name(), err)
+	default:
+		log.Printf("Error fetching commits for project %v of %v: %v", ref.Project.ID, ref.Source.Name(), err)
+	}
+}
+
+// sendCommits streams the project's commits to commitChannel in batches of
+// at most commitBatchSize.
+func sendCommits(ref ProjectRef, commitChannel chan []internal.Commit) error {
+	stream := make(chan internal.Commit)
+	errChannel := make(chan error, 1)
+
+	go func() {
+		defer close(stream)
+		errChannel <- ref.Source.ListCommits(ref.Project, stream)
+	}()
+
+	var batch []internal.Commit
+	for commit := range stream {
+		batch = append(batch, commit)
+		if len(batch) == commitBatchSize {
+			commitChannel <- batch
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		commitChannel <- batch
+	}
+	return <-errChannel
+}
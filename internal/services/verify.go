@@ -0,0 +1,225 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// VerifyOptions are the import settings the mirror is expected to follow.
+type VerifyOptions struct {
+	Policy      DatePolicy
+	Obfuscation Obfuscation
+	Aggregation string
+	Location    *time.Location
+	// Unverified are the projects, named as in the mirror, whose commits
+	// could not be fetched.
+	Unverified map[string]bool
+	// Sources and Builder leave out mirror commits the sources no longer
+	// fetch, because of their since date or project filters.
+	Sources []Source
+	Builder *MessageBuilder
+}
+
+// MirrorCommit is an imported commit of the mirror history.
+type MirrorCommit struct {
+	Hash       plumbing.Hash
+	Date       time.Time
+	Provenance Provenance
+}
+
+type DateMismatch struct {
+	Mirror   MirrorCommit
+	Expected time.Time
+}
+
+type VerifyReport struct {
+	Checked       int
+	SourceCommits int
+	// Missing are source commits the next import would add.
+	Missing       []internal.Commit
+	MissingGroups []CommitGroup
+	// Orphaned are mirror commits whose source commit was not found.
+	Orphaned       []MirrorCommit
+	DateMismatches []DateMismatch
+	// Unverified counts mirror commits of projects that failed to fetch.
+	Unverified int
+	// OutOfScope counts mirror commits the sources no longer fetch.
+	OutOfScope int
+}
+
+func (r VerifyReport) Drift() bool {
+	return len(r.Missing) > 0 || len(r.MissingGroups) > 0 || len(r.Orphaned) > 0 || len(r.DateMismatches) > 0
+}
+
+// FetchCommitsForVerify fetches the commits of every project and returns
+// the names, as in the mirror, of the projects that failed. Projects that
+// no longer exist count as fetched without commits.
+func FetchCommitsForVerify(projects []ProjectRef, builder *MessageBuilder) ([]internal.Commit, map[string]bool) {
+	var mu sync.Mutex
+	var commits []internal.Commit
+	failed := make(map[string]bool)
+
+	forEachProject(projects, func(ref ProjectRef) {
+		batches := make(chan []internal.Commit)
+		collected := make(chan []internal.Commit)
+		go func() {
+			var fetched []internal.Commit
+			for batch := range batches {
+				fetched = append(fetched, batch...)
+			}
+			collected <- fetched
+		}()
+		err := sendCommits(ref, batches)
+		close(batches)
+		fetched := <-collected
+
+		mu.Lock()
+		defer mu.Unlock()
+		var apiErr *APIError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound) {
+			logFetchError(ref, err)
+			failed[builder.ProjectName(ref.Project.Path)] = true
+			return
+		}
+		commits = append(commits, fetched...)
+	})
+
+	return commits, failed
+}
+
+// MirrorCommits returns the imported commits of the mirror history with
+// their provenance. Aggregated commits are left out.
+func MirrorCommits(repo *git.Repository) ([]MirrorCommit, error) {
+	var commits []MirrorCommit
+	err := walkMirror(repo, func(c *object.Commit) error {
+		if provenance := ParseProvenance(c.Message); provenance.imported() && provenance.Group == "" {
+			commits = append(commits, MirrorCommit{Hash: c.Hash, Date: c.Author.When, Provenance: provenance})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// VerifyMirror cross-checks the mirror history against the commits fetched
+// from the sources.
+func VerifyMirror(repo *git.Repository, commits []internal.Commit, options VerifyOptions) (VerifyReport, error) {
+	report := VerifyReport{SourceCommits: len(commits)}
+
+	if options.Aggregation == AggregateNone {
+		missing, err := ObfuscatePending(repo, commits, options.Obfuscation, options.Policy)
+		if err != nil {
+			return VerifyReport{}, err
+		}
+		report.Missing = missing
+	} else {
+		groups, err := PendingGroups(repo, options.Obfuscation.Apply(commits, nil, options.Policy), options.Aggregation, options.Policy, options.Location)
+		if err != nil {
+			return VerifyReport{}, err
+		}
+		report.MissingGroups = groups
+	}
+
+	bySHA := make(map[string]internal.Commit)
+	byKey := make(map[string]internal.Commit)
+	for _, commit := range commits {
+		bySHA[commit.ID] = commit
+		byKey[commit.Key()] = commit
+	}
+	// Only the jitter moves dates, the other policies drop commits.
+	jitter := Obfuscation{Jitter: options.Obfuscation.Jitter, Seed: options.Obfuscation.Seed, Location: options.Obfuscation.Location}
+
+	mirrored, err := MirrorCommits(repo)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	hashedPaths := options.Builder != nil && options.Builder.redact[RedactHashProject]
+	for _, mirror := range mirrored {
+		provenance := mirror.Provenance
+		if outOfScope(options.Sources, provenance, hashedPaths) {
+			report.OutOfScope++
+			continue
+		}
+		if len(options.Unverified) > 0 && (provenance.ProjectPath == "" || options.Unverified[provenance.ProjectPath]) {
+			report.Unverified++
+			continue
+		}
+		report.Checked++
+
+		source, ok := byKey[provenance.Key()]
+		if !ok && provenance.Instance == "" {
+			source, ok = bySHA[provenance.SHA]
+		}
+		if !ok {
+			report.Orphaned = append(report.Orphaned, mirror)
+			continue
+		}
+
+		// Git stores dates with a precision of seconds.
+		expected := options.Policy.Date(jitter.Apply([]internal.Commit{source}, nil, options.Policy)[0]).Truncate(time.Second)
+		if !mirror.Date.Equal(expected) {
+			report.DateMismatches = append(report.DateMismatches, DateMismatch{Mirror: mirror, Expected: expected})
+		}
+	}
+	return report, nil
+}
+
+func outOfScope(sources []Source, provenance Provenance, hashedPaths bool) bool {
+	for _, source := range sources {
+		if scoped, ok := source.(scopedSource); ok && scoped.outOfScope(provenance, hashedPaths) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r VerifyReport) Print(w io.Writer) {
+	if len(r.Missing) > 0 {
+		fmt.Fprintf(w, "Missing from the mirror (%d):\n", len(r.Missing))
+		for _, commit := range r.Missing {
+			fmt.Fprintf(w, "  - %s %s %s\n", commit.Key(), commit.AuthoredDate.Format(time.RFC3339), commit.ProjectPath)
+		}
+	}
+	if len(r.MissingGroups) > 0 {
+		fmt.Fprintf(w, "Groups with missing contributions (%d):\n", len(r.MissingGroups))
+		for _, group := range r.MissingGroups {
+			fmt.Fprintf(w, "  - %s, %d source commits\n", group.Key, len(group.Commits))
+		}
+	}
+	if len(r.Orphaned) > 0 {
+		fmt.Fprintf(w, "Source commit no longer found (%d):\n", len(r.Orphaned))
+		for _, mirror := range r.Orphaned {
+			fmt.Fprintf(w, "  - %s %s %s\n", shortID(mirror.Hash.String()), mirror.Provenance.Key(), mirror.Provenance.ProjectPath)
+		}
+	}
+	if len(r.DateMismatches) > 0 {
+		fmt.Fprintf(w, "Date mismatches (%d):\n", len(r.DateMismatches))
+		for _, mismatch := range r.DateMismatches {
+			fmt.Fprintf(w, "  - %s %s: mirror %s, source %s\n", shortID(mismatch.Mirror.Hash.String()), mismatch.Mirror.Provenance.Key(),
+				mismatch.Mirror.Date.Format(time.RFC3339), mismatch.Expected.Format(time.RFC3339))
+		}
+	}
+	if r.Unverified > 0 {
+		fmt.Fprintf(w, "%d mirror commits belong to projects that could not be fetched and were not checked.\n", r.Unverified)
+	}
+	if r.OutOfScope > 0 {
+		fmt.Fprintf(w, "%d mirror commits are outside the since dates or project filters of the sources and were not checked.\n", r.OutOfScope)
+	}
+
+	status := "no drift"
+	if r.Drift() {
+		status = "drift found"
+	}
+	fmt.Fprintf(w, "Checked %d mirror commits against %d source commits: %s.\n", r.Checked, r.SourceCommits, status)
+}
@@ -7,10 +7,39 @@ import (
 
 type Commit struct {
 	ID           string    `json:"id"`
+	Title        string    `json:"title"`
 	Message      string    `json:"message"`
 	AuthorName   string    `json:"author_name"`
 	AuthorMail   string    `json:"author_email"`
 	AuthoredDate time.Time `json:"authored_date"`
+	// CommittedDate differs from AuthoredDate for rebased or cherry-picked
+	// commits. Both keep the offset reported by the source.
+	CommittedDate time.Time   `json:"committed_date"`
+	Stats         CommitStats `json:"stats"`
+	ProjectID     int         `json:"-"`
+	ProjectPath   string      `json:"-"`
+	Instance      string      `json:"-"`
+}
+
+// Key identifies the commit across all sources. Commits of unnamed sources
+// are keyed by their SHA alone.
+func (c Commit) Key() string {
+	if c.Instance == "" {
+		return c.ID
+	}
+	return c.Instance + ":" + c.ID
+}
+
+type CommitStats struct {
+	Additions int `json:"additions"`
+	Deletions int `json:"deletions"`
+	Total     int `json:"total"`
+}
+
+type Project struct {
+	ID   int    `json:"id"`
+	Path string `json:"path_with_namespace"`
+	URL  string `json:"web_url"`
 }
 
 type GitLabUser struct {
@@ -18,11 +47,23 @@ type GitLabUser struct {
 	Username string `json:"username"`
 }
 
+// TokenInfo describes the token making the request, as returned by
+// /personal_access_tokens/self. ExpiresAt is a date or empty.
+type TokenInfo struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	Active    bool     `json:"active"`
+	Revoked   bool     `json:"revoked"`
+	ExpiresAt string   `json:"expires_at"`
+}
+
 func (c Commit) Print() {
 	fmt.Printf("Commit Details:\n")
-	fmt.Printf("ID           : %s\n", c.ID)
-	fmt.Printf("Message      : %s\n", c.Message)
-	fmt.Printf("Author Name  : %s\n", c.AuthorName)
-	fmt.Printf("Author Email : %s\n", c.AuthorMail)
-	fmt.Printf("Authored Date: %s\n", c.AuthoredDate)
+	fmt.Printf("ID            : %s\n", c.ID)
+	fmt.Printf("Message       : %s\n", c.Message)
+	fmt.Printf("Author Name   : %s\n", c.AuthorName)
+	fmt.Printf("Author Email  : %s\n", c.AuthorMail)
+	fmt.Printf("Authored Date : %s\n", c.AuthoredDate)
+	fmt.Printf("Committed Date: %s\n", c.CommittedDate)
 }
@@ -9,12 +9,21 @@ import (
 	"github.com/joho/godotenv"
 )
 
-func CheckEnvVariables() error {
+func LoadEnvFile() error {
 	if os.Getenv("ENV") == "DEVELOPMENT" {
 		if err := godotenv.Load(); err != nil {
 			return fmt.Errorf("error loading .env file: %v", err)
 		}
 	}
+	return nil
+}
+
+// CheckEnvVariables reports the required variables that are not set.
+// ORIGIN_TOKEN is left out unless originToken is set.
+func CheckEnvVariables(originToken bool) error {
+	if err := LoadEnvFile(); err != nil {
+		return err
+	}
 
 	requiredEnvVars := []string{
 		"BASE_URL",
@@ -25,13 +34,32 @@ func CheckEnvVariables() error {
 		"ORIGIN_TOKEN",
 	}
 
+	skip := make(map[string]bool)
+	if !originToken {
+		skip["ORIGIN_TOKEN"] = true
+	}
+	if os.Getenv("BASE_URL") == "" && hasOtherSource() {
+		skip["BASE_URL"] = true
+		skip["GITLAB_TOKEN"] = true
+	}
+	if hasGitlabCredentials() {
+		skip["GITLAB_TOKEN"] = true
+	}
+
 	var missingVars []string
 	for _, envVar := range requiredEnvVars {
-		if os.Getenv(envVar) == "" {
+		if !skip[envVar] && os.Getenv(envVar) == "" {
 			missingVars = append(missingVars, envVar)
 		}
 	}
 
+	if os.Getenv("BITBUCKET_URL") != "" && os.Getenv("BITBUCKET_TOKEN") == "" {
+		missingVars = append(missingVars, "BITBUCKET_TOKEN")
+	}
+	if os.Getenv("GITEA_URL") != "" && os.Getenv("GITEA_TOKEN") == "" {
+		missingVars = append(missingVars, "GITEA_TOKEN")
+	}
+
 	if len(missingVars) > 0 {
 		return fmt.Errorf("missing required environment variables: %s", strings.Join(missingVars, ", "))
 	}
@@ -39,6 +67,29 @@ func CheckEnvVariables() error {
 	return nil
 }
 
+// hasGitlabCredentials reports whether the GitLab token is provided in
+// another way than the GITLAB_TOKEN variable.
+func hasGitlabCredentials() bool {
+	switch os.Getenv("GITLAB_AUTH") {
+	case "oauth":
+		return true
+	case "job":
+		if os.Getenv("CI_JOB_TOKEN") != "" {
+			return true
+		}
+	}
+	return os.Getenv("GITLAB_TOKEN_FILE") != "" || os.Getenv("GITLAB_TOKEN_COMMAND") != ""
+}
+
+func hasOtherSource() bool {
+	for _, envVar := range []string{"GITLAB_INSTANCES", "LOCAL_REPOS", "BITBUCKET_URL", "GITEA_URL"} {
+		if os.Getenv(envVar) != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func GetHomeDirectory() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
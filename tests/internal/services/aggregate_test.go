@@ -0,0 +1,189 @@
+package services_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func aggregateFixture() []internal.Commit {
+	day := func(d int, hour int) time.Time {
+		return time.Date(2024, 6, d, hour, 0, 0, 0, time.UTC)
+	}
+	return []internal.Commit{
+		{ID: "a1", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(10, 9)},
+		{ID: "a2", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(10, 17)},
+		{ID: "b1", ProjectID: 2, ProjectPath: "group/web", AuthoredDate: day(10, 12)},
+		{ID: "b2", ProjectID: 2, ProjectPath: "group/web", AuthoredDate: day(11, 8)},
+		{ID: "b2", ProjectID: 2, ProjectPath: "group/web", AuthoredDate: day(11, 8)},
+	}
+}
+
+func TestGroupCommits(t *testing.T) {
+	policy, _ := services.NewDatePolicy("", "")
+
+	tests := []struct {
+		name     string
+		mode     string
+		location *time.Location
+		expected string
+	}{
+		{name: "per day", mode: services.AggregateDay, expected: "day:2024-06-10=3 day:2024-06-11=1"},
+		{name: "per project and day", mode: services.AggregateProjectDay, expected: "group/web@2024-06-10=1 group/api@2024-06-10=2 group/web@2024-06-11=1"},
+		{
+			name:     "bucketed in a timezone",
+			mode:     services.AggregateDay,
+			location: time.FixedZone("", 8*3600),
+			expected: "day:2024-06-10=2 day:2024-06-11=2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var summary []string
+			for _, group := range services.GroupCommits(aggregateFixture(), tt.mode, policy, tt.location) {
+				name := group.Key
+				if group.ProjectPath != "" {
+					name = group.ProjectPath + "@" + group.Day
+				}
+				summary = append(summary, fmt.Sprintf("%s=%d", name, len(group.Commits)))
+			}
+			if strings.Join(summary, " ") != tt.expected {
+				t.Errorf("Expected groups %s, got %s", tt.expected, strings.Join(summary, " "))
+			}
+		})
+	}
+}
+
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func newAggregateMirror(t *testing.T) *git.Repository {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+	t.Setenv("MIRROR_CONTENT", "log")
+
+	repo, err := git.PlainInit(filepath.Join(home, "commits-importer"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	return repo
+}
+
+func TestAggregatedCommitsTrackSourceCommits(t *testing.T) {
+	day := func(hour int) time.Time {
+		return time.Date(2024, 6, 10, hour, 0, 0, 0, time.UTC)
+	}
+	first := []internal.Commit{
+		{ID: "a1", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(9)},
+		{ID: "a2", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(10)},
+	}
+
+	t.Run("a day that lost and gained a commit", func(t *testing.T) {
+		repo := newAggregateMirror(t)
+		services.CreateAggregatedCommits(repo, first, services.AggregateDay)
+
+		// a2 was force pushed away upstream, a3 is new.
+		moved := []internal.Commit{first[0], {ID: "a3", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(11)}}
+		if created := services.CreateAggregatedCommits(repo, moved, services.AggregateDay); created != 1 {
+			t.Errorf("Expected the new commit to be imported, got %d commits", created)
+		}
+		if created := services.CreateAggregatedCommits(repo, moved, services.AggregateDay); created != 0 {
+			t.Errorf("Expected a repeated run to create no commits, got %d", created)
+		}
+	})
+
+	t.Run("switching from 1:1 imports", func(t *testing.T) {
+		repo := newAggregateMirror(t)
+		services.CreateLocalCommit(repo, first)
+
+		if created := services.CreateAggregatedCommits(repo, first, services.AggregateDay); created != 0 {
+			t.Errorf("Expected the 1:1 imports to count for their day, got %d commits", created)
+		}
+		policy, _ := services.NewDatePolicy("", "")
+		if groups, _ := services.PendingGroups(repo, first, services.AggregateDay, policy, nil); len(groups) != 0 {
+			t.Errorf("Expected no pending groups, got %d", len(groups))
+		}
+	})
+
+	t.Run("purged days stay purged", func(t *testing.T) {
+		repo := newAggregateMirror(t)
+		commits := append(first, internal.Commit{ID: "b1", ProjectID: 2, ProjectPath: "group/web", AuthoredDate: day(9).AddDate(0, 0, 1)})
+		services.CreateAggregatedCommits(repo, commits, services.AggregateDay)
+
+		builder, _ := services.NewMessageBuilder("", nil, "")
+		if _, err := services.PurgeMirror(repo, services.PurgeFilter{Until: "2024-06-10"}, builder, false); err != nil {
+			t.Fatalf("PurgeMirror returned error: %v", err)
+		}
+		if created := services.CreateAggregatedCommits(repo, commits, services.AggregateDay); created != 0 {
+			t.Errorf("Expected the purged day not to be imported again, got %d commits", created)
+		}
+	})
+}
+
+func TestCreateAggregatedCommits(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+	t.Setenv("MIRROR_CONTENT", "log")
+
+	repo, err := git.PlainInit(filepath.Join(home, "commits-importer"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	commits := aggregateFixture()
+	if created := services.CreateAggregatedCommits(repo, commits, services.AggregateDay); created != 2 {
+		t.Errorf("Expected 2 day commits, got %d", created)
+	}
+	if created := services.CreateAggregatedCommits(repo, commits, services.AggregateDay); created != 0 {
+		t.Errorf("Expected a repeated run to create no commits, got %d", created)
+	}
+
+	commits = append(commits, internal.Commit{ID: "c1", ProjectID: 3, ProjectPath: "group/docs", AuthoredDate: time.Date(2024, 6, 10, 20, 0, 0, 0, time.UTC)})
+	if created := services.CreateAggregatedCommits(repo, commits, services.AggregateDay); created != 1 {
+		t.Errorf("Expected a single delta commit, got %d", created)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read HEAD: %v", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read the last commit: %v", err)
+	}
+
+	expected := "1 contributions on 2024-06-10\n\ngroup/api: 2\ngroup/docs: 1\ngroup/web: 1\n\n3 contributions of this day were imported before.\n\nSource-Group: day:2024-06-10\nSource-Count: 1\nSource-Keys: " + keyHash("c1") + "\nImporter-Version: dev"
+	if strings.TrimSpace(commit.Message) != expected {
+		t.Errorf("Unexpected delta commit message:\n%s", commit.Message)
+	}
+	if !commit.Author.When.Equal(time.Date(2024, 6, 10, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the delta commit at the latest commit of the day, got %v", commit.Author.When)
+	}
+
+	count := 0
+	iter, _ := repo.Log(&git.LogOptions{From: head.Hash()})
+	iter.ForEach(func(*object.Commit) error {
+		count++
+		return nil
+	})
+	if count != 3 {
+		t.Errorf("Expected 3 mirror commits, got %d", count)
+	}
+}
@@ -0,0 +1,142 @@
+package services_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestBitbucketSourceListProjects(t *testing.T) {
+	pages := map[string]string{
+		"0": `{"values":[{"id":1,"slug":"api","project":{"key":"ACME"},"links":{"self":[{"href":"https://bitbucket.example.com/projects/ACME/repos/api/browse"}]}}],"isLastPage":false,"nextPageStart":1}`,
+		"1": `{"values":[{"id":2,"slug":"web","project":{"key":"ACME"},"links":{"self":[]}}],"isLastPage":true}`,
+	}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/1.0/repos" {
+			t.Errorf("Expected path /rest/api/1.0/repos, got %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("Expected Authorization 'Bearer test-token', got '%s'", r.Header.Get("Authorization"))
+		}
+		if r.URL.Query().Get("limit") != "100" {
+			t.Errorf("Expected limit 100, got %s", r.URL.Query().Get("limit"))
+		}
+
+		page, ok := pages[r.URL.Query().Get("start")]
+		if !ok {
+			t.Fatalf("Unexpected start %s", r.URL.Query().Get("start"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, page)
+	}))
+	defer mockServer.Close()
+
+	source := &services.BitbucketSource{BaseURL: mockServer.URL, Token: "test-token"}
+	projects, err := source.ListProjects()
+	if err != nil {
+		t.Fatalf("ListProjects returned error: %v", err)
+	}
+
+	expected := []internal.Project{
+		{ID: 1, Path: "ACME/api", URL: "https://bitbucket.example.com/projects/ACME/repos/api/browse"},
+		{ID: 2, Path: "ACME/web"},
+	}
+	if !reflect.DeepEqual(projects, expected) {
+		t.Errorf("Expected '%v', got '%v'", expected, projects)
+	}
+}
+
+func TestBitbucketSourceListCommits(t *testing.T) {
+	fixedTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		statusCode  int
+		response    map[string]interface{}
+		expectedIds []string
+		expectError bool
+	}{
+		{
+			name:       "commits filtered by author",
+			statusCode: 200,
+			response: map[string]interface{}{
+				"values": []map[string]interface{}{
+					{
+						"id":              "123",
+						"message":         "first commit\n\nbody",
+						"author":          map[string]string{"name": "John Doe", "emailAddress": "john@doe.com"},
+						"authorTimestamp": fixedTime.UnixMilli(),
+					},
+					{
+						"id":              "456",
+						"message":         "someone else",
+						"author":          map[string]string{"name": "Jane Roe", "emailAddress": "jane@roe.com"},
+						"authorTimestamp": fixedTime.UnixMilli(),
+					},
+				},
+				"isLastPage": true,
+			},
+			expectedIds: []string{"123"},
+		},
+		{
+			name:        "repository not found",
+			statusCode:  404,
+			response:    map[string]interface{}{"errors": []map[string]string{{"message": "Repository ACME/api does not exist."}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				expectedPath := "/rest/api/1.0/projects/ACME/repos/api/commits"
+				if r.URL.Path != expectedPath {
+					t.Errorf("Expected path %s, got %s", expectedPath, r.URL.Path)
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.statusCode)
+				responseData, err := json.Marshal(tt.response)
+				if err != nil {
+					t.Fatalf("Failed to marshal response data: %v", err)
+				}
+				w.Write(responseData)
+			}))
+			defer mockServer.Close()
+
+			source := &services.BitbucketSource{BaseURL: mockServer.URL, Token: "test-token", Identities: []string{"john@doe.com"}}
+			commits := make(chan internal.Commit, 10)
+			err := source.ListCommits(internal.Project{ID: 1, Path: "ACME/api"}, commits)
+			close(commits)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListCommits returned error: %v", err)
+			}
+
+			var ids []string
+			for commit := range commits {
+				ids = append(ids, commit.ID)
+				if commit.Title != "first commit" || !commit.AuthoredDate.Equal(fixedTime) || commit.ProjectPath != "ACME/api" {
+					t.Errorf("Unexpected commit: %+v", commit)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.expectedIds) {
+				t.Errorf("Expected '%v', got '%v'", tt.expectedIds, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestBranchSettingsFromEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		imports   string
+		expectErr bool
+	}{
+		{name: "defaults"},
+		{name: "target only", target: "main"},
+		{name: "import branch", target: "main", imports: "imports"},
+		{name: "import without target", imports: "imports", expectErr: true},
+		{name: "same branches", target: "main", imports: "main", expectErr: true},
+		{name: "invalid name", target: "bad..name", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TARGET_BRANCH", tt.target)
+			t.Setenv("IMPORT_BRANCH", tt.imports)
+
+			settings, err := services.BranchSettingsFromEnv()
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Expected error: %v, got %v", tt.expectErr, err)
+			}
+			if err == nil && (settings.Target != tt.target || settings.Import != tt.imports) {
+				t.Errorf("Expected %q and %q, got %+v", tt.target, tt.imports, settings)
+			}
+		})
+	}
+}
+
+// newBranchMirror opens the mirror of a fresh HOME against remote, the way
+// the importer does on its first run.
+func newBranchMirror(t *testing.T, remote string, target string, imports string) *pushMachine {
+	t.Helper()
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+	t.Setenv("MIRROR_CONTENT", "log")
+	t.Setenv("PUSH_CONFLICT", "")
+	t.Setenv("PUSH_LEASE_HASH", "")
+	t.Setenv("ORIGIN_REPO_URL", remote)
+	t.Setenv("TARGET_BRANCH", target)
+	t.Setenv("IMPORT_BRANCH", imports)
+
+	machine := &pushMachine{home: t.TempDir()}
+	machine.use(t)
+	machine.repo = services.OpenOrInitClone()
+	return machine
+}
+
+func remoteBranch(t *testing.T, remote string, branch string) plumbing.Hash {
+	t.Helper()
+	repo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatalf("Failed to open the remote: %v", err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return ref.Hash()
+}
+
+func remoteBranchSubjects(t *testing.T, remote string, branch string) string {
+	t.Helper()
+	repo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatalf("Failed to open the remote: %v", err)
+	}
+	iter, err := repo.Log(&git.LogOptions{From: remoteBranch(t, remote, branch)})
+	if err != nil {
+		t.Fatalf("Failed to read the log of %v: %v", branch, err)
+	}
+	var subjects []string
+	iter.ForEach(func(c *object.Commit) error {
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects = append(subjects, subject)
+		return nil
+	})
+	return strings.Join(subjects, ",")
+}
+
+func TestEmptyRemoteIsInitialisedOnTargetBranch(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatalf("Failed to init the remote: %v", err)
+	}
+
+	machine := newBranchMirror(t, remote, "main", "")
+	machine.importCommits(t, pushCommit("aaaa0001", 10))
+	if err := machine.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	if remoteBranch(t, remote, "main").IsZero() {
+		t.Errorf("Expected the imports on main")
+	}
+	if !remoteBranch(t, remote, "master").IsZero() {
+		t.Errorf("Expected no master branch on the remote")
+	}
+}
+
+func TestTargetBranchDiffersFromRemoteDefault(t *testing.T) {
+	remote, _, _ := newPushSetup(t)
+	master := remoteBranch(t, remote, "master")
+
+	machine := newBranchMirror(t, remote, "main", "")
+	if head, _ := machine.repo.Head(); head.Name() != plumbing.NewBranchReferenceName("main") {
+		t.Fatalf("Expected the mirror on main, got %v", head.Name())
+	}
+	machine.importCommits(t, pushCommit("aaaa0002", 11))
+	if err := machine.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	if remoteBranch(t, remote, "master") != master {
+		t.Errorf("Expected the remote default branch to be left alone")
+	}
+	if subjects := remoteBranchSubjects(t, remote, "main"); subjects != "aaaa0002,aaaa0001" {
+		t.Errorf("Expected main to start from the existing history, got %v", subjects)
+	}
+}
+
+func TestImportBranchIsMergedIntoTarget(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatalf("Failed to init the remote: %v", err)
+	}
+
+	a := newBranchMirror(t, remote, "main", "imports")
+	a.importCommits(t, pushCommit("aaaa0001", 10))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if remoteBranch(t, remote, "main") != remoteBranch(t, remote, "imports") {
+		t.Errorf("Expected main to be fast-forwarded to the imports")
+	}
+
+	// Someone else moves main, the next publish has to merge.
+	b := newBranchMirror(t, remote, "main", "")
+	b.importCommits(t, pushCommit("bbbb0001", 11))
+	if err := b.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish main: %v", err)
+	}
+
+	t.Setenv("TARGET_BRANCH", "main")
+	t.Setenv("IMPORT_BRANCH", "imports")
+	a.importCommits(t, pushCommit("aaaa0002", 12))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	if subjects := remoteBranchSubjects(t, remote, "imports"); subjects != "aaaa0002,aaaa0001" {
+		t.Errorf("Expected the import branch to only have imports, got %v", subjects)
+	}
+	repo, _ := git.PlainOpen(remote)
+	main, err := repo.CommitObject(remoteBranch(t, remote, "main"))
+	if err != nil {
+		t.Fatalf("Failed to read main: %v", err)
+	}
+	if main.NumParents() != 2 {
+		t.Errorf("Expected main to merge the imports, got %d parents", main.NumParents())
+	}
+	file, err := main.File("activity/group__api.log")
+	if err != nil {
+		t.Fatalf("Failed to read the activity log: %v", err)
+	}
+	content, _ := file.Contents()
+	if expected := "2024-06-10 aaaa0001 1\n2024-06-12 aaaa0002 1\n2024-06-11 bbbb0001 1\n"; content != expected {
+		t.Errorf("Expected the merged activity log, got %q", content)
+	}
+}
+
+func TestFetchMirrorKeepsLocalImports(t *testing.T) {
+	remote, a, b := newPushSetup(t)
+	t.Setenv("TARGET_BRANCH", "")
+	t.Setenv("IMPORT_BRANCH", "")
+
+	a.importCommits(t, pushCommit("aaaa0001", 10), pushCommit("aaaa0002", 11))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	b.importCommits(t, pushCommit("bbbb0001", 12))
+	local, _ := b.repo.Head()
+	if err := services.FetchMirror(b.repo); err != nil {
+		t.Fatalf("FetchMirror returned error: %v", err)
+	}
+	if head, _ := b.repo.Head(); head.Hash() != local.Hash() {
+		t.Errorf("Expected FetchMirror to leave the branch at %v, got %v", local.Hash(), head.Hash())
+	}
+	dates, err := services.MirrorCommitDates(b.repo)
+	if err != nil {
+		t.Fatalf("MirrorCommitDates returned error: %v", err)
+	}
+	if len(dates) != 3 {
+		t.Errorf("Expected the published and the local imports, got %d commits", len(dates))
+	}
+
+	// A mirror behind the remote only reads the remote-tracking branch.
+	c := &pushMachine{home: t.TempDir()}
+	if c.repo, err = git.PlainClone(filepath.Join(c.home, "commits-importer"), false, &git.CloneOptions{URL: remote}); err != nil {
+		t.Fatalf("Failed to clone the remote: %v", err)
+	}
+	cloned, _ := c.repo.Head()
+	a.importCommits(t, pushCommit("aaaa0003", 13))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	c.use(t)
+	if err := services.FetchMirror(c.repo); err != nil {
+		t.Fatalf("FetchMirror returned error: %v", err)
+	}
+	if head, _ := c.repo.Head(); head.Hash() != cloned.Hash() {
+		t.Errorf("Expected FetchMirror to leave the branch at %v, got %v", cloned.Hash(), head.Hash())
+	}
+	if dates, _ = services.MirrorCommitDates(c.repo); len(dates) != 3 {
+		t.Errorf("Expected the commits of the remote-tracking branch, got %d commits", len(dates))
+	}
+
+	// Without a local mirror, origin is read into memory.
+	d := &pushMachine{home: t.TempDir()}
+	t.Setenv("ORIGIN_REPO_URL", remote)
+	d.use(t)
+	repo, err := services.OpenMirrorReadOnly()
+	if err != nil {
+		t.Fatalf("OpenMirrorReadOnly returned error: %v", err)
+	}
+	if dates, _ = services.MirrorCommitDates(repo); len(dates) != 3 {
+		t.Errorf("Expected the published commits, got %d commits", len(dates))
+	}
+	if _, err := os.Stat(filepath.Join(d.home, "commits-importer")); !os.IsNotExist(err) {
+		t.Errorf("Expected no mirror to be created, got %v", err)
+	}
+}
+
+func TestPurgeRewritesTargetBranch(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatalf("Failed to init the remote: %v", err)
+	}
+
+	a := newBranchMirror(t, remote, "main", "imports")
+	a.importCommits(t, pushCommit("aaaa0001", 10))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	b := newBranchMirror(t, remote, "main", "")
+	b.importCommits(t, pushCommit("bbbb0001", 11))
+	if err := b.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish main: %v", err)
+	}
+	t.Setenv("TARGET_BRANCH", "main")
+	t.Setenv("IMPORT_BRANCH", "imports")
+	a.importCommits(t, pushCommit("aaaa0002", 12))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	a.use(t)
+	builder, _ := services.NewMessageBuilder("", nil, "")
+	result, err := services.PurgeMirror(a.repo, services.PurgeFilter{SHAs: []string{"aaaa0001"}}, builder, false)
+	if err != nil {
+		t.Fatalf("PurgeMirror returned error: %v", err)
+	}
+	if result.Target.Name.Short() != "main" {
+		t.Fatalf("Expected main to be rewritten along with the import branch, got %v", result.Target.Name)
+	}
+	destinations := []services.Destination{&services.BareRepository{RemoteName: "origin", Path: remote}}
+	if err := services.ForcePublishAll(a.repo, destinations, result.Branches()); err != nil {
+		t.Fatalf("Failed to publish the rewritten branches: %v", err)
+	}
+
+	// The next run merges the rewritten import branch into main again.
+	a.importCommits(t, pushCommit("aaaa0003", 13))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	for _, branch := range []string{"imports", "main"} {
+		if subjects := remoteBranchSubjects(t, remote, branch); strings.Contains(subjects, "aaaa0001") {
+			t.Errorf("Expected aaaa0001 to be gone from %v, got %v", branch, subjects)
+		}
+	}
+	repo, _ := git.PlainOpen(remote)
+	main, err := repo.CommitObject(remoteBranch(t, remote, "main"))
+	if err != nil {
+		t.Fatalf("Failed to read main: %v", err)
+	}
+	file, err := main.File("activity/group__api.log")
+	if err != nil {
+		t.Fatalf("Failed to read the activity log: %v", err)
+	}
+	if content, _ := file.Contents(); strings.Contains(content, "aaaa0001") {
+		t.Errorf("Expected the purged line to be gone from the activity log of main, got %q", content)
+	}
+}
@@ -0,0 +1,141 @@
+package services_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func useHTTPCache(t *testing.T, dir string, maxMB string) {
+	t.Helper()
+	t.Setenv("HTTP_CACHE_DIR", dir)
+	t.Setenv("HTTP_CACHE_MAX_MB", maxMB)
+	if err := services.ConfigureHTTPClient(); err != nil {
+		t.Fatalf("ConfigureHTTPClient returned error: %v", err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv("HTTP_CACHE_DIR")
+		services.ConfigureHTTPClient()
+	})
+}
+
+func TestHTTPCacheRevalidates(t *testing.T) {
+	fullResponses, notModified := 0, 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `W/"` + r.Header.Get("PRIVATE-TOKEN") + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses++
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `[{"id":1,"path_with_namespace":"%s/api"}]`, r.Header.Get("PRIVATE-TOKEN"))
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	useHTTPCache(t, dir, "")
+
+	source := &services.GitLabSource{BaseURL: mockServer.URL, Token: "alice", AuthMode: services.AuthPrivateToken}
+	first, err := source.GetUsersProjects(1)
+	if err != nil {
+		t.Fatalf("GetUsersProjects returned error: %v", err)
+	}
+	second, err := source.GetUsersProjects(1)
+	if err != nil {
+		t.Fatalf("GetUsersProjects returned error: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) || len(second) != 1 {
+		t.Errorf("Expected the cached projects %+v, got %+v", first, second)
+	}
+	if fullResponses != 1 || notModified != 1 {
+		t.Errorf("Expected 1 full and 1 not modified response, got %d and %d", fullResponses, notModified)
+	}
+
+	other := &services.GitLabSource{BaseURL: mockServer.URL, Token: "bob", AuthMode: services.AuthPrivateToken}
+	projects, err := other.GetUsersProjects(1)
+	if err != nil {
+		t.Fatalf("GetUsersProjects returned error: %v", err)
+	}
+	if projects[0].Path != "bob/api" {
+		t.Errorf("Expected a separate cache entry per token, got %+v", projects)
+	}
+
+	removed, err := services.ClearHTTPCache(dir)
+	if err != nil || removed != 2 {
+		t.Errorf("Expected 2 removed responses, got %d (%v)", removed, err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected an empty cache directory, got %d files", len(files))
+	}
+}
+
+func TestHTTPCacheRefetchesMissingBody(t *testing.T) {
+	dir := t.TempDir()
+	fullResponses, notModified := 0, 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			// The cached body disappears while the request is in flight.
+			bodies, _ := filepath.Glob(filepath.Join(dir, "*.body"))
+			for _, body := range bodies {
+				os.Remove(body)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `[{"id":1,"path_with_namespace":"group/api"}]`)
+	}))
+	defer mockServer.Close()
+
+	useHTTPCache(t, dir, "")
+
+	source := &services.GitLabSource{BaseURL: mockServer.URL, Token: "alice", AuthMode: services.AuthPrivateToken}
+	if _, err := source.GetUsersProjects(1); err != nil {
+		t.Fatalf("GetUsersProjects returned error: %v", err)
+	}
+	projects, err := source.GetUsersProjects(1)
+	if err != nil {
+		t.Fatalf("GetUsersProjects returned error: %v", err)
+	}
+	if len(projects) != 1 || projects[0].Path != "group/api" {
+		t.Errorf("Expected the projects to be fetched again, got %+v", projects)
+	}
+	if fullResponses != 2 || notModified != 1 {
+		t.Errorf("Expected 2 full and 1 not modified response, got %d and %d", fullResponses, notModified)
+	}
+}
+
+func TestHTTPCacheEviction(t *testing.T) {
+	page := strings.Repeat("x", 400<<10)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		fmt.Fprintf(w, `{"username":"%s"}`, page)
+	}))
+	defer mockServer.Close()
+
+	dir := t.TempDir()
+	useHTTPCache(t, dir, "1")
+
+	for i := 0; i < 5; i++ {
+		source := &services.GitLabSource{BaseURL: fmt.Sprintf("%v/%d", mockServer.URL, i), Token: "token", AuthMode: services.AuthPrivateToken}
+		if _, err := source.GetUser(); err != nil {
+			t.Fatalf("GetUser returned error: %v", err)
+		}
+	}
+
+	bodies, _ := filepath.Glob(filepath.Join(dir, "*.body"))
+	if len(bodies) != 2 {
+		t.Errorf("Expected the cache to be trimmed to 2 responses, got %d", len(bodies))
+	}
+}
@@ -0,0 +1,79 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestWriteSyntheticChange(t *testing.T) {
+	fixedTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	commits := []internal.Commit{
+		{ID: "aaaaaaaaaaaa", AuthoredDate: fixedTime, Stats: internal.CommitStats{Additions: 5}},
+		{ID: "bbbbbbbbbbbb", AuthoredDate: fixedTime, Stats: internal.CommitStats{Additions: 2, Deletions: 3}},
+		{ID: "cccccccccccc", AuthoredDate: fixedTime},
+	}
+
+	tests := []struct {
+		name            string
+		mode            string
+		expectedPath    string
+		expectedContent string
+	}{
+		{
+			name:         "log mode follows commit stats",
+			mode:         services.ContentLog,
+			expectedPath: filepath.Join("activity", "group__project.log"),
+			expectedContent: strings.Join([]string{
+				"2024-01-01 aaaaaaaa 4",
+				"2024-01-01 aaaaaaaa 5",
+				"2024-01-01 bbbbbbbb 1",
+				"2024-01-01 bbbbbbbb 2",
+				"2024-01-01 cccccccc 1",
+			}, "\n") + "\n",
+		},
+		{
+			name:            "counter mode",
+			mode:            services.ContentCounter,
+			expectedPath:    filepath.Join("activity", "counter.txt"),
+			expectedContent: "3\n",
+		},
+		{
+			name: "disabled",
+			mode: services.ContentNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoPath := t.TempDir()
+
+			for _, commit := range commits {
+				path, err := services.WriteSyntheticChange(repoPath, tt.mode, "group/project", commit)
+				if err != nil {
+					t.Fatalf("WriteSyntheticChange returned error: %v", err)
+				}
+				if path != tt.expectedPath {
+					t.Fatalf("Expected path '%s', got '%s'", tt.expectedPath, path)
+				}
+			}
+
+			if tt.expectedPath == "" {
+				return
+			}
+
+			content, err := os.ReadFile(filepath.Join(repoPath, tt.expectedPath))
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", tt.expectedPath, err)
+			}
+			if string(content) != tt.expectedContent {
+				t.Errorf("Expected content %q, got %q", tt.expectedContent, string(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package services_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestResolveSecret(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		value       string
+		file        string
+		command     string
+		expected    string
+		expectError bool
+	}{
+		{name: "literal value wins", value: "env-token", file: tokenFile, expected: "env-token"},
+		{name: "token file", file: tokenFile, expected: "file-token"},
+		{name: "token command", command: "printf 'cmd-token\\nlogin: me\\n'", expected: "cmd-token"},
+		{name: "failing command", command: "exit 3", expectError: true},
+		{name: "missing file", file: filepath.Join(t.TempDir(), "missing"), expectError: true},
+		{name: "nothing configured", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := services.ResolveSecret(tt.value, tt.file, tt.command)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResolveSecret returned error: %v", err)
+			}
+			if secret != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, secret)
+			}
+		})
+	}
+}
+
+func TestTokenCommandRunsOnce(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "cmd-token" {
+			t.Errorf("Expected the command token, got '%s'", r.Header.Get("PRIVATE-TOKEN"))
+		}
+		fmt.Fprint(w, `{"username":"testuser","id":1}`)
+	}))
+	defer mockServer.Close()
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	t.Setenv("BASE_URL", mockServer.URL)
+	t.Setenv("GITLAB_TOKEN", "")
+	t.Setenv("GITLAB_TOKEN_COMMAND", fmt.Sprintf("echo run >> %s; echo cmd-token", runs))
+
+	for i := 0; i < 3; i++ {
+		if _, err := services.GetGitlabUser(); err != nil {
+			t.Fatalf("GetGitlabUser returned error: %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(runs); string(data) != "run\n" {
+		t.Errorf("Expected the token command to run once, got %q", data)
+	}
+}
+
+func TestGitLabAuthModes(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		expectedKey   string
+		expectedValue string
+	}{
+		{
+			name:          "private token",
+			env:           map[string]string{"GITLAB_TOKEN": "pat"},
+			expectedKey:   "PRIVATE-TOKEN",
+			expectedValue: "pat",
+		},
+		{
+			name:          "oauth bearer token",
+			env:           map[string]string{"GITLAB_AUTH": "oauth", "GITLAB_TOKEN": "bearer"},
+			expectedKey:   "Authorization",
+			expectedValue: "Bearer bearer",
+		},
+		{
+			name:          "ci job token",
+			env:           map[string]string{"GITLAB_AUTH": "job", "CI_JOB_TOKEN": "job-token"},
+			expectedKey:   "JOB-TOKEN",
+			expectedValue: "job-token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(tt.expectedKey) != tt.expectedValue {
+					t.Errorf("Expected %s '%s', got '%s'", tt.expectedKey, tt.expectedValue, r.Header.Get(tt.expectedKey))
+				}
+				fmt.Fprint(w, `{"username":"testuser","id":1}`)
+			}))
+			defer mockServer.Close()
+
+			t.Setenv("BASE_URL", mockServer.URL)
+			t.Setenv("GITLAB_TOKEN", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			if _, err := services.GetGitlabUser(); err != nil {
+				t.Fatalf("GetGitlabUser returned error: %v", err)
+			}
+		})
+	}
+}
+
+func TestOAuthTokenRefresh(t *testing.T) {
+	refreshes := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("Failed to parse form: %v", err)
+			}
+			if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "old-refresh" || r.Form.Get("client_id") != "client" {
+				t.Errorf("Unexpected token request: %v", r.Form)
+			}
+			refreshes++
+			fmt.Fprintf(w, `{"access_token":"new-access","refresh_token":"new-refresh","expires_in":7200,"created_at":%d}`, time.Now().Unix())
+		case "/api/v4/user":
+			if r.Header.Get("Authorization") != "Bearer new-access" {
+				t.Errorf("Expected refreshed bearer token, got '%s'", r.Header.Get("Authorization"))
+			}
+			fmt.Fprint(w, `{"username":"testuser","id":1}`)
+		default:
+			t.Errorf("Unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer mockServer.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "oauth-token.json")
+	expired, _ := json.Marshal(services.OAuthToken{
+		AccessToken:  "old-access",
+		RefreshToken: "old-refresh",
+		ExpiresAt:    time.Now().Add(-time.Hour),
+	})
+	if err := os.WriteFile(tokenFile, expired, 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	t.Setenv("BASE_URL", mockServer.URL)
+	t.Setenv("GITLAB_TOKEN", "")
+	t.Setenv("GITLAB_AUTH", "oauth")
+	t.Setenv("GITLAB_OAUTH_CLIENT_ID", "client")
+	t.Setenv("GITLAB_OAUTH_TOKEN_FILE", tokenFile)
+
+	for i := 0; i < 2; i++ {
+		if _, err := services.GetGitlabUser(); err != nil {
+			t.Fatalf("GetGitlabUser returned error: %v", err)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("Expected a single refresh, got %d", refreshes)
+	}
+
+	var stored services.OAuthToken
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		t.Fatalf("Failed to read token file: %v", err)
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatalf("Failed to parse token file: %v", err)
+	}
+	if stored.AccessToken != "new-access" || stored.RefreshToken != "new-refresh" {
+		t.Errorf("Expected rotated tokens to be stored, got %+v", stored)
+	}
+}
@@ -0,0 +1,95 @@
+package services_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestDatePolicy(t *testing.T) {
+	var commit internal.Commit
+	_, err := services.DecodeCommits(strings.NewReader(`[{
+		"id": "abc",
+		"authored_date": "2024-03-01T23:30:00.000+09:00",
+		"committed_date": "2024-03-02T10:15:00.000+01:00"
+	}]`), func(c internal.Commit) error {
+		commit = c
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DecodeCommits returned error: %v", err)
+	}
+
+	tests := []struct {
+		name              string
+		source            string
+		timezone          string
+		expectedDate      string
+		expectedCommitter string
+		expectError       bool
+	}{
+		{
+			name:              "defaults keep the authored date and its offset",
+			expectedDate:      "2024-03-01T23:30:00+09:00",
+			expectedCommitter: "2024-03-01T23:30:00+09:00",
+		},
+		{
+			name:              "committed date",
+			source:            "committed",
+			expectedDate:      "2024-03-02T10:15:00+01:00",
+			expectedCommitter: "2024-03-02T10:15:00+01:00",
+		},
+		{
+			name:              "committer in UTC",
+			timezone:          "UTC",
+			expectedDate:      "2024-03-01T23:30:00+09:00",
+			expectedCommitter: "2024-03-01T14:30:00Z",
+		},
+		{
+			name:              "committer in an IANA timezone",
+			source:            "committed",
+			timezone:          "America/New_York",
+			expectedDate:      "2024-03-02T10:15:00+01:00",
+			expectedCommitter: "2024-03-02T04:15:00-05:00",
+		},
+		{name: "unknown date", source: "pushed", expectError: true},
+		{name: "unknown timezone", timezone: "Mars/Olympus", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := services.NewDatePolicy(tt.source, tt.timezone)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewDatePolicy returned error: %v", err)
+			}
+
+			if date := policy.Date(commit).Format(time.RFC3339); date != tt.expectedDate {
+				t.Errorf("Expected date %s, got %s", tt.expectedDate, date)
+			}
+			if date := policy.CommitterDate(commit).Format(time.RFC3339); date != tt.expectedCommitter {
+				t.Errorf("Expected committer date %s, got %s", tt.expectedCommitter, date)
+			}
+		})
+	}
+}
+
+func TestDatePolicyFallsBackToAuthoredDate(t *testing.T) {
+	authored := time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("", 2*3600))
+	policy, err := services.NewDatePolicy("committed", "original")
+	if err != nil {
+		t.Fatalf("NewDatePolicy returned error: %v", err)
+	}
+
+	if date := policy.Date(internal.Commit{AuthoredDate: authored}); !date.Equal(authored) {
+		t.Errorf("Expected the authored date %v, got %v", authored, date)
+	}
+}
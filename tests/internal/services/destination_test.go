@@ -0,0 +1,301 @@
+package services_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestRepo(t *testing.T, messages ...string) (*git.Repository, string) {
+	t.Helper()
+
+	path := t.TempDir()
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(path, "readme.md"), []byte("Just a readme."), 0o644); err != nil {
+		t.Fatalf("Failed to write readme: %v", err)
+	}
+
+	workTree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Failed to get worktree: %v", err)
+	}
+	if _, err := workTree.Add("readme.md"); err != nil {
+		t.Fatalf("Failed to stage readme: %v", err)
+	}
+
+	when := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, message := range messages {
+		signature := &object.Signature{Name: "Test User", Email: "test@example.com", When: when.AddDate(0, 0, i)}
+		if _, err := workTree.Commit(message, &git.CommitOptions{Author: signature, Committer: signature, AllowEmptyCommits: true}); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+
+	return repo, path
+}
+
+func TestCheckEnvVariables(t *testing.T) {
+	tests := []struct {
+		name         string
+		originURL    string
+		destinations string
+		giteaToken   string
+		expectError  bool
+	}{
+		{name: "ssh origin does not need a token", originURL: "git@github.com:user/repo.git"},
+		{name: "https origin needs a token", originURL: "https://github.com/user/repo.git", destinations: "bare:/srv/activity.git,dir:/srv/export", expectError: true},
+		{name: "local destinations do not need a token", originURL: "git@github.com:user/repo.git", destinations: "bare:/srv/activity.git,dir:/srv/export"},
+		{
+			name:         "destination with its own token",
+			originURL:    "git@github.com:user/repo.git",
+			destinations: "gitea=https://gitea.example.com/user/activity.git,bare:/srv/activity.git",
+			giteaToken:   "giteatoken123",
+		},
+		{
+			name:         "https destination without a token",
+			originURL:    "git@github.com:user/repo.git",
+			destinations: "git@github.com:user/repo.git,https://gitea.example.com/user/activity.git",
+			expectError:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENV", "")
+			t.Setenv("BASE_URL", "http://test-url.com")
+			t.Setenv("GITLAB_TOKEN", "token123")
+			t.Setenv("COMMITER_NAME", "Test User")
+			t.Setenv("COMMITER_EMAIL", "test@example.com")
+			t.Setenv("ORIGIN_REPO_URL", tt.originURL)
+			t.Setenv("ORIGIN_TOKEN", "")
+			t.Setenv("DESTINATIONS", tt.destinations)
+			t.Setenv("DESTINATION_GITEA_TOKEN", tt.giteaToken)
+
+			err := services.CheckEnvVariables()
+			if tt.expectError && (err == nil || !strings.Contains(err.Error(), "ORIGIN_TOKEN")) {
+				t.Errorf("Expected ORIGIN_TOKEN to be required, got %v", err)
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseDestinations(t *testing.T) {
+	origin := "https://github.com/user/activity.git"
+
+	tests := []struct {
+		name          string
+		spec          string
+		expectedNames []string
+		expectedTypes []string
+		expectError   bool
+	}{
+		{
+			name:          "defaults to origin",
+			spec:          "",
+			expectedNames: []string{"origin"},
+			expectedTypes: []string{"*services.HTTPSRemote"},
+		},
+		{
+			name:          "several destinations",
+			spec:          origin + ",gitea=git@gitea.example.com:user/activity.git,bare:/tmp/activity.git,dir:/tmp/export",
+			expectedNames: []string{"origin", "gitea", "destination-3", "dir:/tmp/export"},
+			expectedTypes: []string{"*services.HTTPSRemote", "*services.SSHRemote", "*services.BareRepository", "*services.DirectoryExport"},
+		},
+		{
+			name:        "duplicate names",
+			spec:        "a=https://one.example.com/x.git,a=https://two.example.com/x.git",
+			expectError: true,
+		},
+		{
+			name:        "unsupported protocol",
+			spec:        "git://example.com/x.git",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destinations, err := services.ParseDestinations(tt.spec, origin)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseDestinations returned error: %v", err)
+			}
+
+			var names, types []string
+			for _, destination := range destinations {
+				names = append(names, destination.Name())
+				types = append(types, reflect.TypeOf(destination).String())
+			}
+			if !reflect.DeepEqual(names, tt.expectedNames) {
+				t.Errorf("Expected names %v, got %v", tt.expectedNames, names)
+			}
+			if !reflect.DeepEqual(types, tt.expectedTypes) {
+				t.Errorf("Expected types %v, got %v", tt.expectedTypes, types)
+			}
+		})
+	}
+}
+
+func TestDestinationCredentials(t *testing.T) {
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("ORIGIN_TOKEN", "github-token")
+	t.Setenv("DESTINATION_GITEA_TOKEN", "gitea-token")
+	t.Setenv("DESTINATION_GITEA_USERNAME", "gitea-user")
+	t.Setenv("DESTINATION_SELF_HOSTED_TOKEN", "self-hosted-token")
+
+	origin := "https://github.com/user/activity.git"
+	spec := origin + ",gitea=https://gitea.example.com/user/activity.git,self-hosted=https://git.example.com/user/activity.git"
+	destinations, err := services.ParseDestinations(spec, origin)
+	if err != nil {
+		t.Fatalf("ParseDestinations returned error: %v", err)
+	}
+
+	expected := []services.HTTPSRemote{
+		{RemoteName: "origin", URL: origin, Username: "Test User", Token: "github-token"},
+		{RemoteName: "gitea", URL: "https://gitea.example.com/user/activity.git", Username: "gitea-user", Token: "gitea-token"},
+		{RemoteName: "self-hosted", URL: "https://git.example.com/user/activity.git", Username: "Test User", Token: "self-hosted-token"},
+	}
+	for i, destination := range destinations {
+		remote, ok := destination.(*services.HTTPSRemote)
+		if !ok || *remote != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], destination)
+		}
+	}
+}
+
+func TestPublishLocalDestinations(t *testing.T) {
+	repo, _ := newTestRepo(t, "first", "second")
+	barePath := filepath.Join(t.TempDir(), "mirror.git")
+	exportPath := filepath.Join(t.TempDir(), "export")
+
+	destinations := []services.Destination{
+		&services.BareRepository{RemoteName: "backup", Path: barePath},
+		&services.DirectoryExport{Path: exportPath},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := services.PublishAll(repo, destinations); err != nil {
+			t.Fatalf("PublishAll returned error: %v", err)
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read HEAD: %v", err)
+	}
+
+	bare, err := git.PlainOpen(barePath)
+	if err != nil {
+		t.Fatalf("Failed to open bare repository: %v", err)
+	}
+	ref, err := bare.Reference(head.Name(), true)
+	if err != nil {
+		t.Fatalf("Failed to read pushed branch: %v", err)
+	}
+	if ref.Hash() != head.Hash() {
+		t.Errorf("Expected bare repository at %s, got %s", head.Hash(), ref.Hash())
+	}
+
+	readme, err := os.ReadFile(filepath.Join(exportPath, "readme.md"))
+	if err != nil || string(readme) != "Just a readme." {
+		t.Errorf("Expected exported readme, got %q (%v)", readme, err)
+	}
+
+	history, err := os.ReadFile(filepath.Join(exportPath, "history.log"))
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(history)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "second") || !strings.HasSuffix(lines[1], "first") {
+		t.Errorf("Unexpected history: %q", history)
+	}
+}
+
+func TestRemoteAuth(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(privateKey, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHostsPath, nil, 0o600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	t.Setenv("SSH_KEY_PATH", keyPath)
+	t.Setenv("SSH_KNOWN_HOSTS", knownHostsPath)
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("ORIGIN_TOKEN", "origintoken123")
+
+	t.Run("ssh key with passphrase", func(t *testing.T) {
+		t.Setenv("SSH_KEY_PASSPHRASE", "secret")
+
+		auth, err := services.RemoteAuth("deploy@github.com:user/repo.git")
+		if err != nil {
+			t.Fatalf("RemoteAuth returned error: %v", err)
+		}
+		keys, ok := auth.(*gitssh.PublicKeys)
+		if !ok {
+			t.Fatalf("Expected *ssh.PublicKeys, got %T", auth)
+		}
+		if keys.User != "deploy" {
+			t.Errorf("Expected user 'deploy', got '%s'", keys.User)
+		}
+		if keys.HostKeyCallback == nil {
+			t.Errorf("Expected known_hosts verification to be configured")
+		}
+	})
+
+	t.Run("ssh key with wrong passphrase", func(t *testing.T) {
+		t.Setenv("SSH_KEY_PASSPHRASE", "wrong")
+
+		if _, err := services.RemoteAuth("ssh://git@github.com/user/repo.git"); err == nil {
+			t.Errorf("Expected an error but got none")
+		}
+	})
+
+	t.Run("https basic auth", func(t *testing.T) {
+		auth, err := services.RemoteAuth("https://github.com/user/repo.git")
+		if err != nil {
+			t.Fatalf("RemoteAuth returned error: %v", err)
+		}
+		basic, ok := auth.(*http.BasicAuth)
+		if !ok || basic.Username != "Test User" || basic.Password != "origintoken123" {
+			t.Errorf("Unexpected auth: %#v", auth)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package services_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+)
+
+func TestRunDoctor(t *testing.T) {
+	expiresAt := time.Now().AddDate(0, 0, 3).Format("2006-01-02")
+
+	tests := []struct {
+		name     string
+		scopes   string
+		email    string
+		expected map[string]string
+	}{
+		{
+			name:   "healthy configuration",
+			scopes: `["read_api","read_user"]`,
+			email:  "test@example.com",
+			expected: map[string]string{
+				"GitLab gitlab: authentication":    services.CheckPass,
+				"GitLab gitlab: token scopes":      services.CheckPass,
+				"GitLab gitlab: token expiry":      services.CheckWarn,
+				"Destination backup: ls-remote":    services.CheckPass,
+				"Destination backup: push":         services.CheckPass,
+				"Destination export: write access": services.CheckPass,
+				"Committer email attribution":      services.CheckPass,
+			},
+		},
+		{
+			name:   "missing scope and unknown email",
+			scopes: `["read_user"]`,
+			email:  "someone@else.com",
+			expected: map[string]string{
+				"GitLab gitlab: token scopes": services.CheckFail,
+				"Committer email attribution": services.CheckFail,
+			},
+		},
+		{
+			name:   "noreply email",
+			scopes: `["api"]`,
+			email:  "42+testuser@users.noreply.github.com",
+			expected: map[string]string{
+				"Committer email attribution": services.CheckPass,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/v4/user":
+					fmt.Fprint(w, `{"username":"testuser","id":1}`)
+				case "/api/v4/personal_access_tokens/self":
+					fmt.Fprintf(w, `{"id":1,"name":"importer","scopes":%s,"active":true,"expires_at":"%s"}`, tt.scopes, expiresAt)
+				case "/github/user":
+					if r.Header.Get("Authorization") != "Bearer destination-token" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					fmt.Fprint(w, `{"login":"testuser","id":42}`)
+				case "/github/user/emails":
+					fmt.Fprint(w, `[{"email":"test@example.com","verified":true,"primary":true}]`)
+				default:
+					if strings.HasPrefix(r.URL.Path, "/github/me/") {
+						http.NotFound(w, r)
+						return
+					}
+					t.Errorf("Unexpected request %s", r.URL.Path)
+				}
+			}))
+			defer mockServer.Close()
+
+			t.Setenv("GITHUB_API_URL", mockServer.URL+"/github")
+			t.Setenv("ORIGIN_TOKEN", "origin-token")
+			t.Setenv("COMMITER_EMAIL", tt.email)
+
+			barePath := filepath.Join(t.TempDir(), "backup.git")
+			bare, err := git.PlainInit(barePath, true)
+			if err != nil {
+				t.Fatalf("Failed to init bare repository: %v", err)
+			}
+
+			sources := []services.Source{&services.GitLabSource{BaseURL: mockServer.URL, Token: "pat", AuthMode: services.AuthPrivateToken}}
+			destinations := []services.Destination{
+				&services.BareRepository{RemoteName: "backup", Path: barePath},
+				&services.DirectoryExport{Path: filepath.Join(t.TempDir(), "export")},
+				&services.HTTPSRemote{RemoteName: "github", URL: mockServer.URL + "/github/me/activity.git", Token: "destination-token"},
+			}
+
+			results := services.RunDoctor(sources, destinations)
+			statuses := map[string]string{}
+			for _, result := range results {
+				name := strings.Replace(result.Name, destinations[1].Name(), "export", 1)
+				statuses[name] = result.Status
+			}
+			for name, status := range tt.expected {
+				if statuses[name] != status {
+					t.Errorf("Expected %s to be %s, got %s", name, status, statuses[name])
+				}
+			}
+
+			if _, err := bare.Reference("refs/heads/gitlab-activity-importer-preflight", false); err == nil {
+				t.Errorf("Expected the preflight branch to be deleted")
+			}
+		})
+	}
+}
+
+func TestRunDoctorSkipsMissingBareRepository(t *testing.T) {
+	t.Setenv("GITHUB_API_URL", "")
+	destinations := []services.Destination{&services.BareRepository{RemoteName: "backup", Path: filepath.Join(t.TempDir(), "backup.git")}}
+
+	results := services.RunDoctor(nil, destinations)
+	if len(results) != 1 || results[0].Name != "Destination backup: access" || results[0].Status != services.CheckSkip {
+		t.Errorf("Expected the missing bare repository to be skipped, got %+v", results)
+	}
+}
+
+func TestPrintChecklist(t *testing.T) {
+	var out bytes.Buffer
+	ok := services.PrintChecklist(&out, []services.CheckResult{
+		{Name: "first", Status: services.CheckPass, Detail: "fine"},
+		{Name: "second", Status: services.CheckFail, Detail: "broken"},
+	})
+	if ok {
+		t.Errorf("Expected a failing checklist")
+	}
+	if !strings.Contains(out.String(), "[PASS] first: fine") || !strings.Contains(out.String(), "[FAIL] second: broken") {
+		t.Errorf("Unexpected checklist output: %s", out.String())
+	}
+}
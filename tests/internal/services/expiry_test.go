@@ -0,0 +1,81 @@
+package services_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestCheckTokenExpiry(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		expectExpired bool
+	}{
+		{name: "no expiry date", status: http.StatusOK, body: `{"scopes":["read_api"],"expires_at":null}`},
+		{name: "expires later", status: http.StatusOK, body: `{"scopes":["read_api"],"expires_at":"2024-08-01"}`},
+		{name: "expires within the window", status: http.StatusOK, body: `{"scopes":["read_api"],"expires_at":"2024-05-12"}`},
+		{name: "expired date", status: http.StatusOK, body: `{"scopes":["read_api"],"expires_at":"2024-05-10"}`, expectExpired: true},
+		{
+			name:          "rejected as expired",
+			status:        http.StatusUnauthorized,
+			body:          `{"error":"invalid_token","error_description":"Token has expired.","scope":"api"}`,
+			expectExpired: true,
+		},
+		{name: "endpoint not available", status: http.StatusNotFound, body: `{"message":"404 Not Found"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v4/personal_access_tokens/self" {
+					t.Errorf("Unexpected request %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer mockServer.Close()
+
+			source := &services.GitLabSource{BaseURL: mockServer.URL, Token: "pat", AuthMode: services.AuthPrivateToken}
+			err := source.CheckTokenExpiry(7*24*time.Hour, now)
+
+			var expired *services.TokenExpiredError
+			if tt.expectExpired {
+				if !errors.As(err, &expired) {
+					t.Fatalf("Expected a TokenExpiredError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTokenExpiryWindow(t *testing.T) {
+	t.Setenv("TOKEN_EXPIRY_WARN_DAYS", "")
+	window, err := services.TokenExpiryWindow()
+	if err != nil || window != 7*24*time.Hour {
+		t.Errorf("Expected a default window of 7 days, got %v (%v)", window, err)
+	}
+
+	t.Setenv("TOKEN_EXPIRY_WARN_DAYS", "30")
+	window, err = services.TokenExpiryWindow()
+	if err != nil || window != 30*24*time.Hour {
+		t.Errorf("Expected a window of 30 days, got %v (%v)", window, err)
+	}
+
+	t.Setenv("TOKEN_EXPIRY_WARN_DAYS", "soon")
+	if _, err := services.TokenExpiryWindow(); err == nil {
+		t.Errorf("Expected an error for an invalid window")
+	}
+}
@@ -0,0 +1,96 @@
+package services_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestProvenance(t *testing.T) {
+	commit := internal.Commit{
+		ID:           "0123456789abcdef0123456789abcdef01234567",
+		Instance:     "work",
+		ProjectID:    42,
+		ProjectPath:  "client/portal",
+		AuthoredDate: time.Date(2024, 3, 5, 23, 30, 0, 0, time.FixedZone("", 2*3600)),
+	}
+
+	tests := []struct {
+		name            string
+		redact          []string
+		expectedPath    string
+		expectedID      string
+		expectedMessage string
+	}{
+		{
+			name:         "plain",
+			expectedPath: "client/portal",
+			expectedID:   "42",
+			expectedMessage: "0123456789abcdef0123456789abcdef01234567\n\n" +
+				"Source-SHA: 0123456789abcdef0123456789abcdef01234567\n" +
+				"Source-Instance: work\n" +
+				"Source-Project: client/portal\n" +
+				"Source-Project-ID: 42\n" +
+				"Source-Date: 2024-03-05T23:30:00+02:00\n" +
+				"Importer-Version: dev",
+		},
+		{name: "hashed project", redact: []string{services.RedactHashProject}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := services.NewMessageBuilder("", tt.redact, "salt")
+			if err != nil {
+				t.Fatalf("NewMessageBuilder returned error: %v", err)
+			}
+			message, err := builder.Build(commit)
+			if err != nil {
+				t.Fatalf("Build returned error: %v", err)
+			}
+			if tt.expectedMessage != "" && message != tt.expectedMessage {
+				t.Errorf("Expected message %q, got %q", tt.expectedMessage, message)
+			}
+			if tt.expectedPath == "" && (strings.Contains(message, "client") || strings.Contains(message, ": 42")) {
+				t.Errorf("Expected the project to be hashed, got %q", message)
+			}
+
+			provenance := services.ParseProvenance(message)
+			if provenance.Key() != commit.Key() || !provenance.AuthoredDate.Equal(commit.AuthoredDate) {
+				t.Errorf("Unexpected provenance %+v", provenance)
+			}
+			expected := builder.Provenance(commit)
+			provenance.AuthoredDate, expected.AuthoredDate = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(provenance, expected) {
+				t.Errorf("Expected the provenance to round trip, got %+v", provenance)
+			}
+			if tt.expectedPath != "" && (provenance.ProjectPath != tt.expectedPath || provenance.ProjectID != tt.expectedID) {
+				t.Errorf("Expected project %v (%v), got %v (%v)", tt.expectedPath, tt.expectedID, provenance.ProjectPath, provenance.ProjectID)
+			}
+		})
+	}
+
+	if legacy := services.ParseProvenance(commit.ID); legacy.SHA != commit.ID || legacy.Instance != "" {
+		t.Errorf("Expected a bare SHA message to be parsed, got %+v", legacy)
+	}
+}
+
+func TestImporterAcrossBatches(t *testing.T) {
+	repo, _ := newPurgeMirror(t, "log")
+	fixture := purgeFixture()
+
+	importer := services.NewImporter(repo)
+	extra := pushCommit("cccc0001", 14)
+	if created := importer.Import([]internal.Commit{fixture[0], extra, extra}); created != 1 {
+		t.Errorf("Expected 1 new commit in the first batch, got %d", created)
+	}
+	if created := importer.Import([]internal.Commit{extra, pushCommit("cccc0002", 15)}); created != 1 {
+		t.Errorf("Expected the second batch to skip the commit of the first, got %d", created)
+	}
+	if messages := headMessages(t, repo); len(messages) != 6 {
+		t.Errorf("Expected 6 mirror commits, got %d", len(messages))
+	}
+}
@@ -0,0 +1,154 @@
+package services_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func giteaCommitsPage(start int, count int, email string) string {
+	var commits []string
+	for i := start; i < start+count; i++ {
+		commits = append(commits, fmt.Sprintf(`{"sha":"%040d","commit":{"message":"commit %d","author":{"name":"John Doe","email":"%s","date":"2024-01-01T23:30:00+02:00"}},"stats":{"additions":3,"deletions":1,"total":4}}`, i, i, email))
+	}
+	return "[" + strings.Join(commits, ",") + "]"
+}
+
+func TestGiteaSourceListProjects(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/user/repos" {
+			t.Errorf("Expected path /api/v1/user/repos, got %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "token test-token" {
+			t.Errorf("Expected Authorization 'token test-token', got '%s'", r.Header.Get("Authorization"))
+		}
+		if r.URL.Query().Get("page") != "1" {
+			t.Errorf("Expected a single page, got page %s", r.URL.Query().Get("page"))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[
+			{"id":1,"full_name":"john/api","html_url":"https://gitea.example.com/john/api","empty":false},
+			{"id":2,"full_name":"john/empty","html_url":"https://gitea.example.com/john/empty","empty":true}
+		]`)
+	}))
+	defer mockServer.Close()
+
+	source := &services.GiteaSource{BaseURL: mockServer.URL, Token: "test-token"}
+	projects, err := source.ListProjects()
+	if err != nil {
+		t.Fatalf("ListProjects returned error: %v", err)
+	}
+
+	expected := []internal.Project{{ID: 1, Path: "john/api", URL: "https://gitea.example.com/john/api"}}
+	if !reflect.DeepEqual(projects, expected) {
+		t.Errorf("Expected '%v', got '%v'", expected, projects)
+	}
+}
+
+func TestGiteaSourceListCommits(t *testing.T) {
+	tests := []struct {
+		name          string
+		pages         []string
+		statusCode    int
+		expectedCount int
+		expectError   bool
+	}{
+		{
+			name:          "pagination until a short page",
+			pages:         []string{giteaCommitsPage(0, 50, "john@doe.com"), giteaCommitsPage(50, 10, "john@doe.com")},
+			statusCode:    200,
+			expectedCount: 60,
+		},
+		{
+			name:          "other authors are skipped",
+			pages:         []string{giteaCommitsPage(0, 5, "jane@roe.com")},
+			statusCode:    200,
+			expectedCount: 0,
+		},
+		{
+			name:        "unauthorized request",
+			pages:       []string{`{"message":"token is required"}`},
+			statusCode:  401,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestCount := 0
+
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v1/repos/john/api/commits" {
+					t.Errorf("Expected path /api/v1/repos/john/api/commits, got %s", r.URL.Path)
+				}
+				if r.URL.Query().Get("page") != fmt.Sprint(requestCount+1) {
+					t.Errorf("Expected page %d, got %s", requestCount+1, r.URL.Query().Get("page"))
+				}
+				if requestCount >= len(tt.pages) {
+					t.Fatalf("More requests than expected pages")
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.statusCode)
+				fmt.Fprint(w, tt.pages[requestCount])
+				requestCount++
+			}))
+			defer mockServer.Close()
+
+			source := &services.GiteaSource{BaseURL: mockServer.URL, Token: "test-token", Identities: []string{"john@doe.com"}}
+			commits := make(chan internal.Commit, 100)
+			err := source.ListCommits(internal.Project{ID: 1, Path: "john/api"}, commits)
+			close(commits)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListCommits returned error: %v", err)
+			}
+
+			count := 0
+			for commit := range commits {
+				count++
+				if _, offset := commit.AuthoredDate.Zone(); offset != 2*60*60 {
+					t.Errorf("Expected +02:00 offset, got %v", commit.AuthoredDate)
+				}
+				if commit.Stats.Additions != 3 || commit.Stats.Deletions != 1 {
+					t.Errorf("Unexpected stats: %+v", commit.Stats)
+				}
+			}
+			if count != tt.expectedCount {
+				t.Errorf("Expected %d commits, got %d", tt.expectedCount, count)
+			}
+			if requestCount != len(tt.pages) {
+				t.Errorf("Expected %d requests, got %d", len(tt.pages), requestCount)
+			}
+		})
+	}
+}
+
+func TestGiteaSourceEscapesRepositoryPath(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/v1/repos/john/api%3Fv2/commits" {
+			t.Errorf("Expected the repository name to be escaped, got %s", r.URL.EscapedPath())
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer mockServer.Close()
+
+	source := &services.GiteaSource{BaseURL: mockServer.URL, Token: "test-token", Identities: []string{"john@doe.com"}}
+	commits := make(chan internal.Commit, 1)
+	if err := source.ListCommits(internal.Project{ID: 1, Path: "john/api?v2"}, commits); err != nil {
+		t.Fatalf("ListCommits returned error: %v", err)
+	}
+}
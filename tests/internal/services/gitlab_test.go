@@ -1,11 +1,14 @@
 package services_test
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -374,3 +377,241 @@ func TestGetProjectsCommits(t *testing.T) {
 		})
 	}
 }
+
+func TestGitLabInstances(t *testing.T) {
+	requests := make(map[string]int)
+
+	newInstance := func(name string, token string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("PRIVATE-TOKEN") != token {
+				t.Errorf("Expected PRIVATE-TOKEN '%s' on %s, got '%s'", token, name, r.Header.Get("PRIVATE-TOKEN"))
+			}
+			requests[name]++
+
+			switch {
+			case r.URL.Path == "/api/v4/user":
+				fmt.Fprint(w, `{"username":"testuser","id":1}`)
+			case r.URL.Path == "/api/v4/users/1/contributed_projects":
+				fmt.Fprint(w, `[{"id":1,"path_with_namespace":"client/api"},{"id":2,"path_with_namespace":"client/secret"},{"id":3,"path_with_namespace":"other/tool"}]`)
+			default:
+				t.Errorf("Unexpected request %s on %s", r.URL.Path, name)
+			}
+		}))
+	}
+
+	work := newInstance("work", "work-token")
+	defer work.Close()
+	client := newInstance("client", "client-token")
+	defer client.Close()
+
+	t.Setenv("CLIENT_GITLAB_TOKEN", "client-token")
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("GITLAB_INSTANCES", fmt.Sprintf(`[
+		{"name":"work","base_url":"%s/","token":"work-token","author":"tuser"},
+		{"name":"client","base_url":"%s","token_env":"CLIENT_GITLAB_TOKEN","include_projects":["client/*"],"exclude_projects":["client/secret"],"since":"2024-01-01"}
+	]`, work.URL, client.URL))
+
+	instances, err := services.GitLabInstancesFromEnv()
+	if err != nil {
+		t.Fatalf("GitLabInstancesFromEnv returned error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("Expected 2 instances, got %d", len(instances))
+	}
+	if instances[0].Name() != "work" || instances[0].Author != "tuser" || instances[0].BaseURL != work.URL {
+		t.Errorf("Unexpected work instance: %+v", instances[0])
+	}
+	if instances[1].Author != "Test User" || !instances[1].Since.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected client instance: %+v", instances[1])
+	}
+
+	expectedPaths := [][]string{
+		{"client/api", "client/secret", "other/tool"},
+		{"client/api"},
+	}
+	for i, instance := range instances {
+		projects, err := instance.ListProjects()
+		if err != nil {
+			t.Fatalf("ListProjects returned error: %v", err)
+		}
+		var paths []string
+		for _, project := range projects {
+			paths = append(paths, project.Path)
+		}
+		if !reflect.DeepEqual(paths, expectedPaths[i]) {
+			t.Errorf("Expected projects %v for %s, got %v", expectedPaths[i], instance.Name(), paths)
+		}
+	}
+
+	if requests["work"] != 2 || requests["client"] != 2 {
+		t.Errorf("Expected 2 requests per instance, got %v", requests)
+	}
+
+	t.Setenv("GITLAB_INSTANCES", `[{"name":"work","base_url":"https://a"},{"name":"other","base_url":"https://b","token":"x"}]`)
+	if _, err := services.GitLabInstancesFromEnv(); err == nil || !strings.Contains(err.Error(), "no token configured for GitLab instance work") {
+		t.Errorf("Expected missing token error, got %v", err)
+	}
+}
+
+func TestGitLabInstanceAuthModes(t *testing.T) {
+	t.Run("job token", func(t *testing.T) {
+		t.Setenv("CI_JOB_TOKEN", "job-token")
+		t.Setenv("GITLAB_INSTANCES", `[
+			{"name":"ci","base_url":"https://ci.example.com","auth":"job","project_ids":[7,8]},
+			{"name":"unscoped","base_url":"https://other.example.com","auth":"job"}
+		]`)
+
+		instances, err := services.GitLabInstancesFromEnv()
+		if err != nil {
+			t.Fatalf("GitLabInstancesFromEnv returned error: %v", err)
+		}
+		if instances[0].Token != "job-token" || !reflect.DeepEqual(instances[0].ProjectIDs, []int{7, 8}) {
+			t.Errorf("Unexpected job instance: %+v", instances[0])
+		}
+		projects, err := instances[0].ListProjects()
+		if err != nil || len(projects) != 2 || projects[0].ID != 7 {
+			t.Errorf("Expected the configured projects, got %v (%v)", projects, err)
+		}
+		if _, err := instances[1].ListProjects(); err == nil {
+			t.Errorf("Expected an error for a job token without project IDs")
+		}
+	})
+
+	t.Run("oauth", func(t *testing.T) {
+		refreshes := 0
+		mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/oauth/token":
+				refreshes++
+				fmt.Fprintf(w, `{"access_token":"new-access","refresh_token":"new-refresh","expires_in":7200,"created_at":%d}`, time.Now().Unix())
+			case "/api/v4/user":
+				if r.Header.Get("Authorization") != "Bearer new-access" {
+					t.Errorf("Expected refreshed bearer token, got '%s'", r.Header.Get("Authorization"))
+				}
+				fmt.Fprint(w, `{"username":"testuser","id":1}`)
+			default:
+				t.Errorf("Unexpected request %s", r.URL.Path)
+			}
+		}))
+		defer mockServer.Close()
+
+		t.Setenv("HOME", t.TempDir())
+		tokenFile := filepath.Join(t.TempDir(), "client-token.json")
+		expired, _ := json.Marshal(services.OAuthToken{AccessToken: "old-access", RefreshToken: "old-refresh", ExpiresAt: time.Now().Add(-time.Hour)})
+		if err := os.WriteFile(tokenFile, expired, 0o600); err != nil {
+			t.Fatalf("Failed to write token file: %v", err)
+		}
+		t.Setenv("GITLAB_INSTANCES", fmt.Sprintf(`[{"name":"client","base_url":"%s","auth":"oauth","oauth_token_file":"%s"}]`, mockServer.URL, tokenFile))
+
+		instances, err := services.GitLabInstancesFromEnv()
+		if err != nil {
+			t.Fatalf("GitLabInstancesFromEnv returned error: %v", err)
+		}
+		if instances[0].OAuth == nil {
+			t.Fatalf("Expected the instance to refresh its OAuth token")
+		}
+		if _, err := instances[0].GetUser(); err != nil {
+			t.Fatalf("GetUser returned error: %v", err)
+		}
+		if refreshes != 1 {
+			t.Errorf("Expected a single refresh, got %d", refreshes)
+		}
+
+		t.Setenv("GITLAB_INSTANCES", `[{"name":"client","base_url":"https://git.client.example","auth":"oauth"}]`)
+		if _, err := services.GitLabInstancesFromEnv(); err == nil || !strings.Contains(err.Error(), "login") {
+			t.Errorf("Expected a login hint without a stored token, got %v", err)
+		}
+		source, err := services.NewInstanceOAuthTokenSource("client")
+		if err != nil || !strings.HasSuffix(source.Path, "oauth-token-client.json") {
+			t.Errorf("Expected a token file per instance, got %v (%v)", source, err)
+		}
+	})
+}
+
+func TestDecodeCommits(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		expectedIDs   []string
+		expectedError bool
+	}{
+		{name: "empty page", body: `[]`},
+		{
+			name:        "commits with stats",
+			body:        `[{"id":"a","title":"first","stats":{"additions":1,"deletions":2,"total":3}},{"id":"b","title":"second"}]`,
+			expectedIDs: []string{"a", "b"},
+		},
+		{name: "not an array", body: `{"message":"oops"}`, expectedError: true},
+		{name: "truncated", body: `[{"id":"a"},{"id":`, expectedIDs: []string{"a"}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []string
+			count, err := services.DecodeCommits(strings.NewReader(tt.body), func(commit internal.Commit) error {
+				ids = append(ids, commit.ID)
+				return nil
+			})
+
+			if tt.expectedError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tt.expectedError, err)
+			}
+			if count != len(tt.expectedIDs) || !reflect.DeepEqual(ids, tt.expectedIDs) {
+				t.Errorf("Expected commits %v, got %v (%d)", tt.expectedIDs, ids, count)
+			}
+		})
+	}
+}
+
+// commitFixture is a single large page of commits, shaped like the GitLab
+// commits API with stats.
+func commitFixture(b *testing.B, size int) []byte {
+	b.Helper()
+
+	commits := make([]internal.Commit, size)
+	for i := range commits {
+		commits[i] = internal.Commit{
+			ID:           fmt.Sprintf("%040x", i),
+			Title:        "Fix the thing",
+			Message:      strings.Repeat("A fairly long commit message body. ", 20),
+			AuthorName:   "John Doe",
+			AuthorMail:   "john@example.com",
+			AuthoredDate: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			Stats:        internal.CommitStats{Additions: 10, Deletions: 2, Total: 12},
+		}
+	}
+
+	data, err := json.Marshal(commits)
+	if err != nil {
+		b.Fatalf("Failed to marshal fixture: %v", err)
+	}
+	return data
+}
+
+func BenchmarkDecodeCommits(b *testing.B) {
+	data := commitFixture(b, 100000)
+
+	b.Run("read all and unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, err := io.ReadAll(bytes.NewReader(data))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var commits []internal.Commit
+			if err := json.Unmarshal(body, &commits); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := services.DecodeCommits(bytes.NewReader(data), func(internal.Commit) error { return nil })
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
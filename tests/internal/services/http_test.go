@@ -0,0 +1,156 @@
+package services_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		name            string
+		statusCode      int
+		body            string
+		headers         map[string]string
+		expectedMessage string
+		expectedRetry   time.Duration
+	}{
+		{
+			name:            "unauthorized",
+			statusCode:      http.StatusUnauthorized,
+			body:            `{"message":"401 Unauthorized"}`,
+			expectedMessage: "401 Unauthorized",
+		},
+		{
+			name:            "forbidden with oauth error",
+			statusCode:      http.StatusForbidden,
+			body:            `{"error":"insufficient_scope","error_description":"The request requires higher privileges than provided by the access token."}`,
+			expectedMessage: "The request requires higher privileges than provided by the access token.",
+		},
+		{
+			name:            "project not found",
+			statusCode:      http.StatusNotFound,
+			body:            `{"message":"404 Project Not Found"}`,
+			expectedMessage: "404 Project Not Found",
+		},
+		{
+			name:       "rate limited",
+			statusCode: http.StatusTooManyRequests,
+			body:       "Retry later",
+			headers: map[string]string{
+				"Retry-After":         "30",
+				"RateLimit-Limit":     "600",
+				"RateLimit-Remaining": "0",
+			},
+			expectedMessage: "Retry later",
+			expectedRetry:   30 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Request-Id", "req-123")
+				for key, value := range tt.headers {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(tt.statusCode)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer mockServer.Close()
+
+			source := &services.GitLabSource{BaseURL: mockServer.URL, Token: "secret-token", Author: "john", AuthMode: services.AuthPrivateToken}
+			_, err := source.GetProjectCommits(42)
+
+			var apiErr *services.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Expected an APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tt.statusCode {
+				t.Errorf("Expected status %d, got %d", tt.statusCode, apiErr.StatusCode)
+			}
+			if apiErr.Method != "GET" || !strings.HasPrefix(apiErr.Path, "/api/v4/projects/42/repository/commits?") {
+				t.Errorf("Unexpected request %s %s", apiErr.Method, apiErr.Path)
+			}
+			if apiErr.Message != tt.expectedMessage {
+				t.Errorf("Expected message '%s', got '%s'", tt.expectedMessage, apiErr.Message)
+			}
+			if apiErr.RequestID != "req-123" {
+				t.Errorf("Expected request id 'req-123', got '%s'", apiErr.RequestID)
+			}
+			if apiErr.RetryAfter != tt.expectedRetry {
+				t.Errorf("Expected retry after %v, got %v", tt.expectedRetry, apiErr.RetryAfter)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("request failed with status code: %d", tt.statusCode)) {
+				t.Errorf("Unexpected error message: %v", err)
+			}
+			if strings.Contains(err.Error(), "secret-token") {
+				t.Errorf("Error leaks the token: %v", err)
+			}
+		})
+	}
+}
+
+func TestPaginationReusesConnections(t *testing.T) {
+	const pages = 50
+
+	var mu sync.Mutex
+	newConnections, open, maxOpen := 0, 0, 0
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page > pages {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		// Trailing whitespace is left unread by the decoder and has to be
+		// drained for the connection to be reused.
+		fmt.Fprintf(w, `[{"id":"%040d","title":"commit"}]%s`, page, strings.Repeat(" ", 64<<10))
+	}))
+	mockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			newConnections++
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	mockServer.Start()
+	defer mockServer.Close()
+
+	source := &services.GitLabSource{BaseURL: mockServer.URL, Token: "test-token", Author: "john"}
+	count := 0
+	err := source.StreamProjectCommits(1, func(internal.Commit) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamProjectCommits returned error: %v", err)
+	}
+
+	if count != pages {
+		t.Errorf("Expected %d commits, got %d", pages, count)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if newConnections != 1 || maxOpen != 1 {
+		t.Errorf("Expected a single reused connection, got %d connections with up to %d open", newConnections, maxOpen)
+	}
+}
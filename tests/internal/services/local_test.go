@@ -0,0 +1,88 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func commitAs(t *testing.T, repo *git.Repository, name string, email string, message string) string {
+	t.Helper()
+
+	workTree, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Failed to get worktree: %v", err)
+	}
+	signature := &object.Signature{Name: name, Email: email, When: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	hash, err := workTree.Commit(message, &git.CommitOptions{Author: signature, Committer: signature, AllowEmptyCommits: true})
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+	return hash.String()
+}
+
+func TestLocalSource(t *testing.T) {
+	root := t.TempDir()
+
+	clientRepo, err := git.PlainInit(filepath.Join(root, "client", "api"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	mine := commitAs(t, clientRepo, "Test User", "test@example.com", "mine")
+	commitAs(t, clientRepo, "Someone Else", "else@example.com", "not mine")
+	alsoMine := commitAs(t, clientRepo, "test user", "work@client.example", "mine with another identity")
+
+	if _, err := git.PlainClone(filepath.Join(root, "api-copy"), false, &git.CloneOptions{URL: filepath.Join(root, "client", "api")}); err != nil {
+		t.Fatalf("Failed to clone repository: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "not-a-repo"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	source := &services.LocalSource{
+		Paths:      []string{root},
+		Identities: []string{"test@example.com", "Test User"},
+	}
+
+	projects, err := source.ListProjects()
+	if err != nil {
+		t.Fatalf("ListProjects returned error: %v", err)
+	}
+
+	var paths []string
+	for _, project := range projects {
+		paths = append(paths, project.Path)
+	}
+	sort.Strings(paths)
+	base := filepath.Base(root)
+	if len(paths) != 2 || paths[0] != base+"/api-copy" || paths[1] != base+"/client/api" {
+		t.Fatalf("Unexpected projects: %v", paths)
+	}
+
+	commits := make(chan internal.Commit, 10)
+	for _, project := range projects {
+		if err := source.ListCommits(project, commits); err != nil {
+			t.Fatalf("ListCommits returned error: %v", err)
+		}
+	}
+	close(commits)
+
+	var ids []string
+	for commit := range commits {
+		ids = append(ids, commit.ID)
+	}
+	sort.Strings(ids)
+
+	expected := []string{mine, alsoMine}
+	sort.Strings(expected)
+	if len(ids) != 2 || ids[0] != expected[0] || ids[1] != expected[1] {
+		t.Errorf("Expected commits %v, got %v", expected, ids)
+	}
+}
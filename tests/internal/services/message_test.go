@@ -0,0 +1,137 @@
+package services_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestMessageBuilderBuild(t *testing.T) {
+	commit := internal.Commit{
+		ID:           "0123456789abcdef0123456789abcdef01234567",
+		Title:        "ACME-42 Fix login for https://acme.example.com/login (#17)",
+		Message:      "ACME-42 Fix login for https://acme.example.com/login (#17)\n\nSee acme/portal!3 for details.",
+		AuthoredDate: time.Date(2024, 3, 5, 23, 30, 0, 0, time.UTC),
+		ProjectID:    7,
+		ProjectPath:  "acme/portal",
+	}
+
+	tests := []struct {
+		name        string
+		template    string
+		redact      []string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "default template keeps the SHA and the project",
+			expected: commit.ID + "\n\nSource-SHA: " + commit.ID + "\nSource-Project: acme/portal",
+		},
+		{
+			name:     "template fields",
+			template: "{{.ProjectPath}} {{.Date}} {{.ShortSHA}}",
+			expected: "acme/portal 2024-03-05 01234567\n\nSource-SHA: " + commit.ID,
+		},
+		{
+			name:     "hashed project name",
+			template: "{{.ProjectPath}}: {{.Title}}",
+			redact:   []string{services.RedactHashProject, services.RedactStripRefs},
+			expected: "project-",
+		},
+		{
+			name:     "first line only",
+			template: "{{.Message}}",
+			redact:   []string{services.RedactFirstLine},
+			expected: "ACME-42 Fix login for https://acme.example.com/login (#17)\n\nSource-SHA: " + commit.ID,
+		},
+		{
+			name:     "strip ticket ids and urls",
+			template: "{{.Message}}",
+			redact:   []string{services.RedactStripRefs},
+			expected: "Fix login for\n\nSee for details.\n\nSource-SHA: " + commit.ID,
+		},
+		{
+			name:        "unknown redaction mode",
+			redact:      []string{"everything"},
+			expectError: true,
+		},
+		{
+			name:        "invalid template",
+			template:    "{{.Nope",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder, err := services.NewMessageBuilder(tt.template, tt.redact, "salt")
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewMessageBuilder returned error: %v", err)
+			}
+
+			message, err := builder.Build(commit)
+			if err != nil {
+				t.Fatalf("Build returned error: %v", err)
+			}
+
+			if !strings.HasPrefix(message, tt.expected) {
+				t.Errorf("Expected message starting with %q, got %q", tt.expected, message)
+			}
+			if strings.Contains(message, "acme") && tt.name == "hashed project name" {
+				t.Errorf("Expected project name to be redacted, got %q", message)
+			}
+			if got := services.SourceSHA(message); got != commit.ID {
+				t.Errorf("Expected source SHA %s, got %s", commit.ID, got)
+			}
+		})
+	}
+}
+
+func TestMessageBuilderHashesProjectID(t *testing.T) {
+	builder, err := services.NewMessageBuilder("{{.ProjectID}}", []string{services.RedactHashProject}, "salt")
+	if err != nil {
+		t.Fatalf("NewMessageBuilder returned error: %v", err)
+	}
+
+	message, err := builder.Build(internal.Commit{ID: "abc123", ProjectID: 7, ProjectPath: "acme/portal"})
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+	title := strings.SplitN(message, "\n", 2)[0]
+	if title == "7" || title != builder.ProjectID(7) {
+		t.Errorf("Expected the hashed project ID %q, got %q", builder.ProjectID(7), title)
+	}
+}
+
+func TestMessageBuilderInstanceTrailer(t *testing.T) {
+	builder, err := services.NewMessageBuilder("", nil, "")
+	if err != nil {
+		t.Fatalf("NewMessageBuilder returned error: %v", err)
+	}
+
+	commit := internal.Commit{ID: "abc123", Instance: "work"}
+	message, err := builder.Build(commit)
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	expected := "abc123\n\nSource-SHA: abc123\nSource-Instance: work\nImporter-Version: dev"
+	if message != expected {
+		t.Errorf("Expected message %q, got %q", expected, message)
+	}
+	if key := services.SourceKey(message); key != commit.Key() || key != "work:abc123" {
+		t.Errorf("Expected key 'work:abc123', got '%s'", key)
+	}
+	if key := services.SourceKey("abc123"); key != "abc123" {
+		t.Errorf("Expected legacy key 'abc123', got '%s'", key)
+	}
+}
@@ -0,0 +1,182 @@
+package services_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+func writePEM(t *testing.T, path string, blockType string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+// clientCertificate creates a self-signed client certificate and returns
+// its pool along with the certificate and key paths.
+func clientCertificate(t *testing.T, dir string) (*x509.CertPool, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "importer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool, certPath, keyPath
+}
+
+func configureHTTP(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for _, name := range []string{"HTTP_PROXY_URL", "TLS_CA_BUNDLE", "TLS_CLIENT_CERT", "TLS_CLIENT_KEY", "TLS_INSECURE_SKIP_VERIFY"} {
+		t.Setenv(name, env[name])
+	}
+	t.Cleanup(func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+		services.ConfigureHTTPClient()
+	})
+	return services.ConfigureHTTPClient()
+}
+
+func TestTLSSettings(t *testing.T) {
+	dir := t.TempDir()
+	clientCAs, certPath, keyPath := clientCertificate(t, dir)
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"username":"testuser","id":1}`)
+	}))
+	mockServer.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+	mockServer.StartTLS()
+	defer mockServer.Close()
+
+	caPath := filepath.Join(dir, "ca.pem")
+	writePEM(t, caPath, "CERTIFICATE", mockServer.Certificate().Raw)
+
+	mtlsServer := httptest.NewUnstartedServer(mockServer.Config.Handler)
+	mtlsServer.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	mtlsServer.StartTLS()
+	defer mtlsServer.Close()
+
+	mtlsCAPath := filepath.Join(dir, "mtls-ca.pem")
+	writePEM(t, mtlsCAPath, "CERTIFICATE", mtlsServer.Certificate().Raw)
+
+	tests := []struct {
+		name        string
+		server      *httptest.Server
+		env         map[string]string
+		expectError bool
+	}{
+		{name: "unknown certificate authority", server: mockServer, expectError: true},
+		{name: "custom CA bundle", server: mockServer, env: map[string]string{"TLS_CA_BUNDLE": caPath}},
+		{name: "insecure skip verify", server: mockServer, env: map[string]string{"TLS_INSECURE_SKIP_VERIFY": "true"}},
+		{name: "missing client certificate", server: mtlsServer, env: map[string]string{"TLS_CA_BUNDLE": mtlsCAPath}, expectError: true},
+		{
+			name:   "client certificate",
+			server: mtlsServer,
+			env:    map[string]string{"TLS_CA_BUNDLE": mtlsCAPath, "TLS_CLIENT_CERT": certPath, "TLS_CLIENT_KEY": keyPath},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := configureHTTP(t, tt.env); err != nil {
+				t.Fatalf("ConfigureHTTPClient returned error: %v", err)
+			}
+
+			source := &services.GitLabSource{BaseURL: tt.server.URL, Token: "token", AuthMode: services.AuthPrivateToken}
+			_, err := source.GetUser()
+			if tt.expectError != (err != nil) {
+				t.Errorf("Expected error %v, got %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestInvalidNetworkSettings(t *testing.T) {
+	tests := []map[string]string{
+		{"HTTP_PROXY_URL": "not a url"},
+		{"TLS_CA_BUNDLE": filepath.Join(t.TempDir(), "missing.pem")},
+		{"TLS_CLIENT_CERT": "client.crt"},
+		{"TLS_INSECURE_SKIP_VERIFY": "maybe"},
+	}
+
+	for _, env := range tests {
+		if err := configureHTTP(t, env); err == nil {
+			t.Errorf("Expected an error for %v", env)
+		}
+	}
+}
+
+func TestProxySettings(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host+r.URL.Path)
+		if r.URL.Path == "/api/v4/user" {
+			fmt.Fprint(w, `{"username":"testuser","id":1}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer proxy.Close()
+
+	if err := configureHTTP(t, map[string]string{"HTTP_PROXY_URL": proxy.URL}); err != nil {
+		t.Fatalf("ConfigureHTTPClient returned error: %v", err)
+	}
+
+	source := &services.GitLabSource{BaseURL: "http://gitlab.internal", Token: "token", AuthMode: services.AuthPrivateToken}
+	if _, err := source.GetUser(); err != nil {
+		t.Fatalf("GetUser returned error: %v", err)
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{"http://git.internal/activity.git"}})
+	remote.List(&git.ListOptions{})
+
+	expected := []string{"gitlab.internal/api/v4/user", "git.internal/activity.git/info/refs"}
+	if fmt.Sprint(proxied) != fmt.Sprint(expected) {
+		t.Errorf("Expected proxied requests %v, got %v", expected, proxied)
+	}
+}
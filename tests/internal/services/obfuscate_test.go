@@ -0,0 +1,166 @@
+package services_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+)
+
+func busyDay(count int) []internal.Commit {
+	var commits []internal.Commit
+	for i := count - 1; i >= 0; i-- {
+		commits = append(commits, internal.Commit{
+			ID:           fmt.Sprintf("c%02d", i),
+			AuthoredDate: time.Date(2024, 6, 10, 8+i/2, 30*(i%2), 0, 0, time.UTC),
+		})
+	}
+	return commits
+}
+
+func commitIDs(commits []internal.Commit) string {
+	var ids []string
+	for _, commit := range commits {
+		ids = append(ids, commit.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestObfuscationApply(t *testing.T) {
+	policy, _ := services.NewDatePolicy("", "")
+	mirrored := time.Date(2024, 6, 10, 7, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		obfuscation services.Obfuscation
+		commits     []internal.Commit
+		existing    []time.Time
+		expected    string
+	}{
+		{name: "disabled", commits: busyDay(3), expected: "c02,c01,c00"},
+		{name: "cap keeps the earliest", obfuscation: services.Obfuscation{Cap: 2}, commits: busyDay(5), expected: "c00,c01"},
+		{name: "cap counts the mirror", obfuscation: services.Obfuscation{Cap: 2}, commits: busyDay(5), existing: []time.Time{mirrored}, expected: "c00"},
+		{name: "cap reached", obfuscation: services.Obfuscation{Cap: 1}, commits: busyDay(5), existing: []time.Time{mirrored}, expected: ""},
+		{name: "levels round down", obfuscation: services.Obfuscation{Levels: []int{1, 3, 6}}, commits: busyDay(5), expected: "c00,c01,c02"},
+		{name: "levels above the last", obfuscation: services.Obfuscation{Levels: []int{1, 3, 6}}, commits: busyDay(9), expected: "c00,c01,c02,c03,c04,c05"},
+		{name: "levels count the mirror", obfuscation: services.Obfuscation{Levels: []int{1, 3, 6}}, commits: busyDay(3), existing: []time.Time{mirrored}, expected: "c00,c01"},
+		{name: "levels and cap", obfuscation: services.Obfuscation{Cap: 4, Levels: []int{1, 3, 6}}, commits: busyDay(9), expected: "c00,c01,c02,c03"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := commitIDs(tt.obfuscation.Apply(tt.commits, tt.existing, policy))
+			if result != tt.expected {
+				t.Errorf("Expected commits %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestObfuscationJitter(t *testing.T) {
+	policy, _ := services.NewDatePolicy("", "")
+	commits := []internal.Commit{
+		{ID: "early", AuthoredDate: time.Date(2024, 6, 10, 0, 30, 0, 0, time.UTC), CommittedDate: time.Date(2024, 6, 10, 0, 45, 0, 0, time.UTC)},
+		{ID: "noon", AuthoredDate: time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)},
+		{ID: "late", AuthoredDate: time.Date(2024, 6, 10, 23, 30, 0, 0, time.FixedZone("", -7*3600))},
+	}
+
+	obfuscation := services.Obfuscation{Jitter: 3 * time.Hour, Seed: "secret"}
+	first := obfuscation.Apply(commits, nil, policy)
+	second := obfuscation.Apply(commits, nil, policy)
+
+	moved := 0
+	for i, commit := range first {
+		if !commit.AuthoredDate.Equal(second[i].AuthoredDate) {
+			t.Errorf("Expected the same jitter on every run for %v, got %v and %v", commit.ID, commit.AuthoredDate, second[i].AuthoredDate)
+		}
+		if commit.AuthoredDate.Format("2006-01-02") != "2024-06-10" {
+			t.Errorf("Expected %v to stay on its day, got %v", commit.ID, commit.AuthoredDate)
+		}
+		if diff := commit.AuthoredDate.Sub(commits[i].AuthoredDate); diff > 3*time.Hour || diff < -3*time.Hour {
+			t.Errorf("Expected %v to move by at most 3h, moved by %v", commit.ID, diff)
+		}
+		if !commit.AuthoredDate.Equal(commits[i].AuthoredDate) {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Errorf("Expected jitter to move commits")
+	}
+	if first[0].CommittedDate.Sub(first[0].AuthoredDate) != 15*time.Minute {
+		t.Errorf("Expected both dates to move together, got %v and %v", first[0].AuthoredDate, first[0].CommittedDate)
+	}
+
+	other := services.Obfuscation{Jitter: 3 * time.Hour, Seed: "other"}.Apply(commits, nil, policy)
+	if other[1].AuthoredDate.Equal(first[1].AuthoredDate) {
+		t.Errorf("Expected another seed to move commits differently")
+	}
+}
+
+func TestObfuscationFromEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		expectErr bool
+		check     func(services.Obfuscation) bool
+	}{
+		{name: "disabled", env: map[string]string{}, check: func(o services.Obfuscation) bool { return !o.Enabled() }},
+		{name: "defaults", env: map[string]string{"OBFUSCATE": "cap, levels,jitter"}, check: func(o services.Obfuscation) bool {
+			return o.Cap == 10 && len(o.Levels) == 4 && o.Jitter == 3*time.Hour
+		}},
+		{name: "settings", env: map[string]string{"OBFUSCATE": "cap,levels,jitter", "OBFUSCATE_CAP": "3", "OBFUSCATE_LEVELS": "2,5", "OBFUSCATE_JITTER": "30m", "OBFUSCATE_SEED": "s"}, check: func(o services.Obfuscation) bool {
+			return o.Cap == 3 && fmt.Sprint(o.Levels) == "[2 5]" && o.Jitter == 30*time.Minute && o.Seed == "s"
+		}},
+		{name: "unknown policy", env: map[string]string{"OBFUSCATE": "blur"}, expectErr: true},
+		{name: "invalid cap", env: map[string]string{"OBFUSCATE": "cap", "OBFUSCATE_CAP": "0"}, expectErr: true},
+		{name: "levels not ascending", env: map[string]string{"OBFUSCATE": "levels", "OBFUSCATE_LEVELS": "3,1"}, expectErr: true},
+		{name: "invalid jitter", env: map[string]string{"OBFUSCATE": "jitter", "OBFUSCATE_JITTER": "soon"}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"OBFUSCATE", "OBFUSCATE_CAP", "OBFUSCATE_LEVELS", "OBFUSCATE_JITTER", "OBFUSCATE_SEED"} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			obfuscation, err := services.ObfuscationFromEnv(nil)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Expected error: %v, got %v", tt.expectErr, err)
+			}
+			if err == nil && !tt.check(obfuscation) {
+				t.Errorf("Unexpected obfuscation %+v", obfuscation)
+			}
+		})
+	}
+}
+
+func TestObfuscatePendingIsStable(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+
+	repo, err := git.PlainInit(filepath.Join(home, "commits-importer"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	policy, _ := services.NewDatePolicy("", "")
+	obfuscation := services.Obfuscation{Cap: 3, Jitter: time.Hour, Seed: "secret"}
+	commits := busyDay(6)
+
+	for run, expected := range []int{3, 0} {
+		pending, err := services.ObfuscatePending(repo, commits, obfuscation, policy)
+		if err != nil {
+			t.Fatalf("ObfuscatePending returned error: %v", err)
+		}
+		if created := services.CreateLocalCommit(repo, pending); created != expected {
+			t.Errorf("Run %d: expected %d commits, got %d", run+1, expected, created)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package services_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+func TestCalendarBucketing(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	lateNight := time.Date(2024, 6, 10, 23, 30, 0, 0, time.FixedZone("", -7*3600))
+
+	tests := []struct {
+		name        string
+		timezone    string
+		expectedDay string
+	}{
+		{name: "original offset", timezone: "original", expectedDay: "2024-06-10"},
+		{name: "UTC", timezone: "UTC", expectedDay: "2024-06-11"},
+		{name: "same offset as the commit", timezone: "America/Los_Angeles", expectedDay: "2024-06-10"},
+		{name: "ahead of the commit", timezone: "Asia/Tokyo", expectedDay: "2024-06-11"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, err := services.ParseTimezone(tt.timezone)
+			if err != nil {
+				t.Fatalf("ParseTimezone returned error: %v", err)
+			}
+
+			calendar := services.NewCalendar(now, location)
+			calendar.AddPending(lateNight)
+			if day := calendar.Day(lateNight); day != tt.expectedDay {
+				t.Errorf("Expected day %s, got %s", tt.expectedDay, day)
+			}
+			if _, pending := calendar.Count(tt.expectedDay); pending != 1 {
+				t.Errorf("Expected 1 pending contribution on %s, got %d", tt.expectedDay, pending)
+			}
+		})
+	}
+}
+
+func TestCalendarRendering(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	calendar := services.NewCalendar(now, time.UTC)
+
+	if calendar.Start.Weekday() != time.Sunday || calendar.End.Format("2006-01-02") != "2024-06-15" {
+		t.Errorf("Unexpected calendar range %v - %v", calendar.Start, calendar.End)
+	}
+
+	for i := 0; i < 4; i++ {
+		calendar.AddExisting(time.Date(2024, 6, 3, 10, 0, 0, 0, time.UTC))
+	}
+	calendar.AddPending(time.Date(2024, 6, 4, 10, 0, 0, 0, time.UTC))
+	calendar.AddPending(time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC))
+
+	var text bytes.Buffer
+	calendar.RenderText(&text)
+	output := text.String()
+	if !strings.Contains(output, "█") || !strings.Contains(output, "░") {
+		t.Errorf("Expected the busiest and the quietest shade in the output:\n%s", output)
+	}
+	if !strings.Contains(output, "4 existing and 1 new contributions on 2 days, at most 4 on a single day.") {
+		t.Errorf("Unexpected summary:\n%s", output)
+	}
+	if lines := strings.Split(strings.TrimSpace(output), "\n"); len(lines) != 10 {
+		t.Errorf("Expected a header, 7 weekday rows and a summary, got %d lines", len(lines))
+	}
+
+	var svg bytes.Buffer
+	if err := calendar.RenderSVG(&svg); err != nil {
+		t.Fatalf("RenderSVG returned error: %v", err)
+	}
+	if count := strings.Count(svg.String(), "<rect"); count != 7*52+7 {
+		t.Errorf("Expected %d days, got %d", 7*52+7, count)
+	}
+	if !strings.Contains(svg.String(), "<title>2024-06-03: 4 existing, 0 new</title>") {
+		t.Errorf("Expected a tooltip for the busiest day")
+	}
+}
+
+func TestPendingCommits(t *testing.T) {
+	repo, _ := newTestRepo(t, "aaa", "Mirror\n\nSource-SHA: bbb\nSource-Instance: work")
+
+	commits := []internal.Commit{
+		{ID: "aaa"},
+		{ID: "bbb", Instance: "work"},
+		{ID: "bbb"},
+		{ID: "ccc"},
+		{ID: "ccc"},
+	}
+	pending, err := services.PendingCommits(repo, commits)
+	if err != nil {
+		t.Fatalf("PendingCommits returned error: %v", err)
+	}
+
+	var ids []string
+	for _, commit := range pending {
+		ids = append(ids, commit.Key())
+	}
+	if strings.Join(ids, ",") != "bbb,ccc" {
+		t.Errorf("Expected pending commits bbb,ccc, got %v", ids)
+	}
+
+	dates, err := services.MirrorCommitDates(repo)
+	if err != nil || len(dates) != 2 {
+		t.Errorf("Expected 2 mirror commit dates, got %v (%v)", dates, err)
+	}
+}
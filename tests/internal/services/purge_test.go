@@ -0,0 +1,285 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func purgeFixture() []internal.Commit {
+	day := func(d int) time.Time {
+		return time.Date(2024, 6, d, 12, 0, 0, 0, time.UTC)
+	}
+	return []internal.Commit{
+		{ID: "aaaa0001", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(10), Stats: internal.CommitStats{Additions: 2}},
+		{ID: "bbbb0001", ProjectID: 2, ProjectPath: "client/web", AuthoredDate: day(11), Stats: internal.CommitStats{Additions: 3}},
+		{ID: "aaaa0002", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(12), Stats: internal.CommitStats{Additions: 1}},
+		{ID: "bbbb0002", ProjectID: 2, ProjectPath: "client/web", AuthoredDate: day(13), Stats: internal.CommitStats{Additions: 1}},
+	}
+}
+
+func newPurgeMirror(t *testing.T, content string) (*git.Repository, string) {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+	t.Setenv("MIRROR_CONTENT", content)
+
+	path := filepath.Join(home, "commits-importer")
+	repo, err := git.PlainInit(path, false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	if created := services.CreateLocalCommit(repo, purgeFixture()); created != 4 {
+		t.Fatalf("Expected 4 imported commits, got %d", created)
+	}
+	return repo, path
+}
+
+func headMessages(t *testing.T, repo *git.Repository) []string {
+	t.Helper()
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read HEAD: %v", err)
+	}
+	iter, err := repo.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		t.Fatalf("Failed to read the log: %v", err)
+	}
+	var messages []string
+	iter.ForEach(func(c *object.Commit) error {
+		messages = append(messages, c.Message)
+		return nil
+	})
+	return messages
+}
+
+func TestPurgeFilters(t *testing.T) {
+	repo, _ := newPurgeMirror(t, "none")
+	builder, _ := services.NewMessageBuilder("", nil, "")
+
+	tests := []struct {
+		name     string
+		filter   services.PurgeFilter
+		expected int
+	}{
+		{name: "project", filter: services.PurgeFilter{Projects: []string{"client/web"}}, expected: 2},
+		{name: "date range", filter: services.PurgeFilter{Since: "2024-06-11", Until: "2024-06-12"}, expected: 2},
+		{name: "project and date range", filter: services.PurgeFilter{Projects: []string{"client/web"}, Since: "2024-06-12"}, expected: 1},
+		{name: "sha prefixes", filter: services.PurgeFilter{SHAs: []string{"aaaa0002", "bbbb"}}, expected: 3},
+		{name: "no match", filter: services.PurgeFilter{Projects: []string{"other"}}, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, _ := repo.Head()
+			result, err := services.PurgeMirror(repo, tt.filter, builder, true)
+			if err != nil {
+				t.Fatalf("PurgeMirror returned error: %v", err)
+			}
+			if len(result.Removed) != tt.expected {
+				t.Errorf("Expected %d commits to be removed, got %d", tt.expected, len(result.Removed))
+			}
+			if current, _ := repo.Head(); current.Hash() != head.Hash() {
+				t.Errorf("Expected a dry run to leave HEAD alone")
+			}
+		})
+	}
+
+	if _, err := services.PurgeMirror(repo, services.PurgeFilter{}, builder, true); err == nil {
+		t.Errorf("Expected an error without a filter")
+	}
+}
+
+func TestPurgeMirrorRewritesHistory(t *testing.T) {
+	repo, path := newPurgeMirror(t, "log")
+	builder, _ := services.NewMessageBuilder("", nil, "")
+
+	result, err := services.PurgeMirror(repo, services.PurgeFilter{Projects: []string{"client/web"}}, builder, false)
+	if err != nil {
+		t.Fatalf("PurgeMirror returned error: %v", err)
+	}
+	if len(result.Removed) != 2 || result.NewHead == result.OldHead {
+		t.Fatalf("Expected 2 removed commits and a new HEAD, got %d and %v", len(result.Removed), result.NewHead)
+	}
+
+	messages := headMessages(t, repo)
+	if len(messages) != 2 {
+		t.Errorf("Expected 2 remaining commits, got %d", len(messages))
+	}
+	for _, message := range messages {
+		if strings.Contains(message, "client/web") {
+			t.Errorf("Expected no commit of the purged project, got %q", message)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "activity", "client__web.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected the activity log of the purged project to be removed, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(path, "activity", "group__api.log")); strings.Count(string(data), "\n") != 3 {
+		t.Errorf("Expected the other activity log to be kept, got %q", data)
+	}
+	purged, err := os.ReadFile(filepath.Join(path, ".purged"))
+	if err != nil || strings.Contains(string(purged), "bbbb0001") || strings.Count(string(purged), "sha ") != 2 {
+		t.Errorf("Expected 2 hashed entries in .purged, got %q (%v)", purged, err)
+	}
+
+	if created := services.CreateLocalCommit(repo, purgeFixture()); created != 0 {
+		t.Errorf("Expected purged commits not to be imported again, got %d", created)
+	}
+	pending, _ := services.PendingCommits(repo, purgeFixture())
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending commits, got %d", len(pending))
+	}
+}
+
+func TestPurgeMirrorLowersCounter(t *testing.T) {
+	repo, path := newPurgeMirror(t, "counter")
+	builder, _ := services.NewMessageBuilder("", nil, "")
+
+	if _, err := services.PurgeMirror(repo, services.PurgeFilter{SHAs: []string{"bbbb0001"}}, builder, false); err != nil {
+		t.Fatalf("PurgeMirror returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(path, "activity", "counter.txt")); strings.TrimSpace(string(data)) != "3" {
+		t.Errorf("Expected the counter to be lowered to 3, got %q", data)
+	}
+}
+
+func TestPurgeDryRunPatches(t *testing.T) {
+	repo, _ := newPurgeMirror(t, "log")
+	builder, _ := services.NewMessageBuilder("", nil, "")
+
+	result, err := services.PurgeMirror(repo, services.PurgeFilter{SHAs: []string{"bbbb0001"}}, builder, true)
+	if err != nil {
+		t.Fatalf("PurgeMirror returned error: %v", err)
+	}
+	if len(result.Rewritten) != 2 {
+		t.Fatalf("Expected the 2 later commits to be rewritten, got %d", len(result.Rewritten))
+	}
+	for _, rewritten := range result.Rewritten {
+		patch := rewritten.Patch.String()
+		if !strings.Contains(patch, "activity/client__web.log") || !strings.Contains(patch, "\n-") {
+			t.Errorf("Expected a patch removing a line of the activity log from %v, got:\n%s", rewritten.Commit.Hash, patch)
+		}
+	}
+}
+
+func TestForcePublishAllPrunesExport(t *testing.T) {
+	repo, _ := newPurgeMirror(t, "log")
+	builder, _ := services.NewMessageBuilder("", nil, "")
+	export := &services.DirectoryExport{Path: filepath.Join(t.TempDir(), "export")}
+	if err := export.Publish(repo); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+
+	result, err := services.PurgeMirror(repo, services.PurgeFilter{Projects: []string{"client/web"}}, builder, false)
+	if err != nil {
+		t.Fatalf("PurgeMirror returned error: %v", err)
+	}
+	if err := services.ForcePublishAll(repo, []services.Destination{export}, result.Branches()); err != nil {
+		t.Fatalf("ForcePublishAll returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(export.Path, "activity", "client__web.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected the purged activity log to be removed from the export, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(export.Path, "activity", "group__api.log")); err != nil {
+		t.Errorf("Expected the other activity log to be kept, got %v", err)
+	}
+}
+
+func TestForcePublishAllUsesLease(t *testing.T) {
+	repo, _ := newPurgeMirror(t, "log")
+	builder, _ := services.NewMessageBuilder("", nil, "")
+
+	remotePath := filepath.Join(t.TempDir(), "remote.git")
+	destination := &services.BareRepository{RemoteName: "backup", Path: remotePath}
+	if err := destination.Publish(repo); err != nil {
+		t.Fatalf("Failed to publish the mirror: %v", err)
+	}
+
+	result, err := services.PurgeMirror(repo, services.PurgeFilter{Until: "2024-06-10"}, builder, false)
+	if err != nil {
+		t.Fatalf("PurgeMirror returned error: %v", err)
+	}
+
+	stale := plumbing.NewHash("1111111111111111111111111111111111111111")
+	if err := services.ForcePublishAll(repo, []services.Destination{destination}, []services.PurgedBranch{{Name: result.Branch, OldHead: stale}}); err == nil {
+		t.Errorf("Expected a push with a stale lease to be rejected")
+	}
+	if err := services.ForcePublishAll(repo, []services.Destination{destination}, result.Branches()); err != nil {
+		t.Fatalf("ForcePublishAll returned error: %v", err)
+	}
+
+	remote, err := git.PlainOpen(remotePath)
+	if err != nil {
+		t.Fatalf("Failed to open the remote: %v", err)
+	}
+	ref, err := remote.Reference(result.Branch, true)
+	if err != nil || ref.Hash() != result.NewHead {
+		t.Errorf("Expected the remote branch at %v, got %v (%v)", result.NewHead, ref, err)
+	}
+}
+
+func TestPurgeReadsInterimMessages(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	repo, err := git.PlainInit(filepath.Join(home, "commits-importer"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	workTree, _ := repo.Worktree()
+
+	// Messages written before the commits carried the full provenance.
+	messages := []string{
+		"aaaa0001\n\nSource-SHA: aaaa0001\nSource-Project: group/api",
+		"bbbb0001\n\nSource-SHA: bbbb0001\nSource-Project: client/web",
+		"2 contributions to client/web on 2024-06-12\n\nSource-Group: day:2024-06-12:0123abcd\nSource-Count: 2\nSource-Project: client/web",
+	}
+	for i, message := range messages {
+		if err := os.WriteFile(filepath.Join(home, "commits-importer", "file.txt"), []byte(message), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		workTree.Add("file.txt")
+		signature := &object.Signature{Name: "Test User", Email: "test@example.com", When: time.Date(2024, 6, 10+i, 12, 0, 0, 0, time.UTC)}
+		if _, err := workTree.Commit(message, &git.CommitOptions{Author: signature}); err != nil {
+			t.Fatalf("Failed to commit: %v", err)
+		}
+	}
+
+	aggregate := services.ParseProvenance(messages[2])
+	if aggregate.Group != "day:2024-06-12:0123abcd" || aggregate.Count != 2 || aggregate.SHA != "" || aggregate.ProjectPath != "client/web" {
+		t.Errorf("Unexpected provenance of the aggregated commit: %+v", aggregate)
+	}
+
+	builder, _ := services.NewMessageBuilder("", nil, "")
+	tests := []struct {
+		name     string
+		filter   services.PurgeFilter
+		expected int
+	}{
+		{name: "project", filter: services.PurgeFilter{Projects: []string{"client/web"}}, expected: 2},
+		{name: "sha", filter: services.PurgeFilter{SHAs: []string{"aaaa"}}, expected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := services.PurgeMirror(repo, tt.filter, builder, true)
+			if err != nil {
+				t.Fatalf("PurgeMirror returned error: %v", err)
+			}
+			if len(result.Removed) != tt.expected || result.Unattributed != 0 {
+				t.Errorf("Expected %d commits removed and all attributed, got %d and %d unattributed", tt.expected, len(result.Removed), result.Unattributed)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package services_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func pushCommit(id string, day int) internal.Commit {
+	return internal.Commit{
+		ID:           id,
+		ProjectID:    1,
+		ProjectPath:  "group/api",
+		AuthoredDate: time.Date(2024, 6, day, 12, 0, 0, 0, time.UTC),
+		Stats:        internal.CommitStats{Additions: 1},
+	}
+}
+
+// pushMachine is a home directory with its own mirror, like another
+// machine running the importer against the same remote.
+type pushMachine struct {
+	home string
+	repo *git.Repository
+}
+
+func (m *pushMachine) use(t *testing.T) {
+	t.Setenv("HOME", m.home)
+}
+
+func (m *pushMachine) importCommits(t *testing.T, commits ...internal.Commit) {
+	m.use(t)
+	services.CreateLocalCommit(m.repo, commits)
+}
+
+func (m *pushMachine) publish(t *testing.T, remote string) error {
+	m.use(t)
+	return (&services.BareRepository{RemoteName: "origin", Path: remote}).Publish(m.repo)
+}
+
+// newPushSetup publishes a first import from machine a and clones the
+// result as machine b.
+func newPushSetup(t *testing.T) (string, *pushMachine, *pushMachine) {
+	t.Helper()
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+	t.Setenv("MIRROR_CONTENT", "log")
+	t.Setenv("PUSH_CONFLICT", "")
+	t.Setenv("PUSH_LEASE_HASH", "")
+
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatalf("Failed to init the remote: %v", err)
+	}
+
+	a := &pushMachine{home: t.TempDir()}
+	repo, err := git.PlainInit(filepath.Join(a.home, "commits-importer"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+	a.repo = repo
+	a.importCommits(t, pushCommit("aaaa0001", 10))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish the first import: %v", err)
+	}
+
+	b := &pushMachine{home: t.TempDir()}
+	if b.repo, err = git.PlainClone(filepath.Join(b.home, "commits-importer"), false, &git.CloneOptions{URL: remote}); err != nil {
+		t.Fatalf("Failed to clone the remote: %v", err)
+	}
+	return remote, a, b
+}
+
+func remoteHead(t *testing.T, remote string) *object.Commit {
+	t.Helper()
+	repo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatalf("Failed to open the remote: %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read the remote HEAD: %v", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("Failed to read the remote HEAD commit: %v", err)
+	}
+	return commit
+}
+
+func remoteSubjects(t *testing.T, remote string) []string {
+	t.Helper()
+	var subjects []string
+	commit := remoteHead(t, remote)
+	iter := object.NewCommitPreorderIter(commit, nil, nil)
+	iter.ForEach(func(c *object.Commit) error {
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects = append(subjects, subject)
+		return nil
+	})
+	return subjects
+}
+
+func remoteFile(t *testing.T, remote string, name string) string {
+	t.Helper()
+	file, err := remoteHead(t, remote).File(name)
+	if err != nil {
+		t.Fatalf("Failed to read %v from the remote: %v", name, err)
+	}
+	content, _ := file.Contents()
+	return content
+}
+
+func TestSafePushRebasesOntoRemoteEdits(t *testing.T) {
+	remote, a, b := newPushSetup(t)
+
+	b.use(t)
+	if err := os.WriteFile(filepath.Join(b.home, "commits-importer", "readme.md"), []byte("Edited on the forge."), 0o644); err != nil {
+		t.Fatalf("Failed to edit the readme: %v", err)
+	}
+	workTree, _ := b.repo.Worktree()
+	workTree.Add("readme.md")
+	signature := &object.Signature{Name: "Someone", Email: "someone@example.com", When: time.Now()}
+	if _, err := workTree.Commit("Edit readme", &git.CommitOptions{Author: signature}); err != nil {
+		t.Fatalf("Failed to commit the readme: %v", err)
+	}
+	if err := b.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish the readme edit: %v", err)
+	}
+
+	a.importCommits(t, pushCommit("aaaa0001", 10), pushCommit("aaaa0002", 11))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Expected the rejected push to be rebased, got %v", err)
+	}
+
+	if subjects := strings.Join(remoteSubjects(t, remote), ","); subjects != "aaaa0002,Edit readme,aaaa0001" {
+		t.Errorf("Expected a linear history, got %v", subjects)
+	}
+	if readme := remoteFile(t, remote, "readme.md"); readme != "Edited on the forge." {
+		t.Errorf("Expected the readme edit to be kept, got %q", readme)
+	}
+	if head, _ := a.repo.Head(); head.Hash() != remoteHead(t, remote).Hash {
+		t.Errorf("Expected the local mirror to match the remote")
+	}
+}
+
+func TestSafePushDropsImportsOfConcurrentRuns(t *testing.T) {
+	remote, a, b := newPushSetup(t)
+
+	b.importCommits(t, pushCommit("aaaa0002", 11))
+	if err := b.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish from the second machine: %v", err)
+	}
+
+	a.importCommits(t, pushCommit("aaaa0002", 11), pushCommit("aaaa0003", 12))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Expected the rejected push to be rebased, got %v", err)
+	}
+
+	if subjects := strings.Join(remoteSubjects(t, remote), ","); subjects != "aaaa0003,aaaa0002,aaaa0001" {
+		t.Errorf("Expected every import once, got %v", subjects)
+	}
+	activity := remoteFile(t, remote, "activity/group__api.log")
+	expected := "2024-06-10 aaaa0001 1\n2024-06-11 aaaa0002 1\n2024-06-12 aaaa0003 1\n"
+	if activity != expected {
+		t.Errorf("Expected the activity logs to be merged, got %q", activity)
+	}
+}
+
+func TestSafePushConflictModes(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		expectErr bool
+		parents   int
+	}{
+		{name: "merge", mode: services.PushConflictMerge, parents: 2},
+		{name: "fail", mode: services.PushConflictFail, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, a, b := newPushSetup(t)
+			b.importCommits(t, pushCommit("bbbb0001", 11))
+			if err := b.publish(t, remote); err != nil {
+				t.Fatalf("Failed to publish from the second machine: %v", err)
+			}
+
+			t.Setenv("PUSH_CONFLICT", tt.mode)
+			a.importCommits(t, pushCommit("aaaa0002", 12))
+			err := a.publish(t, remote)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("Expected error: %v, got %v", tt.expectErr, err)
+			}
+			if tt.parents > 0 && remoteHead(t, remote).NumParents() != tt.parents {
+				t.Errorf("Expected a merge commit on the remote")
+			}
+		})
+	}
+}
+
+func TestSafePushWithLease(t *testing.T) {
+	remote, a, b := newPushSetup(t)
+	b.importCommits(t, pushCommit("bbbb0001", 11))
+	if err := b.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish from the second machine: %v", err)
+	}
+	moved := remoteHead(t, remote).Hash
+
+	a.importCommits(t, pushCommit("aaaa0002", 12))
+	t.Setenv("PUSH_LEASE_HASH", "1111111111111111111111111111111111111111")
+	if err := a.publish(t, remote); err == nil || !strings.Contains(err.Error(), "no longer at the expected") {
+		t.Errorf("Expected a stale lease to be rejected, got %v", err)
+	}
+	if remoteHead(t, remote).Hash != moved {
+		t.Errorf("Expected the remote to be left alone")
+	}
+
+	t.Setenv("PUSH_LEASE_HASH", moved.String())
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Expected the push with a matching lease to succeed, got %v", err)
+	}
+	if head, _ := a.repo.Head(); remoteHead(t, remote).Hash != head.Hash() {
+		t.Errorf("Expected the remote to be overwritten with the local mirror")
+	}
+
+	t.Setenv("PUSH_LEASE_HASH", "nope")
+	if _, err := services.PushSettingsFromEnv("origin"); err == nil {
+		t.Errorf("Expected an invalid lease hash to be rejected")
+	}
+}
+
+func TestLeaseIsScopedPerDestination(t *testing.T) {
+	remote, a, _ := newPushSetup(t)
+	backup := &services.BareRepository{RemoteName: "backup", Path: remote}
+	published := remoteHead(t, remote).Hash
+	stale := "1111111111111111111111111111111111111111"
+
+	a.importCommits(t, pushCommit("aaaa0002", 12))
+	a.use(t)
+	t.Setenv("DESTINATION_BACKUP_LEASE_HASH", stale)
+	if err := backup.Publish(a.repo); err == nil || !strings.Contains(err.Error(), "no longer at the expected") {
+		t.Errorf("Expected the stale lease of backup to be rejected, got %v", err)
+	}
+	if _, err := a.repo.Reference(plumbing.NewRemoteReferenceName("backup", "master"), false); err != plumbing.ErrReferenceNotFound {
+		t.Errorf("Expected the tracking branch planted for the lease to be removed, got %v", err)
+	}
+	if remoteHead(t, remote).Hash != published {
+		t.Errorf("Expected the remote to be left alone")
+	}
+
+	// The origin lease does not apply to other destinations.
+	t.Setenv("DESTINATION_BACKUP_LEASE_HASH", "")
+	t.Setenv("PUSH_LEASE_HASH", stale)
+	if err := backup.Publish(a.repo); err != nil {
+		t.Fatalf("Expected backup to be pushed without a lease, got %v", err)
+	}
+	if head, _ := a.repo.Head(); remoteHead(t, remote).Hash != head.Hash() {
+		t.Errorf("Expected the remote to have the new import")
+	}
+}
+
+func TestSafePushOnlyIntegratesOrigin(t *testing.T) {
+	remote, a, b := newPushSetup(t)
+	backupPath := filepath.Join(t.TempDir(), "backup.git")
+	backup := &services.BareRepository{RemoteName: "backup", Path: backupPath}
+	a.use(t)
+	if err := backup.Publish(a.repo); err != nil {
+		t.Fatalf("Failed to publish to backup: %v", err)
+	}
+
+	b.importCommits(t, pushCommit("bbbb0001", 11))
+	if err := backup.Publish(b.repo); err != nil {
+		t.Fatalf("Failed to publish to backup from the second machine: %v", err)
+	}
+	moved := remoteHead(t, backupPath).Hash
+
+	a.importCommits(t, pushCommit("aaaa0002", 12))
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish to origin: %v", err)
+	}
+	head, _ := a.repo.Head()
+	if err := backup.Publish(a.repo); err == nil || !strings.Contains(err.Error(), "only origin") {
+		t.Errorf("Expected the diverged backup to be reported, got %v", err)
+	}
+	if after, _ := a.repo.Head(); after.Hash() != head.Hash() {
+		t.Errorf("Expected the mirror not to integrate backup, got %v", after.Hash())
+	}
+	if remoteHead(t, backupPath).Hash != moved {
+		t.Errorf("Expected backup to be left alone")
+	}
+}
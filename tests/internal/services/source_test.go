@@ -0,0 +1,170 @@
+package services_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+)
+
+type fakeSource struct {
+	projects []internal.Project
+	commits  map[int][]internal.Commit
+}
+
+func (s *fakeSource) Name() string {
+	return "fake"
+}
+
+func (s *fakeSource) ListProjects() ([]internal.Project, error) {
+	return s.projects, nil
+}
+
+func (s *fakeSource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	projectCommits, ok := s.commits[project.ID]
+	if !ok {
+		return errors.New("project not found")
+	}
+	for _, commit := range projectCommits {
+		commits <- commit
+	}
+	return nil
+}
+
+func TestFetchAllCommits(t *testing.T) {
+	source := &fakeSource{
+		projects: []internal.Project{{ID: 1}, {ID: 2}, {ID: 3}},
+		commits: map[int][]internal.Commit{
+			1: {{ID: "a"}, {ID: "b"}},
+			2: {{ID: "c"}},
+		},
+	}
+
+	projects, err := services.ListAllProjects([]services.Source{source})
+	if err != nil {
+		t.Fatalf("ListAllProjects returned error: %v", err)
+	}
+	if len(projects) != 3 {
+		t.Fatalf("Expected 3 projects, got %d", len(projects))
+	}
+
+	commitChannel := make(chan []internal.Commit, len(projects))
+	services.FetchAllCommits(projects, commitChannel)
+
+	var ids []string
+	batches := 0
+	for commits := range commitChannel {
+		batches++
+		for _, commit := range commits {
+			ids = append(ids, commit.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	if batches != 2 {
+		t.Errorf("Expected 2 batches, got %d", batches)
+	}
+	if fmt.Sprint(ids) != "[a b c]" {
+		t.Errorf("Expected commits [a b c], got %v", ids)
+	}
+}
+
+// slowSource records how many projects are listed at the same time.
+type slowSource struct {
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (s *slowSource) Name() string {
+	return "slow"
+}
+
+func (s *slowSource) ListProjects() ([]internal.Project, error) {
+	var projects []internal.Project
+	for id := 1; id <= 30; id++ {
+		projects = append(projects, internal.Project{ID: id})
+	}
+	return projects, nil
+}
+
+func (s *slowSource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.peak {
+		s.peak = s.running
+	}
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	commits <- internal.Commit{ID: fmt.Sprint(project.ID)}
+
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	return nil
+}
+
+func TestFetchAllCommitsBoundsConcurrency(t *testing.T) {
+	source := &slowSource{}
+	projects, err := services.ListAllProjects([]services.Source{source})
+	if err != nil {
+		t.Fatalf("ListAllProjects returned error: %v", err)
+	}
+
+	commitChannel := make(chan []internal.Commit, len(projects))
+	services.FetchAllCommits(projects, commitChannel)
+
+	fetched := 0
+	for commits := range commitChannel {
+		fetched += len(commits)
+	}
+	if fetched != len(projects) {
+		t.Errorf("Expected %d commits, got %d", len(projects), fetched)
+	}
+	if source.peak > 8 {
+		t.Errorf("Expected at most 8 projects fetched at once, got %d", source.peak)
+	}
+
+	source.peak = 0
+	builder, _ := services.NewMessageBuilder("", nil, "")
+	commits, failed := services.FetchCommitsForVerify(projects, builder)
+	if len(commits) != len(projects) || len(failed) != 0 {
+		t.Errorf("Expected %d commits and no failures, got %d and %v", len(projects), len(commits), failed)
+	}
+	if source.peak > 8 {
+		t.Errorf("Expected at most 8 projects fetched at once for verify, got %d", source.peak)
+	}
+}
+
+func TestGitLabSourceListCommits(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "1" {
+			fmt.Fprint(w, `[{"id":"123","title":"first","message":"first"}]`)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	}))
+	defer mockServer.Close()
+
+	source := &services.GitLabSource{BaseURL: mockServer.URL, Token: "test-token", Author: "user"}
+	commits := make(chan internal.Commit, 10)
+
+	err := source.ListCommits(internal.Project{ID: 5, Path: "group/project"}, commits)
+	if err != nil {
+		t.Fatalf("ListCommits returned error: %v", err)
+	}
+	close(commits)
+
+	commit := <-commits
+	if commit.ID != "123" || commit.ProjectID != 5 || commit.ProjectPath != "group/project" {
+		t.Errorf("Unexpected commit: %+v", commit)
+	}
+}
@@ -0,0 +1,170 @@
+package services_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/furmanp/gitlab-activity-importer/internal"
+	"github.com/furmanp/gitlab-activity-importer/internal/services"
+	"github.com/go-git/go-git/v5"
+)
+
+type verifySource struct {
+	fakeSource
+	errors map[int]error
+}
+
+func (s *verifySource) ListCommits(project internal.Project, commits chan<- internal.Commit) error {
+	if err, ok := s.errors[project.ID]; ok {
+		return err
+	}
+	return s.fakeSource.ListCommits(project, commits)
+}
+
+func TestFetchCommitsForVerify(t *testing.T) {
+	source := &verifySource{
+		fakeSource: fakeSource{commits: map[int][]internal.Commit{1: {{ID: "a"}, {ID: "b"}}}},
+		errors: map[int]error{
+			2: &services.APIError{StatusCode: http.StatusNotFound},
+			3: errors.New("connection reset"),
+		},
+	}
+	projects := []services.ProjectRef{
+		{Source: source, Project: internal.Project{ID: 1, Path: "group/api"}},
+		{Source: source, Project: internal.Project{ID: 2, Path: "group/gone"}},
+		{Source: source, Project: internal.Project{ID: 3, Path: "group/flaky"}},
+	}
+	builder, _ := services.NewMessageBuilder("", nil, "")
+
+	commits, failed := services.FetchCommitsForVerify(projects, builder)
+	if len(commits) != 2 {
+		t.Errorf("Expected 2 commits, got %d", len(commits))
+	}
+	if len(failed) != 1 || !failed["group/flaky"] {
+		t.Errorf("Expected only group/flaky to fail, got %v", failed)
+	}
+}
+
+func TestVerifyMirror(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("COMMITER_NAME", "Test User")
+	t.Setenv("COMMITER_EMAIL", "test@example.com")
+
+	repo, err := git.PlainInit(filepath.Join(home, "commits-importer"), false)
+	if err != nil {
+		t.Fatalf("Failed to init repository: %v", err)
+	}
+
+	day := func(d int, hour int) time.Time {
+		return time.Date(2024, 6, d, hour, 0, 0, 0, time.UTC)
+	}
+	imported := []internal.Commit{
+		{ID: "aaaa0001", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(10, 9)},
+		{ID: "aaaa0002", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(11, 9)},
+		{ID: "bbbb0001", ProjectID: 2, ProjectPath: "client/web", AuthoredDate: day(12, 9)},
+	}
+	services.CreateLocalCommit(repo, imported)
+	policy, _ := services.NewDatePolicy("", "")
+
+	upstream := []internal.Commit{
+		imported[0],
+		{ID: "aaaa0002", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(11, 15)},
+		{ID: "aaaa0003", ProjectID: 1, ProjectPath: "group/api", AuthoredDate: day(13, 9)},
+	}
+
+	tests := []struct {
+		name       string
+		commits    []internal.Commit
+		unverified map[string]bool
+		sources    []services.Source
+		expected   string
+		drift      bool
+	}{
+		{name: "in sync", commits: imported, expected: "Checked 3 mirror commits against 3 source commits: no drift.", drift: false},
+		{
+			name:     "drift",
+			commits:  upstream,
+			expected: "Missing from the mirror (1):\n  - aaaa0003 2024-06-13T09:00:00Z group/api\nSource commit no longer found (1):",
+			drift:    true,
+		},
+		{
+			name:       "project that failed to fetch",
+			commits:    imported[:2],
+			unverified: map[string]bool{"client/web": true},
+			expected:   "1 mirror commits belong to projects that could not be fetched and were not checked.\nChecked 2 mirror commits against 2 source commits: no drift.",
+			drift:      false,
+		},
+		{
+			name:    "commits the sources no longer fetch",
+			commits: imported[1:2],
+			sources: []services.Source{&services.GitLabSource{Since: day(11, 0), ExcludeProjects: []string{"client/*"}}},
+			expected: "2 mirror commits are outside the since dates or project filters of the sources and were not checked.\n" +
+				"Checked 1 mirror commits against 1 source commits: no drift.",
+			drift: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := services.VerifyMirror(repo, tt.commits, services.VerifyOptions{
+				Policy:      policy,
+				Aggregation: services.AggregateNone,
+				Unverified:  tt.unverified,
+				Sources:     tt.sources,
+			})
+			if err != nil {
+				t.Fatalf("VerifyMirror returned error: %v", err)
+			}
+			if report.Drift() != tt.drift {
+				t.Errorf("Expected drift %v, got %v", tt.drift, report.Drift())
+			}
+
+			var output bytes.Buffer
+			report.Print(&output)
+			if !strings.Contains(output.String(), tt.expected) {
+				t.Errorf("Expected output containing %q, got:\n%s", tt.expected, output.String())
+			}
+			if tt.name == "drift" && (len(report.DateMismatches) != 1 || report.DateMismatches[0].Mirror.Provenance.SHA != "aaaa0002") {
+				t.Errorf("Expected a date mismatch for aaaa0002, got %+v", report.DateMismatches)
+			}
+		})
+	}
+}
+
+func TestVerifyMirrorReadsRemoteTrackingBranch(t *testing.T) {
+	remote, a, b := newPushSetup(t)
+	t.Setenv("TARGET_BRANCH", "")
+	t.Setenv("IMPORT_BRANCH", "")
+	t.Setenv("ORIGIN_REPO_URL", remote)
+
+	published := []internal.Commit{pushCommit("aaaa0001", 10), pushCommit("aaaa0002", 11)}
+	a.importCommits(t, published...)
+	if err := a.publish(t, remote); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	local := pushCommit("bbbb0001", 12)
+	b.importCommits(t, local)
+	head, _ := b.repo.Head()
+
+	repo, err := services.OpenMirrorReadOnly()
+	if err != nil {
+		t.Fatalf("OpenMirrorReadOnly returned error: %v", err)
+	}
+	policy, _ := services.NewDatePolicy("", "")
+	report, err := services.VerifyMirror(repo, append(published, local), services.VerifyOptions{Policy: policy, Aggregation: services.AggregateNone})
+	if err != nil {
+		t.Fatalf("VerifyMirror returned error: %v", err)
+	}
+	if report.Drift() || report.Checked != 3 {
+		t.Errorf("Expected 3 commits checked without drift, got %+v", report)
+	}
+	if after, _ := repo.Head(); after.Hash() != head.Hash() {
+		t.Errorf("Expected verify to leave the branch at %v, got %v", head.Hash(), after.Hash())
+	}
+}
@@ -17,6 +17,9 @@ func clearEnvVars(t *testing.T) {
 		"COMMITER_EMAIL",
 		"ORIGIN_REPO_URL",
 		"ORIGIN_TOKEN",
+		"LOCAL_REPOS",
+		"DESTINATIONS",
+		"DESTINATION_GITEA_TOKEN",
 	}
 
 	for _, v := range vars {
@@ -28,10 +31,11 @@ func clearEnvVars(t *testing.T) {
 
 func TestCheckEnvVariables(t *testing.T) {
 	tests := []struct {
-		name        string
-		setupEnv    map[string]string
-		expectError bool
-		errorMsg    string
+		name            string
+		setupEnv        map[string]string
+		skipOriginToken bool
+		expectError     bool
+		errorMsg        string
 	}{
 		{
 			name: "all required variables set",
@@ -57,6 +61,29 @@ func TestCheckEnvVariables(t *testing.T) {
 			expectError: true,
 			errorMsg:    "ORIGIN_REPO_URL",
 		},
+		{
+			name: "local repositories without gitlab",
+			setupEnv: map[string]string{
+				"LOCAL_REPOS":     "/src",
+				"COMMITER_NAME":   "Test User",
+				"COMMITER_EMAIL":  "test@example.com",
+				"ORIGIN_REPO_URL": "http://repo.com",
+				"ORIGIN_TOKEN":    "origintoken123",
+			},
+			expectError: false,
+		},
+		{
+			name: "origin token not required",
+			setupEnv: map[string]string{
+				"BASE_URL":        "http://test-url.com",
+				"GITLAB_TOKEN":    "token123",
+				"COMMITER_NAME":   "Test User",
+				"COMMITER_EMAIL":  "test@example.com",
+				"ORIGIN_REPO_URL": "git@github.com:user/repo.git",
+			},
+			skipOriginToken: true,
+			expectError:     false,
+		},
 		{
 			name: "missing multiple variables",
 			setupEnv: map[string]string{
@@ -83,7 +110,7 @@ func TestCheckEnvVariables(t *testing.T) {
 				}
 			}
 
-			err := internal.CheckEnvVariables()
+			err := internal.CheckEnvVariables(!tt.skipOriginToken)
 
 			if tt.expectError && err == nil {
 				t.Error("expected error but got none")
@@ -105,7 +132,7 @@ func TestCheckEnvVariables_Development(t *testing.T) {
 		t.Fatalf("failed to set ENV: %v", err)
 	}
 
-	err := internal.CheckEnvVariables()
+	err := internal.CheckEnvVariables(true)
 
 	if err == nil {
 		t.Error("expected error due to missing .env file but got none")